@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	bn256 "github.com/ethereum/go-ethereum/crypto/bn256/cloudflare"
+)
+
+// bn256FieldModulus is the prime p of the base field of the curve y^2 = x^3 + 3.
+var bn256FieldModulus, _ = new(big.Int).SetString("30644e72e131a029b85045b68181585d97816a916871ca8d3c208c16d87cfd47", 16)
+
+// DecompressG1 parses a signature in the 33 byte format of the aggregate signer: 02 or 03 for an even or odd y
+// followed by x.
+func DecompressG1(compressed string) (*bn256.G1, error) {
+	data, err := hex.DecodeString(compressed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 33 || (data[0] != 2 && data[0] != 3) {
+		return nil, fmt.Errorf("invalid compressed G1 point %s", compressed)
+	}
+	x := new(big.Int).SetBytes(data[1:])
+	if x.Cmp(bn256FieldModulus) >= 0 {
+		return nil, fmt.Errorf("invalid compressed G1 point %s", compressed)
+	}
+	y_squared := new(big.Int).Exp(x, big.NewInt(3), bn256FieldModulus)
+	y_squared.Add(y_squared, big.NewInt(3)).Mod(y_squared, bn256FieldModulus)
+	// p = 3 mod 4, so the square root is y^((p+1)/4)
+	exponent := new(big.Int).Rsh(new(big.Int).Add(bn256FieldModulus, big.NewInt(1)), 2)
+	y := new(big.Int).Exp(y_squared, exponent, bn256FieldModulus)
+	if new(big.Int).Exp(y, big.NewInt(2), bn256FieldModulus).Cmp(y_squared) != 0 {
+		return nil, fmt.Errorf("compressed G1 point %s is not on the curve", compressed)
+	}
+	if y.Bit(0) != uint(data[0]-2) {
+		y.Sub(bn256FieldModulus, y)
+	}
+	point := make([]byte, 64)
+	x.FillBytes(point[:32])
+	y.FillBytes(point[32:])
+	g1 := new(bn256.G1)
+	if _, err := g1.Unmarshal(point); err != nil {
+		return nil, err
+	}
+	return g1, nil
+}
+
+func CompressG1(g1 *bn256.G1) string {
+	point := g1.Marshal()
+	prefix := "02"
+	if point[63]&1 == 1 {
+		prefix = "03"
+	}
+	return prefix + hex.EncodeToString(point[:32])
+}
+
+// G2FromComponents parses a public key given as four hex words in the order of validators.json and of the
+// aggregate signer output: x real, x imaginary, y real, y imaginary. The curve library orders each
+// coordinate imaginary part first.
+func G2FromComponents(components []string) (*bn256.G2, error) {
+	if len(components) != 4 {
+		return nil, fmt.Errorf("G2 public key has %d components instead of 4", len(components))
+	}
+	point := []byte{}
+	for _, i := range []int{1, 0, 3, 2} {
+		word, err := hex.DecodeString(fmt.Sprintf("%064s", components[i]))
+		if err != nil || len(word) != 32 {
+			return nil, fmt.Errorf("invalid G2 public key component %s", components[i])
+		}
+		point = append(point, word...)
+	}
+	g2 := new(bn256.G2)
+	if _, err := g2.Unmarshal(point); err != nil {
+		return nil, err
+	}
+	return g2, nil
+}
+
+func G2Components(g2 *bn256.G2) []string {
+	point := g2.Marshal()
+	components := []string{}
+	for _, i := range []int{1, 0, 3, 2} {
+		components = append(components, hex.EncodeToString(point[i*32:(i+1)*32]))
+	}
+	return components
+}
+
+// AggregatePartialSignatures adds the signatures of several validators over the same message, giving the
+// signature AggregateSignature would produce with all of their keys.
+func AggregatePartialSignatures(signatures []string) (string, error) {
+	if len(signatures) == 0 {
+		return "", fmt.Errorf("no signatures to aggregate")
+	}
+	aggregate := new(bn256.G1)
+	for i, signature := range signatures {
+		g1, err := DecompressG1(signature)
+		if err != nil {
+			return "", err
+		}
+		if i == 0 {
+			aggregate.Set(g1)
+		} else {
+			aggregate.Add(aggregate, g1)
+		}
+	}
+	return CompressG1(aggregate), nil
+}
+
+// AggregatePublicKeys adds G2 public keys into the key the contract checks an aggregate signature against.
+func AggregatePublicKeys(public_keys [][]string) ([]string, error) {
+	if len(public_keys) == 0 {
+		return nil, fmt.Errorf("no public keys to aggregate")
+	}
+	aggregate := new(bn256.G2)
+	for i, public_key := range public_keys {
+		g2, err := G2FromComponents(public_key)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			aggregate.Set(g2)
+		} else {
+			aggregate.Add(aggregate, g2)
+		}
+	}
+	return G2Components(aggregate), nil
+}
+
+// VerifySameMessage checks that two signatures, each under its own public key, are over the same message:
+// e(a, pk_b) == e(b, pk_a). The message hash of the aggregate signer cannot be computed here, so a partial
+// signature is verified against a signature this node made itself.
+func VerifySameMessage(signature_a string, public_key_a []string, signature_b string, public_key_b []string) error {
+	a, err := DecompressG1(signature_a)
+	if err != nil {
+		return err
+	}
+	b, err := DecompressG1(signature_b)
+	if err != nil {
+		return err
+	}
+	pk_a, err := G2FromComponents(public_key_a)
+	if err != nil {
+		return err
+	}
+	pk_b, err := G2FromComponents(public_key_b)
+	if err != nil {
+		return err
+	}
+	if !bn256.PairingCheck([]*bn256.G1{a, new(bn256.G1).Neg(b)}, []*bn256.G2{pk_b, pk_a}) {
+		return fmt.Errorf("signatures are not over the same message")
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"reflect"
+	"testing"
+
+	bn256 "github.com/ethereum/go-ethereum/crypto/bn256/cloudflare"
+)
+
+// testHashToG1 maps a message to G1 by try-and-increment. It stands in for the hash of the aggregate signer
+// binary, which the tests cannot run, so partial signatures can be produced and checked in Go.
+func testHashToG1(message string) *bn256.G1 {
+	for counter := 0; counter < 256; counter++ {
+		digest := sha256.Sum256(append([]byte(message), byte(counter)))
+		if point, err := DecompressG1("02" + hex.EncodeToString(digest[:])); err == nil {
+			return point
+		}
+	}
+	panic("no point for message")
+}
+
+func testPartialSigner(key *big.Int) PartialSigner {
+	return func(message string) (string, error) {
+		return CompressG1(new(bn256.G1).ScalarMult(testHashToG1(message), key)), nil
+	}
+}
+
+func testVerifySignature(t *testing.T, message string, signature string, public_key []string) {
+	t.Helper()
+	g1, err := DecompressG1(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g2, err := G2FromComponents(public_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generator := new(bn256.G2).ScalarBaseMult(big.NewInt(1))
+	if !bn256.PairingCheck([]*bn256.G1{g1, new(bn256.G1).Neg(testHashToG1(message))}, []*bn256.G2{generator, g2}) {
+		t.Errorf("signature %s does not verify", signature)
+	}
+}
+
+// The aggregate public key of TestAggregateSignature, computed from the two keys and added in Go.
+func TestAggregatePublicKeysMatchesSigner(t *testing.T) {
+	public_keys := [][]string{}
+	for _, key := range []string{"d1f0f4e6df9803f1c94fe46214037c2fa926238de5504315abac0e9a5c189843", "b155212c78e165ab377c6e1c142ba828a94a05699b60c0d12c279cd7e5a3f4ae"} {
+		k, _ := new(big.Int).SetString(key, 16)
+		public_keys = append(public_keys, G2Components(new(bn256.G2).ScalarBaseMult(k)))
+	}
+	aggregated, err := AggregatePublicKeys(public_keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"1aaa1aa48d2a03f922d5d1e851850c25681f94b72cb5e5974cbdc2648214cfd3",
+		"18efbac529960229814ee922e00bd4fe57689ad2f4bca2522bd8d57cc9ed2d2a",
+		"2a008c2e6f4d94f03490d077033c8d56e11e443f542ad59c7c58f2a68137db53",
+		"008bc79f2e7b926b9f3824a2eadb2b92398e7e5450d2ab84226ea70c7fd177d9",
+	}
+	if !reflect.DeepEqual(aggregated, expected) {
+		t.Errorf("aggregated public key %v, expected %v", aggregated, expected)
+	}
+}
+
+func TestAggregatePartialSignatures(t *testing.T) {
+	message := "10afdfd0a74398e23708f64b1ebdc41a78d85eebcb3b3d5fc7a9dd411f8f852d"
+	signatures := []string{}
+	public_keys := [][]string{}
+	for i := int64(1); i <= 3; i++ {
+		key := big.NewInt(1000003 * i)
+		signature, _ := testPartialSigner(key)(message)
+		point, err := DecompressG1(signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if CompressG1(point) != signature {
+			t.Errorf("compression does not round trip for %s", signature)
+		}
+		signatures = append(signatures, signature)
+		public_keys = append(public_keys, G2Components(new(bn256.G2).ScalarBaseMult(key)))
+	}
+	signature, err := AggregatePartialSignatures(signatures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public_key, err := AggregatePublicKeys(public_keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testVerifySignature(t, message, signature, public_key)
+
+	if _, err := DecompressG1("04" + signature[2:]); err == nil {
+		t.Error("expected an invalid prefix to be rejected")
+	}
+	if _, err := AggregatePartialSignatures(nil); err == nil {
+		t.Error("expected an error aggregating no signatures")
+	}
+}
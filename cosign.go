@@ -0,0 +1,503 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// CosignPeer is a validator node: its position in OrderedValidators, where it listens, the account its identity
+// key signs handshakes with and the BLS public key its partial signatures verify against, in the order of
+// validators.json.
+type CosignPeer struct {
+	Index          int      `json:"index"`
+	Address        string   `json:"address"`
+	Account        string   `json:"account"`
+	BlsG2PublicKey []string `json:"blsG2PublicKey"`
+}
+
+// CosignConfig is the validator set as seen by the node at Index. Quorum is the number of identical partial
+// signatures, the node's own included, needed to aggregate. It is not read from the config file: RunCosign sets it
+// to the SigningThreshold of the batch, the same threshold the local signing path applies.
+type CosignConfig struct {
+	Index          int          `json:"index"`
+	Listen         string       `json:"listen"`
+	Quorum         int          `json:"-"`
+	TimeoutSeconds int          `json:"timeoutSeconds"`
+	Validator      string       `json:"validator"`
+	Peers          []CosignPeer `json:"peers"`
+}
+
+// CosignResult is the aggregate of the partial signatures of Signers over Message.
+type CosignResult struct {
+	SettlementId        uint64   `json:"settlementId"`
+	Message             string   `json:"message"`
+	Signature           string   `json:"signature"`
+	AggregatedPublicKey []string `json:"aggregatedPublicKey"`
+	Signers             []int    `json:"signers"`
+	SignerBitmap        string   `json:"signerBitmap"`
+}
+
+// PartialSigner signs an encoded settlement message with a single validator key and returns the compressed
+// signature.
+type PartialSigner func(message string) (string, error)
+
+// KeyPartialSigner signs with the aggregate signer binary given only the node's own key.
+func KeyPartialSigner(key string) PartialSigner {
+	return func(message string) (string, error) {
+		signature, _, err := AggregateSignature(message, []string{key})
+		return signature, err
+	}
+}
+
+// cosignFrame is one line of the peer protocol. The dialer opens with its index and a challenge, the listener
+// answers with its own challenge and a proof over the dialer's, the dialer proves itself in turn and then sends
+// its partial signatures, each with a proof binding it to the listener's challenge.
+type cosignFrame struct {
+	Index        int    `json:"index"`
+	Challenge    string `json:"challenge,omitempty"`
+	Proof        string `json:"proof,omitempty"`
+	SettlementId uint64 `json:"settlementId,omitempty"`
+	Message      string `json:"message,omitempty"`
+	Signature    string `json:"signature,omitempty"`
+}
+
+const cosignHandshakeTimeout = 5 * time.Second
+
+// CosignNode exchanges partial signatures with the other validators over TCP.
+type CosignNode struct {
+	config   CosignConfig
+	peers    map[int]CosignPeer
+	identity *ecdsa.PrivateKey
+	sign     PartialSigner
+	listener net.Listener
+
+	mu       sync.Mutex
+	own      map[uint64]cosignFrame
+	pending  map[uint64]map[int]cosignFrame
+	partials map[uint64]map[string]map[int]string
+	updated  chan struct{}
+	closed   chan struct{}
+}
+
+// NewCosignNode checks the config and starts accepting peers on listener.
+func NewCosignNode(config CosignConfig, listener net.Listener, identity *ecdsa.PrivateKey, sign PartialSigner) (*CosignNode, error) {
+	node := &CosignNode{
+		config:   config,
+		peers:    make(map[int]CosignPeer),
+		identity: identity,
+		sign:     sign,
+		listener: listener,
+		own:      make(map[uint64]cosignFrame),
+		pending:  make(map[uint64]map[int]cosignFrame),
+		partials: make(map[uint64]map[string]map[int]string),
+		updated:  make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	for _, peer := range config.Peers {
+		if _, ok := node.peers[peer.Index]; ok {
+			return nil, fmt.Errorf("duplicate cosign peer %d", peer.Index)
+		}
+		if !common.IsHexAddress(peer.Account) {
+			return nil, fmt.Errorf("invalid account %q for cosign peer %d", peer.Account, peer.Index)
+		}
+		if _, err := G2FromComponents(peer.BlsG2PublicKey); err != nil {
+			return nil, fmt.Errorf("%s for cosign peer %d", err.Error(), peer.Index)
+		}
+		node.peers[peer.Index] = peer
+	}
+	self, ok := node.peers[config.Index]
+	if !ok {
+		return nil, fmt.Errorf("cosign node %d is not in its peer list", config.Index)
+	}
+	if crypto.PubkeyToAddress(identity.PublicKey) != common.HexToAddress(self.Account) {
+		return nil, fmt.Errorf("identity key does not match the account of cosign node %d", config.Index)
+	}
+	if config.Quorum < 1 || config.Quorum > len(node.peers) {
+		return nil, fmt.Errorf("quorum %d is not between 1 and the %d cosign peers", config.Quorum, len(node.peers))
+	}
+	go node.accept()
+	return node, nil
+}
+
+func (node *CosignNode) Close() error {
+	close(node.closed)
+	return node.listener.Close()
+}
+
+func (node *CosignNode) accept() {
+	for {
+		conn, err := node.listener.Accept()
+		if err != nil {
+			return
+		}
+		go node.handleInbound(conn)
+	}
+}
+
+func newChallenge() string {
+	challenge := make([]byte, 32)
+	rand.Read(challenge)
+	return hex.EncodeToString(challenge)
+}
+
+// handshakeDigest is what a node signs to prove it holds the identity of index to the holder of challenge.
+func handshakeDigest(challenge string, index int) []byte {
+	return crypto.Keccak256([]byte(fmt.Sprintf("nume cosign handshake %s %d", challenge, index)))
+}
+
+// frameDigest is what a dialer signs to bind a partial signature frame to the session opened by challenge.
+func frameDigest(challenge string, frame cosignFrame) []byte {
+	return crypto.Keccak256([]byte(fmt.Sprintf("nume cosign frame %s %d %d %s %s", challenge, frame.Index, frame.SettlementId, frame.Message, frame.Signature)))
+}
+
+func (node *CosignNode) prove(digest []byte) (string, error) {
+	proof, err := crypto.Sign(digest, node.identity)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(proof), nil
+}
+
+// verifyProof checks that proof over digest was made by the configured identity of peer index.
+func (node *CosignNode) verifyProof(index int, digest []byte, proof string) error {
+	peer, ok := node.peers[index]
+	if !ok || index == node.config.Index {
+		return fmt.Errorf("unknown cosign peer %d", index)
+	}
+	signature, err := hex.DecodeString(proof)
+	if err != nil {
+		return err
+	}
+	public_key, err := crypto.SigToPub(digest, signature)
+	if err != nil {
+		return err
+	}
+	if crypto.PubkeyToAddress(*public_key) != common.HexToAddress(peer.Account) {
+		return fmt.Errorf("cosign peer %d failed authentication", index)
+	}
+	return nil
+}
+
+func (node *CosignNode) handleInbound(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(cosignHandshakeTimeout))
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+	var hello cosignFrame
+	if err := decoder.Decode(&hello); err != nil {
+		return
+	}
+	if _, ok := node.peers[hello.Index]; !ok || hello.Index == node.config.Index || hello.Challenge == "" {
+		return
+	}
+	proof, err := node.prove(handshakeDigest(hello.Challenge, node.config.Index))
+	if err != nil {
+		return
+	}
+	challenge := newChallenge()
+	if err := encoder.Encode(cosignFrame{Index: node.config.Index, Challenge: challenge, Proof: proof}); err != nil {
+		return
+	}
+	var auth cosignFrame
+	if err := decoder.Decode(&auth); err != nil {
+		return
+	}
+	if err := node.verifyProof(hello.Index, handshakeDigest(challenge, hello.Index), auth.Proof); err != nil {
+		fmt.Println(err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	for {
+		var partial cosignFrame
+		if err := decoder.Decode(&partial); err != nil {
+			return
+		}
+		if partial.Index != hello.Index {
+			fmt.Println("cosign peer", hello.Index, "sent a frame as", partial.Index)
+			return
+		}
+		if err := node.verifyProof(hello.Index, frameDigest(challenge, partial), partial.Proof); err != nil {
+			fmt.Println(err, "for a frame from cosign peer", hello.Index)
+			return
+		}
+		if err := node.addPartial(hello.Index, partial); err != nil {
+			fmt.Println(err, "from cosign peer", hello.Index)
+		}
+	}
+}
+
+// addPartial records the partial signature of an authenticated peer, or the node's own one. A peer has one
+// signature per settlement, the first one received. A partial over the message this node signed is stored only
+// once it verifies against the node's own signature, so partials that arrive before the node signs are held
+// until it does. Partials over another message cannot be verified and only count towards detecting that a quorum
+// signed something else, they are never aggregated.
+func (node *CosignNode) addPartial(index int, partial cosignFrame) error {
+	if _, err := DecompressG1(partial.Signature); err != nil {
+		return err
+	}
+	if _, err := DecodeSettlementMessage(partial.Message); err != nil {
+		return err
+	}
+	partial.Message = strings.ToLower(strings.TrimPrefix(partial.Message, "0x"))
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if index == node.config.Index {
+		node.own[partial.SettlementId] = partial
+		node.storePartial(index, partial)
+		pending := node.pending[partial.SettlementId]
+		delete(node.pending, partial.SettlementId)
+		for peer_index, peer_partial := range pending {
+			if err := node.verifyPartial(peer_index, peer_partial); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			node.storePartial(peer_index, peer_partial)
+		}
+		return nil
+	}
+	if _, ok := node.own[partial.SettlementId]; !ok {
+		if node.pending[partial.SettlementId] == nil {
+			node.pending[partial.SettlementId] = make(map[int]cosignFrame)
+		}
+		if _, ok := node.pending[partial.SettlementId][index]; !ok {
+			node.pending[partial.SettlementId][index] = partial
+		}
+		return nil
+	}
+	if err := node.verifyPartial(index, partial); err != nil {
+		return err
+	}
+	node.storePartial(index, partial)
+	return nil
+}
+
+// verifyPartial checks the partial signature of peer index against the node's own signature when both are over
+// the same message. The caller holds node.mu.
+func (node *CosignNode) verifyPartial(index int, partial cosignFrame) error {
+	own := node.own[partial.SettlementId]
+	if partial.Message != own.Message {
+		return nil
+	}
+	err := VerifySameMessage(partial.Signature, node.peers[index].BlsG2PublicKey, own.Signature, node.peers[node.config.Index].BlsG2PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid partial signature from cosign peer %d: %s", index, err.Error())
+	}
+	return nil
+}
+
+// storePartial records a checked partial signature. The caller holds node.mu.
+func (node *CosignNode) storePartial(index int, partial cosignFrame) {
+	by_message, ok := node.partials[partial.SettlementId]
+	if !ok {
+		by_message = make(map[string]map[int]string)
+		node.partials[partial.SettlementId] = by_message
+	}
+	for _, signatures := range by_message {
+		if _, ok := signatures[index]; ok {
+			return
+		}
+	}
+	if by_message[partial.Message] == nil {
+		by_message[partial.Message] = make(map[int]string)
+	}
+	by_message[partial.Message][index] = partial.Signature
+	select {
+	case node.updated <- struct{}{}:
+	default:
+	}
+}
+
+// sendPartial dials peer until it is reachable or deadline passes, authenticates both ends and sends partial.
+func (node *CosignNode) sendPartial(peer CosignPeer, partial cosignFrame, deadline time.Time) error {
+	var conn net.Conn
+	var err error
+	for {
+		conn, err = net.DialTimeout("tcp", peer.Address, time.Until(deadline))
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-node.closed:
+			return nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+	challenge := newChallenge()
+	if err := encoder.Encode(cosignFrame{Index: node.config.Index, Challenge: challenge}); err != nil {
+		return err
+	}
+	var reply cosignFrame
+	if err := decoder.Decode(&reply); err != nil {
+		return err
+	}
+	if reply.Index != peer.Index {
+		return fmt.Errorf("cosign peer at %s answered as %d instead of %d", peer.Address, reply.Index, peer.Index)
+	}
+	if err := node.verifyProof(peer.Index, handshakeDigest(challenge, peer.Index), reply.Proof); err != nil {
+		return err
+	}
+	proof, err := node.prove(handshakeDigest(reply.Challenge, node.config.Index))
+	if err != nil {
+		return err
+	}
+	if err := encoder.Encode(cosignFrame{Index: node.config.Index, Proof: proof}); err != nil {
+		return err
+	}
+	partial.Proof, err = node.prove(frameDigest(reply.Challenge, partial))
+	if err != nil {
+		return err
+	}
+	return encoder.Encode(partial)
+}
+
+// quorum aggregates the partial signatures over message once enough validators sent them. It fails when a
+// quorum has signed a different message, since this node can then never reach one.
+func (node *CosignNode) quorum(settlement_id uint64, message string) (CosignResult, bool, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	result := CosignResult{SettlementId: settlement_id, Message: message}
+	for other, signatures := range node.partials[settlement_id] {
+		if other != message && len(signatures) >= node.config.Quorum {
+			return result, false, fmt.Errorf("a quorum of %d validators signed a different settlement message", len(signatures))
+		}
+	}
+	signatures := node.partials[settlement_id][message]
+	if len(signatures) < node.config.Quorum {
+		return result, false, nil
+	}
+	for index := range signatures {
+		result.Signers = append(result.Signers, index)
+	}
+	sort.Ints(result.Signers)
+	signer_indexes := []uint{}
+	for _, index := range result.Signers {
+		signer_indexes = append(signer_indexes, uint(index))
+	}
+	result.SignerBitmap = SignerBitmap(signer_indexes)
+	partial_signatures := []string{}
+	public_keys := [][]string{}
+	for _, index := range result.Signers {
+		partial_signatures = append(partial_signatures, signatures[index])
+		public_keys = append(public_keys, node.peers[index].BlsG2PublicKey)
+	}
+	var err error
+	result.Signature, err = AggregatePartialSignatures(partial_signatures)
+	if err != nil {
+		return result, false, err
+	}
+	result.AggregatedPublicKey, err = AggregatePublicKeys(public_keys)
+	if err != nil {
+		return result, false, err
+	}
+	own := node.own[settlement_id]
+	if err := VerifySameMessage(result.Signature, result.AggregatedPublicKey, own.Signature, node.peers[node.config.Index].BlsG2PublicKey); err != nil {
+		return result, false, fmt.Errorf("aggregate signature does not verify: %s", err.Error())
+	}
+	return result, true, nil
+}
+
+// Cosign signs message with the node's own key, sends the partial signature to every peer and waits until a
+// quorum of validators has signed the identical message.
+func (node *CosignNode) Cosign(settlement_id uint64, message SettlementMessage) (CosignResult, error) {
+	encoded := message.Encode()
+	signature, err := node.sign(encoded)
+	if err != nil {
+		return CosignResult{}, err
+	}
+	partial := cosignFrame{Index: node.config.Index, SettlementId: settlement_id, Message: encoded, Signature: signature}
+	if err := node.addPartial(node.config.Index, partial); err != nil {
+		return CosignResult{}, err
+	}
+	timeout := time.Duration(node.config.TimeoutSeconds) * time.Second
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	deadline := time.Now().Add(timeout)
+	for _, peer := range node.config.Peers {
+		if peer.Index == node.config.Index {
+			continue
+		}
+		go func(peer CosignPeer) {
+			if err := node.sendPartial(peer, partial, deadline); err != nil {
+				fmt.Println("error sending partial signature to cosign peer", peer.Index, err)
+			}
+		}(peer)
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		result, done, err := node.quorum(settlement_id, encoded)
+		if err != nil || done {
+			return result, err
+		}
+		select {
+		case <-node.updated:
+		case <-timer.C:
+			node.mu.Lock()
+			agreed := len(node.partials[settlement_id][encoded])
+			node.mu.Unlock()
+			return result, fmt.Errorf("cosign timed out with %d of %d required signatures", agreed, node.config.Quorum)
+		case <-node.closed:
+			return result, fmt.Errorf("cosign node closed")
+		}
+	}
+}
+
+// CheckCosignValidators checks that the config agrees with validators.json: the node's Index is the position of
+// its Validator in OrderedValidators and every peer's BLS key is the key of the validator at its Index, so that
+// signer indexes and aggregated keys match what the contract expects.
+func CheckCosignValidators(config CosignConfig, validator_keys map[string]ValidatorKeys) error {
+	validators := OrderedValidators(validator_keys)
+	position := -1
+	for i, v := range validators {
+		if v == config.Validator {
+			position = i
+		}
+	}
+	if position == -1 {
+		return fmt.Errorf("validator %s not found in validators.json", config.Validator)
+	}
+	if config.Index != position {
+		return fmt.Errorf("cosign index %d is not the position %d of validator %s", config.Index, position, config.Validator)
+	}
+	for _, peer := range config.Peers {
+		if peer.Index < 0 || peer.Index >= len(validators) {
+			return fmt.Errorf("cosign peer %d is not a validator", peer.Index)
+		}
+		peer_key, err := G2FromComponents(peer.BlsG2PublicKey)
+		if err != nil {
+			return fmt.Errorf("%s for cosign peer %d", err.Error(), peer.Index)
+		}
+		validator_key, err := G2FromComponents(validator_keys[validators[peer.Index]].BlsG2PublicKey)
+		if err != nil {
+			return fmt.Errorf("%s for validator %s", err.Error(), validators[peer.Index])
+		}
+		if string(peer_key.Marshal()) != string(validator_key.Marshal()) {
+			return fmt.Errorf("BLS key of cosign peer %d does not match validator %s", peer.Index, validators[peer.Index])
+		}
+	}
+	return nil
+}
+
+// LoadIdentityKey parses the hex secp256k1 key a node authenticates to its peers with.
+func LoadIdentityKey(key string) (*ecdsa.PrivateKey, error) {
+	return crypto.HexToECDSA(strings.TrimPrefix(strings.TrimSpace(key), "0x"))
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	bn256 "github.com/ethereum/go-ethereum/crypto/bn256/cloudflare"
+)
+
+type testCosignNetwork struct {
+	configs    []CosignConfig
+	listeners  []net.Listener
+	identities []*ecdsa.PrivateKey
+	bls_keys   []*big.Int
+}
+
+// newTestCosignNetwork gives n validators a loopback listener, an identity key and a BLS key.
+func newTestCosignNetwork(t *testing.T, n int, quorum int) *testCosignNetwork {
+	network := &testCosignNetwork{}
+	peers := []CosignPeer{}
+	for i := 0; i < n; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		identity, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bls_key := big.NewInt(int64(7919 * (i + 1)))
+		t.Cleanup(func() { listener.Close() })
+		network.listeners = append(network.listeners, listener)
+		network.identities = append(network.identities, identity)
+		network.bls_keys = append(network.bls_keys, bls_key)
+		peers = append(peers, CosignPeer{
+			Index:          i,
+			Address:        listener.Addr().String(),
+			Account:        crypto.PubkeyToAddress(identity.PublicKey).Hex(),
+			BlsG2PublicKey: G2Components(new(bn256.G2).ScalarBaseMult(bls_key)),
+		})
+	}
+	for i := 0; i < n; i++ {
+		network.configs = append(network.configs, CosignConfig{Index: i, Quorum: quorum, TimeoutSeconds: 5, Peers: peers})
+	}
+	return network
+}
+
+func (network *testCosignNetwork) node(t *testing.T, i int) *CosignNode {
+	node, err := NewCosignNode(network.configs[i], network.listeners[i], network.identities[i], testPartialSigner(network.bls_keys[i]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+func testCosignMessage(new_root string) SettlementMessage {
+	return SettlementMessage{
+		PrevRoot:       common.HexToHash("0x01"),
+		NewRoot:        common.HexToHash(new_root),
+		BlockNumber:    42,
+		HasWithdrawal:  true,
+		WithdrawalHash: common.HexToHash("0x03"),
+	}
+}
+
+func runCosign(nodes []*CosignNode, messages []SettlementMessage) ([]CosignResult, []error) {
+	results := make([]CosignResult, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		if node == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, node *CosignNode) {
+			results[i], errs[i] = node.Cosign(7, messages[i])
+			wg.Done()
+		}(i, node)
+	}
+	wg.Wait()
+	return results, errs
+}
+
+func TestCosignQuorum(t *testing.T) {
+	network := newTestCosignNetwork(t, 4, 3)
+	// node 3 is offline, the other three still reach the quorum
+	network.listeners[3].Close()
+	nodes := []*CosignNode{network.node(t, 0), network.node(t, 1), network.node(t, 2), nil}
+	message := testCosignMessage("0x02")
+	results, errs := runCosign(nodes, []SettlementMessage{message, message, message, message})
+	for i := 0; i < 3; i++ {
+		if errs[i] != nil {
+			t.Fatalf("node %d: %v", i, errs[i])
+		}
+		result := results[i]
+		if result.Message != message.Encode() || len(result.Signers) != 3 {
+			t.Fatalf("node %d: unexpected result %+v", i, result)
+		}
+		for _, signer := range result.Signers {
+			if signer == 3 {
+				t.Errorf("node %d counted the offline node as a signer", i)
+			}
+		}
+		testVerifySignature(t, result.Message, result.Signature, result.AggregatedPublicKey)
+	}
+}
+
+func TestCosignDisagreement(t *testing.T) {
+	network := newTestCosignNetwork(t, 3, 2)
+	nodes := []*CosignNode{network.node(t, 0), network.node(t, 1), network.node(t, 2)}
+	honest := testCosignMessage("0x02")
+	results, errs := runCosign(nodes, []SettlementMessage{honest, honest, testCosignMessage("0x04")})
+	for i := 0; i < 2; i++ {
+		if errs[i] != nil {
+			t.Fatalf("node %d: %v", i, errs[i])
+		}
+		if len(results[i].Signers) != 2 || results[i].Signers[0] != 0 || results[i].Signers[1] != 1 {
+			t.Errorf("node %d: expected signers [0 1], got %v", i, results[i].Signers)
+		}
+		if !strings.HasSuffix(results[i].SignerBitmap, "03") {
+			t.Errorf("node %d: expected signer bitmap 0b11, got %s", i, results[i].SignerBitmap)
+		}
+	}
+	if errs[2] == nil || !strings.Contains(errs[2].Error(), "different settlement message") {
+		t.Errorf("expected the diverging node to fail, got %v", errs[2])
+	}
+}
+
+func TestCosignRejectsUnauthenticatedPeer(t *testing.T) {
+	network := newTestCosignNetwork(t, 3, 2)
+	// node 2 dials with an identity key that is not the one configured for it
+	impostor, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	network.configs[2].TimeoutSeconds = 1
+	network.configs[0].TimeoutSeconds = 1
+	forged := network.configs[2]
+	forged.Peers = append([]CosignPeer{}, forged.Peers...)
+	forged.Peers[2].Account = crypto.PubkeyToAddress(impostor.PublicKey).Hex()
+	impostor_node, err := NewCosignNode(forged, network.listeners[2], impostor, testPartialSigner(network.bls_keys[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impostor_node.Close()
+	network.listeners[1].Close()
+	nodes := []*CosignNode{network.node(t, 0), nil, impostor_node}
+	message := testCosignMessage("0x02")
+	_, errs := runCosign(nodes, []SettlementMessage{message, message, message})
+	if errs[0] == nil || !strings.Contains(errs[0].Error(), "timed out with 1 of 2") {
+		t.Errorf("expected node 0 to ignore the impostor, got %v", errs[0])
+	}
+}
+
+func TestCosignRejectsBadPartial(t *testing.T) {
+	network := newTestCosignNetwork(t, 3, 3)
+	for i := range network.configs {
+		network.configs[i].TimeoutSeconds = 1
+	}
+	// node 2 authenticates but signs with a key that is not its configured BLS key
+	bad_node, err := NewCosignNode(network.configs[2], network.listeners[2], network.identities[2], testPartialSigner(big.NewInt(104729)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad_node.Close()
+	nodes := []*CosignNode{network.node(t, 0), network.node(t, 1), bad_node}
+	message := testCosignMessage("0x02")
+	_, errs := runCosign(nodes, []SettlementMessage{message, message, message})
+	for i := 0; i < 2; i++ {
+		if errs[i] == nil || !strings.Contains(errs[i].Error(), "timed out with 2 of 3") {
+			t.Errorf("expected node %d to drop the bad partial, got %v", i, errs[i])
+		}
+	}
+}
+
+func TestNewCosignNodeChecksConfig(t *testing.T) {
+	network := newTestCosignNetwork(t, 3, 2)
+	config := network.configs[0]
+	for _, quorum := range []int{0, 4} {
+		config.Quorum = quorum
+		if _, err := NewCosignNode(config, network.listeners[0], network.identities[0], testPartialSigner(network.bls_keys[0])); err == nil {
+			t.Errorf("expected quorum %d of 3 peers to be rejected", quorum)
+		}
+	}
+	if _, err := NewCosignNode(network.configs[0], network.listeners[0], network.identities[1], testPartialSigner(network.bls_keys[0])); err == nil {
+		t.Error("expected a mismatched identity key to be rejected")
+	}
+}
+
+func TestCheckCosignValidators(t *testing.T) {
+	network := newTestCosignNetwork(t, 3, 2)
+	validator_keys := make(map[string]ValidatorKeys)
+	validators := []string{}
+	for i, peer := range network.configs[0].Peers {
+		validator := fmt.Sprintf("%064x", i+1)
+		validators = append(validators, validator)
+		validator_keys[validator] = ValidatorKeys{BlsG2PublicKey: peer.BlsG2PublicKey}
+	}
+	config := network.configs[1]
+	config.Validator = validators[1]
+	if err := CheckCosignValidators(config, validator_keys); err != nil {
+		t.Errorf("expected a matching config to pass, got %v", err)
+	}
+	config.Validator = validators[2]
+	if err := CheckCosignValidators(config, validator_keys); err == nil {
+		t.Error("expected an index that is not the validator's position to be rejected")
+	}
+	config.Validator = "unknown"
+	if err := CheckCosignValidators(config, validator_keys); err == nil {
+		t.Error("expected an unknown validator to be rejected")
+	}
+	config.Validator = validators[1]
+	config.Peers = append([]CosignPeer{}, config.Peers...)
+	config.Peers[0].BlsG2PublicKey, config.Peers[2].BlsG2PublicKey = config.Peers[2].BlsG2PublicKey, config.Peers[0].BlsG2PublicKey
+	if err := CheckCosignValidators(config, validator_keys); err == nil {
+		t.Error("expected a peer key that is not its validator's key to be rejected")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"os"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// BalanceChange is a single debit (negative Amount) or credit of one user's asset. Kind says why, for example
+// "nume_fee", "mint_fee", "royalty" or the transaction type for the principal amount.
+type BalanceChange struct {
+	User   string `json:"user"`
+	Asset  string `json:"asset"`
+	Amount string `json:"amount"`
+	Kind   string `json:"kind"`
+}
+
+// NftMove records an NFT leaving From and reaching To. From is empty for deposits and mints, To for withdrawals.
+type NftMove struct {
+	Nft  string `json:"nft"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type ListerNonceUse struct {
+	User  string `json:"user"`
+	Start uint   `json:"start"`
+	End   uint   `json:"end"`
+}
+
+// TraceEntry is what one transaction of the batch did to the state.
+type TraceEntry struct {
+	Number         int              `json:"number"`
+	Id             uint             `json:"id"`
+	Type           string           `json:"type"`
+	Skipped        bool             `json:"skipped,omitempty"`
+	Rejected       string           `json:"rejected,omitempty"`
+	Signer         string           `json:"signer,omitempty"`
+	Nonce          uint64           `json:"nonce"`
+	BalanceChanges []BalanceChange  `json:"balanceChanges"`
+	NftMoves       []NftMove        `json:"nftMoves"`
+	ListerNonces   []ListerNonceUse `json:"listerNonces"`
+}
+
+// ExecutionTrace collects a TraceEntry per transaction. A nil *ExecutionTrace records nothing, so
+// TransitionState calls it unconditionally.
+type ExecutionTrace struct {
+	Entries []TraceEntry
+}
+
+func (trace *ExecutionTrace) current() *TraceEntry {
+	if trace == nil || len(trace.Entries) == 0 {
+		return nil
+	}
+	return &trace.Entries[len(trace.Entries)-1]
+}
+
+func (trace *ExecutionTrace) Begin(number int, id uint, tx_type string) {
+	if trace == nil {
+		return
+	}
+	trace.Entries = append(trace.Entries, TraceEntry{Number: number, Id: id, Type: tx_type, BalanceChanges: []BalanceChange{}, NftMoves: []NftMove{}, ListerNonces: []ListerNonceUse{}})
+}
+
+func (trace *ExecutionTrace) Skip() {
+	if entry := trace.current(); entry != nil {
+		entry.Skipped = true
+	}
+}
+
+func (trace *ExecutionTrace) Credit(user string, asset string, amount *big.Int, kind string) {
+	if entry := trace.current(); entry != nil {
+		entry.BalanceChanges = append(entry.BalanceChanges, BalanceChange{User: user, Asset: asset, Amount: amount.String(), Kind: kind})
+	}
+}
+
+func (trace *ExecutionTrace) Debit(user string, asset string, amount *big.Int, kind string) {
+	trace.Credit(user, asset, new(big.Int).Neg(amount), kind)
+}
+
+// Transfer records the debit and credit made by one DeductFees call.
+func (trace *ExecutionTrace) Transfer(from string, to string, asset string, amount *big.Int, kind string) {
+	trace.Debit(from, asset, amount, kind)
+	trace.Credit(to, asset, amount, kind)
+}
+
+// MoveNft records an NFT leaving or reaching a user. A removal followed by an arrival of the same NFT is
+// merged into one move.
+func (trace *ExecutionTrace) MoveNft(nft string, from string, to string) {
+	entry := trace.current()
+	if entry == nil {
+		return
+	}
+	if last := len(entry.NftMoves) - 1; from == "" && last >= 0 && entry.NftMoves[last].Nft == nft && entry.NftMoves[last].To == "" {
+		entry.NftMoves[last].To = to
+		return
+	}
+	entry.NftMoves = append(entry.NftMoves, NftMove{Nft: nft, From: from, To: to})
+}
+
+func (trace *ExecutionTrace) ConsumeListerNonces(user string, start uint, end uint) {
+	if entry := trace.current(); entry != nil {
+		entry.ListerNonces = append(entry.ListerNonces, ListerNonceUse{User: user, Start: start, End: end})
+	}
+}
+
+// Reject replaces whatever the entry of a rejected transaction recorded with the rejection reason, since its
+// changes were rolled back.
+func (trace *ExecutionTrace) Reject(rejected RejectedTransaction) {
+	if trace == nil {
+		return
+	}
+	if entry := trace.current(); entry == nil || entry.Number != rejected.Number {
+		trace.Begin(rejected.Number, rejected.Id, rejected.Type)
+	}
+	entry := trace.current()
+	*entry = TraceEntry{Number: entry.Number, Id: entry.Id, Type: entry.Type, Rejected: rejected.Reason, BalanceChanges: []BalanceChange{}, NftMoves: []NftMove{}, ListerNonces: []ListerNonceUse{}}
+}
+
+// End records the signer's account nonce after the transaction.
+func (trace *ExecutionTrace) End(signer string, nonce uint64) {
+	if entry := trace.current(); entry != nil {
+		entry.Signer = signer
+		entry.Nonce = nonce
+	}
+}
+
+// JSONL writes one JSON object per line, in batch order.
+func (trace *ExecutionTrace) JSONL() ([]byte, error) {
+	var buf bytes.Buffer
+	if trace == nil {
+		return buf.Bytes(), nil
+	}
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range trace.Entries {
+		if err := encoder.Encode(entry); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteExecutionTrace writes the trace as JSON Lines to path and returns its hash, or does nothing for a nil trace.
+func WriteExecutionTrace(trace *ExecutionTrace, path string) (string, error) {
+	if trace == nil {
+		return "", nil
+	}
+	data, err := trace.JSONL()
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		return "", err
+	}
+	return "0x" + hex.EncodeToString(crypto.Keccak256(data)), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+func TestExecutionTraceReplaysState(t *testing.T) {
+	input_data, _, err := GetData("./test_data")
+	if err != nil {
+		t.Errorf("Error reading test data " + err.Error())
+		return
+	}
+	options := &TransitionOptions{Trace: &ExecutionTrace{}}
+	new_balances, _, _, err := transitionTestData(input_data, options)
+	if err != nil {
+		t.Errorf("Error in transition state " + err.Error())
+		return
+	}
+	if len(options.Trace.Entries) != len(input_data.Transactions) {
+		t.Errorf("Expected %d trace entries got %d", len(input_data.Transactions), len(options.Trace.Entries))
+	}
+
+	replayed := CopyMap(input_data.OldUserBalances)
+	kinds := map[string]bool{}
+	for _, entry := range options.Trace.Entries {
+		for _, change := range entry.BalanceChanges {
+			kinds[change.Kind] = true
+			if _, ok := replayed[change.User]; !ok {
+				replayed[change.User] = make(map[string]string)
+			}
+			balance, _ := new(big.Int).SetString(replayed[change.User][change.Asset], 10)
+			if balance == nil {
+				balance = big.NewInt(0)
+			}
+			amount, _ := new(big.Int).SetString(change.Amount, 10)
+			replayed[change.User][change.Asset] = balance.Add(balance, amount).String()
+		}
+		for _, move := range entry.NftMoves {
+			if move.From != "" {
+				delete(replayed[move.From], move.Nft)
+			}
+			if move.To != "" {
+				if _, ok := replayed[move.To]; !ok {
+					replayed[move.To] = make(map[string]string)
+				}
+				replayed[move.To][move.Nft] = new_balances[move.To][move.Nft]
+			}
+		}
+	}
+	if !NestedMapsEqual(replayed, new_balances) {
+		t.Errorf("Replaying the trace does not reproduce the post-state %v", DiffBalances(new_balances, replayed, nil, input_data.MetaData, nil))
+	}
+	if !kinds["nume_fee"] || !kinds["mint_fee"] || !kinds["royalty"] {
+		t.Errorf("Expected nume fee, mint fee and royalty entries got %v", kinds)
+	}
+
+	data, err := options.Trace.JSONL()
+	if err != nil {
+		t.Errorf("Error encoding trace " + err.Error())
+		return
+	}
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	if len(lines) != len(options.Trace.Entries) {
+		t.Errorf("Expected one line per entry got %d", len(lines))
+	}
+	var first TraceEntry
+	if err := json.Unmarshal(lines[0], &first); err != nil || first.Number != 1 {
+		t.Errorf("Unexpected first trace line %s", string(lines[0]))
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ExitAsset is one balance slot of the exiting user with its proof against the user's balances root.
+type ExitAsset struct {
+	Asset                 string   `json:"asset"`
+	BalanceIndex          int      `json:"balanceIndex"`
+	CurrencyOrNftContract string   `json:"currencyOrNftContract"`
+	AmountOrNftTokenId    string   `json:"amountOrNftTokenId"`
+	AssetType             string   `json:"assetType"`
+	L2Minted              string   `json:"l2Minted"`
+	Leaf                  string   `json:"leaf"`
+	BalanceProof          []string `json:"balanceProof"`
+	Calldata              string   `json:"calldata"`
+}
+
+// ExitPackage is everything a user needs to withdraw from L1 without the operator: the account leaf preimage as
+// hashed by GetLeafHash, its proof against the account root and a proof and exit calldata per asset.
+type ExitPackage struct {
+	User                string      `json:"user"`
+	BalancesRoot        string      `json:"balancesRoot"`
+	Nonce               uint64      `json:"nonce"`
+	UsedListerNonceHash string      `json:"usedListerNonceHash"`
+	Leaf                string      `json:"leaf"`
+	AccountIndex        int         `json:"accountIndex"`
+	AccountProof        []string    `json:"accountProof"`
+	Root                string      `json:"root"`
+	Assets              []ExitAsset `json:"assets"`
+}
+
+// GetExitState is the state at the last signed root, the previous state of input_data, in the layout of a
+// SimulationResult so that a persisted simulation can be exited from as well.
+func GetExitState(input_data InputData) SimulationResult {
+	users_ordered := []string{}
+	for _, u := range input_data.MetaData["users_ordered"].([]interface{}) {
+		users_ordered = append(users_ordered, u.(string))
+	}
+	if len(users_ordered) > len(input_data.OldUserBalances) {
+		users_ordered = users_ordered[:len(input_data.OldUserBalances)]
+	}
+	users_nonce := map[string]uint64{}
+	for k, v := range input_data.MetaData["old_users_nonce"].(map[string]interface{}) {
+		users_nonce[k] = uint64(v.(float64))
+	}
+	return SimulationResult{
+		Balances:        input_data.OldUserBalances,
+		BalanceOrder:    input_data.OldUserBalanceOrder,
+		UsersOrdered:    users_ordered,
+		UsersNonce:      users_nonce,
+		UserListerNonce: input_data.UserListerNonce,
+	}
+}
+
+func hexList(proof [][]byte) []string {
+	list := []string{}
+	for _, p := range proof {
+		list = append(list, "0x"+hex.EncodeToString(p))
+	}
+	return list
+}
+
+// BuildExitPackage proves the account of user and each asset it holds in state. The account tree rebuilt from
+// state must have expected_root, the root signed on L1, or the proofs would not be accepted by the exit function.
+func BuildExitPackage(state SimulationResult, user string, expected_root string, max_num_users int, max_num_balances int) (ExitPackage, error) {
+	var exit_package ExitPackage
+	account_index := -1
+	for i, u := range state.UsersOrdered {
+		if strings.EqualFold(u, user) {
+			account_index = i
+			user = u
+			break
+		}
+	}
+	if account_index == -1 {
+		return exit_package, fmt.Errorf("user %s not found in state", user)
+	}
+	account_tree, err := GetAccountTree(state.UsersOrdered, len(state.UsersOrdered), state.Balances, state.BalanceOrder, state.UsersNonce, state.UserListerNonce, max_num_users, max_num_balances)
+	if err != nil {
+		return exit_package, err
+	}
+	if !strings.EqualFold(hex.EncodeToString(account_tree.Root), strings.TrimPrefix(strings.ToLower(expected_root), "0x")) {
+		return exit_package, fmt.Errorf("state root 0x%s does not match the expected root %s", hex.EncodeToString(account_tree.Root), expected_root)
+	}
+	balances_tree, ok := GetBalancesTree(state.Balances[user], state.BalanceOrder[user], max_num_balances)
+	if !ok {
+		return exit_package, fmt.Errorf("too many balances for user %s", user)
+	}
+	account_proof, _ := account_tree.Proof(account_index)
+	if !account_tree.VerifyProof(account_proof, account_index) {
+		return exit_package, fmt.Errorf("account proof does not verify for user %s", user)
+	}
+	exit_package = ExitPackage{
+		User:                user,
+		BalancesRoot:        "0x" + hex.EncodeToString(balances_tree.Root),
+		Nonce:               state.UsersNonce[user],
+		UsedListerNonceHash: common.BytesToHash(state.UserListerNonce[user].Hash()).Hex(),
+		Leaf:                "0x" + hex.EncodeToString(account_tree.Nodes[0][account_index].Data),
+		AccountIndex:        account_index,
+		AccountProof:        hexList(account_proof),
+		Root:                "0x" + hex.EncodeToString(account_tree.Root),
+		Assets:              []ExitAsset{},
+	}
+
+	exit_abi, err := getExitABI()
+	if err != nil {
+		return exit_package, err
+	}
+	for i, asset := range state.BalanceOrder[user] {
+		if asset == ZeroAddress {
+			continue
+		}
+		currency_or_contract, amt_or_token_id, ctype, l2_minted := GetBalanceLeafFields(asset, state.Balances[user][asset])
+		balance_proof, _ := balances_tree.Proof(i)
+		if !balances_tree.VerifyProof(balance_proof, i) {
+			return exit_package, fmt.Errorf("balance proof does not verify for %s of user %s", asset, user)
+		}
+		exit_asset := ExitAsset{
+			Asset:                 asset,
+			BalanceIndex:          i,
+			CurrencyOrNftContract: currency_or_contract,
+			AmountOrNftTokenId:    amt_or_token_id,
+			AssetType:             ctype,
+			L2Minted:              l2_minted,
+			Leaf:                  "0x" + hex.EncodeToString(balances_tree.Nodes[0][i].Data),
+			BalanceProof:          hexList(balance_proof),
+		}
+		exit_asset.Calldata, err = ExitCalldata(exit_abi, exit_package, exit_asset)
+		if err != nil {
+			return exit_package, err
+		}
+		exit_package.Assets = append(exit_package.Assets, exit_asset)
+	}
+	return exit_package, nil
+}
+
+func getExitABI() (abi.ABI, error) {
+	path, err := filepath.Abs("exit.abi")
+	if err != nil {
+		return abi.ABI{}, err
+	}
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return abi.ABI{}, err
+	}
+	return abi.JSON(strings.NewReader(string(file)))
+}
+
+// ExitCalldata ABI-encodes the call to the contract's exit function for one asset of the package.
+func ExitCalldata(exit_abi abi.ABI, exit_package ExitPackage, exit_asset ExitAsset) (string, error) {
+	to_hashes := func(list []string) []common.Hash {
+		hashes := []common.Hash{}
+		for _, h := range list {
+			hashes = append(hashes, common.HexToHash(h))
+		}
+		return hashes
+	}
+	to_big := func(value string) (*big.Int, error) {
+		n, ok := new(big.Int).SetString(value, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid exit amount %s", value)
+		}
+		return n, nil
+	}
+	values := []*big.Int{}
+	for _, v := range []string{exit_asset.AmountOrNftTokenId, exit_asset.AssetType, exit_asset.L2Minted} {
+		n, err := to_big(v)
+		if err != nil {
+			return "", err
+		}
+		values = append(values, n)
+	}
+	data, err := exit_abi.Pack("exit",
+		common.HexToAddress(exit_package.User),
+		common.HexToHash(exit_package.BalancesRoot),
+		new(big.Int).SetUint64(exit_package.Nonce),
+		common.HexToHash(exit_package.UsedListerNonceHash),
+		big.NewInt(int64(exit_package.AccountIndex)),
+		to_hashes(exit_package.AccountProof),
+		common.HexToAddress(exit_asset.CurrencyOrNftContract),
+		values[0],
+		values[1],
+		values[2],
+		big.NewInt(int64(exit_asset.BalanceIndex)),
+		to_hashes(exit_asset.BalanceProof),
+	)
+	if err != nil {
+		return "", err
+	}
+	return "0x" + hex.EncodeToString(data), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	solsha3 "github.com/miguelmota/go-solidity-sha3"
+)
+
+// foldProof hashes a leaf up to the root the way the exit function does, taking the side from the index bits.
+func foldProof(leaf []byte, proof []string, index int) []byte {
+	hash := leaf
+	for _, p := range proof {
+		neighbour := common.HexToHash(p).Bytes()
+		if index%2 == 0 {
+			hash = solsha3.SoliditySHA3([]string{"uint256", "uint256"}, []interface{}{new(big.Int).SetBytes(hash), new(big.Int).SetBytes(neighbour)})
+		} else {
+			hash = solsha3.SoliditySHA3([]string{"uint256", "uint256"}, []interface{}{new(big.Int).SetBytes(neighbour), new(big.Int).SetBytes(hash)})
+		}
+		index /= 2
+	}
+	return hash
+}
+
+func TestBuildExitPackage(t *testing.T) {
+	input_data, _, err := GetData("./test_data")
+	if err != nil {
+		t.Errorf("Error reading test data " + err.Error())
+		return
+	}
+	state, err := Simulate(input_data, nil)
+	if err != nil {
+		t.Errorf("Error in simulate " + err.Error())
+		return
+	}
+	user := "0x7771e6fe5245a04a94329a71b5c37aacc22ccf53"
+	exit_package, err := BuildExitPackage(state, user, state.Root, 16, 8)
+	if err != nil {
+		t.Errorf("Error building exit package " + err.Error())
+		return
+	}
+	if exit_package.Root != state.Root {
+		t.Errorf("Expected the exit root %s to be the state root %s", exit_package.Root, state.Root)
+	}
+	leaf := GetLeafHash(user, exit_package.BalancesRoot, uint(exit_package.Nonce), state.UserListerNonce[user])
+	if "0x"+hex.EncodeToString(leaf) != exit_package.Leaf {
+		t.Errorf("Account leaf does not match its preimage")
+	}
+	if common.BytesToHash(foldProof(leaf, exit_package.AccountProof, exit_package.AccountIndex)).Hex() != exit_package.Root {
+		t.Errorf("Account proof does not fold to the root")
+	}
+	if len(exit_package.Assets) != 2 {
+		t.Errorf("Expected a fee currency and an nft asset got %v", exit_package.Assets)
+		return
+	}
+
+	exit_abi, err := getExitABI()
+	if err != nil {
+		t.Errorf("Error reading exit abi " + err.Error())
+		return
+	}
+	for _, asset := range exit_package.Assets {
+		asset_leaf := GetBalanceLeafHash(asset.Asset, state.Balances[user][asset.Asset])
+		if common.BytesToHash(foldProof(asset_leaf, asset.BalanceProof, asset.BalanceIndex)).Hex() != exit_package.BalancesRoot {
+			t.Errorf("Balance proof of %s does not fold to the balances root", asset.Asset)
+		}
+		calldata := common.FromHex(asset.Calldata)
+		if !bytes.Equal(calldata[:4], exit_abi.Methods["exit"].ID) {
+			t.Errorf("Calldata of %s does not call exit", asset.Asset)
+			continue
+		}
+		args, err := exit_abi.Methods["exit"].Inputs.Unpack(calldata[4:])
+		if err != nil {
+			t.Errorf("Error decoding calldata " + err.Error())
+			continue
+		}
+		if args[0].(common.Address) != common.HexToAddress(user) || args[7].(*big.Int).String() != asset.AmountOrNftTokenId || len(args[11].([][32]byte)) != len(asset.BalanceProof) {
+			t.Errorf("Unexpected calldata arguments %v", args)
+		}
+	}
+	if exit_package.Assets[1].AssetType != "1" || exit_package.Assets[1].AmountOrNftTokenId != "12" {
+		t.Errorf("Expected nft 12 in the second slot got %v", exit_package.Assets[1])
+	}
+
+	if _, err := BuildExitPackage(state, "0x0000000000000000000000000000000000000001", state.Root, 16, 8); err == nil {
+		t.Errorf("Expected an error for a user not in the state")
+	}
+	if _, err := BuildExitPackage(state, user, state.PrevRoot, 16, 8); err == nil {
+		t.Errorf("Expected an error for a state that does not hash to the expected root")
+	}
+}
+
+func TestGetExitStateRoot(t *testing.T) {
+	input_data, _, err := GetData("./test_data")
+	if err != nil {
+		t.Errorf("Error reading test data " + err.Error())
+		return
+	}
+	execution, err := ExecuteBatch(input_data, nil)
+	if err != nil {
+		t.Errorf("Error in execute batch " + err.Error())
+		return
+	}
+	input_data, _, _ = GetData("./test_data")
+	state := GetExitState(input_data)
+	user := state.UsersOrdered[0]
+	exit_package, err := BuildExitPackage(state, user, execution.Result.PrevRoot, 16, 8)
+	if err != nil {
+		t.Errorf("Error building exit package " + err.Error())
+		return
+	}
+	if exit_package.Root != execution.Result.PrevRoot {
+		t.Errorf("Expected the exit state root %s to be the previous root %s", exit_package.Root, execution.Result.PrevRoot)
+	}
+}
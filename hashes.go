@@ -4,7 +4,6 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math/big"
-	"sort"
 
 	"github.com/ethereum/go-ethereum/crypto"
 	solsha3 "github.com/miguelmota/go-solidity-sha3"
@@ -35,6 +34,40 @@ func NftQueueItemHash(address string, currency string, amountOrNftTokenId string
 	return hash, true
 }
 
+// GetQueueTransactions converts the batch into the Transaction list hashed by the queue and withdrawal hashes.
+// Trades and collection offers are left out, and so are transactions rejected in skip mode.
+func GetQueueTransactions(transactions []interface{}, rejected []RejectedTransaction) []Transaction {
+	rejected_numbers := make(map[int]bool)
+	for _, r := range rejected {
+		rejected_numbers[r.Number] = true
+	}
+	queue_transactions := []Transaction{}
+	for i, tx := range transactions {
+		if rejected_numbers[i+1] {
+			continue
+		}
+		if t, ok := tx.(map[string]interface{}); ok {
+			if t["Type"] != "nft_trade" && t["Type"] != "collection_offer" {
+				transaction := Transaction{
+					Id:                           uint(t["Id"].(float64)),
+					From:                         t["From"].(string),
+					To:                           t["To"].(string),
+					AmountOrNftTokenId:           t["AmountOrNftTokenId"].(string),
+					Nonce:                        uint(t["Nonce"].(float64)),
+					CurrencyOrNftContractAddress: t["CurrencyOrNftContractAddress"].(string),
+					Type:                         t["Type"].(string),
+					Signature:                    t["Signature"].(string),
+					IsInvalid:                    t["IsInvalid"].(bool),
+					L2Minted:                     t["L2Minted"].(bool),
+					Data:                         t["Data"].(string),
+				}
+				queue_transactions = append(queue_transactions, transaction)
+			}
+		}
+	}
+	return queue_transactions
+}
+
 func QueueHash(queue []Transaction, tx_type string) ([]byte, int, bool) {
 	var queue_hash []byte
 
@@ -71,8 +104,13 @@ func WithdrawalHash(withdrawal []Transaction) ([]byte, []string, []bool, []strin
 	withdrawal_str := ""
 	for i := 0; i < len(withdrawal); i++ {
 		if withdrawal[i].Type == "withdrawal" {
+			// native withdrawals are type 2, the type of their balance leaf, so L1 pays them out as value
+			token_type := 0
+			if IsNativeCurrency(withdrawal[i].CurrencyOrNftContractAddress) {
+				token_type = 2
+			}
 
-			withdrawal_str += fmt.Sprintf("%02x", 0)
+			withdrawal_str += fmt.Sprintf("%02x", token_type)
 			withdrawal_str += withdrawal[i].To[2:]
 			withdrawal_str += withdrawal[i].CurrencyOrNftContractAddress[2:]
 			amt, ok := new(big.Int).SetString(withdrawal[i].AmountOrNftTokenId, 10)
@@ -86,7 +124,7 @@ func WithdrawalHash(withdrawal []Transaction) ([]byte, []string, []bool, []strin
 			withdrawal_addresses = append(withdrawal_addresses, withdrawal[i].To)
 			withdrawal_currency_or_nft_contract = append(withdrawal_currency_or_nft_contract, withdrawal[i].CurrencyOrNftContractAddress)
 			withdrawal_l2_minted = append(withdrawal_l2_minted, false)
-			withdrawal_type = append(withdrawal_type, 0)
+			withdrawal_type = append(withdrawal_type, token_type)
 		} else if withdrawal[i].Type == "nft_withdrawal" {
 
 			withdrawal_str += fmt.Sprintf("%02x", 1)
@@ -195,53 +233,82 @@ func NftWithdrawalQueueHash(queue []Transaction) ([]byte, int, []string, []strin
 	return queue_hash, len(addresses), addresses, amounts, tokens, l2_minted, true
 }
 
-func GetOptimizedNonce(used_lister_nonce []uint) []uint {
-	optimized_used_lister_nonce := []uint{}
-	sort.Slice(used_lister_nonce, func(i, j int) bool { return used_lister_nonce[i] < used_lister_nonce[j] })
-	last_optimized_nonce := uint(0)
-	for i, nonce := range used_lister_nonce {
-		if uint(i+1) == nonce {
-			last_optimized_nonce = nonce
-			continue
-		} else {
-			if last_optimized_nonce != 0 {
-				optimized_used_lister_nonce = append([]uint{0}, optimized_used_lister_nonce...)
-				optimized_used_lister_nonce = append(optimized_used_lister_nonce, last_optimized_nonce)
-				last_optimized_nonce = 0
-			}
-			optimized_used_lister_nonce = append(optimized_used_lister_nonce, nonce)
-		}
-	}
-	if last_optimized_nonce != 0 {
-		optimized_used_lister_nonce = append([]uint{0}, optimized_used_lister_nonce...)
-		optimized_used_lister_nonce = append(optimized_used_lister_nonce, last_optimized_nonce)
-		last_optimized_nonce = 0
+// GetOptimizedNonce returns the committed encoding of a legacy nonce list, see NonceSet.Optimized.
+// The caller's slice is left untouched.
+//
+// Deprecated: lister nonces, cancel_listing included, are kept in a NonceSet. Use NewNonceSet and its Add and
+// Hash instead of slices.
+func GetOptimizedNonce(used_lister_nonce []uint) ([]uint, error) {
+	set, err := NewNonceSet(used_lister_nonce)
+	if err != nil {
+		return nil, err
 	}
-	return optimized_used_lister_nonce
+	return set.Optimized(), nil
 }
 
-func ProcessAndVerifyCollectionData(collection_data map[string]interface{}) (bool, []byte) {
-	types := []string{}
-	values := []interface{}{}
-	for _, t := range collection_data["MintUsers"].([]interface{}) {
-		types = append(types, "address")
-		values = append(values, t)
+// getCollectionHashes returns the collection leaf hash and the message signed by the owner. Mint rules and
+// royalty splits are appended to both only when set, so older collections keep their hash and signature.
+func getCollectionHashes(collection_data map[string]interface{}) ([]byte, []byte, error) {
+	mint_users_hash, err := GetMintUsersHash(collection_data)
+	if err != nil {
+		return nil, nil, err
 	}
-	mint_users_hash := solsha3.SoliditySHA3(
-		types,
-		values)
-	meta_hash := solsha3.SoliditySHA3(
-		[]string{"uint256", "uint256", "bytes32", "bytes32", "uint256", "address", "uint256"},
-		[]interface{}{
-			collection_data["MintStart"],
-			collection_data["MintEnd"],
-			solsha3.SoliditySHA3("string", collection_data["BaseUri"]),
-			mint_users_hash,
-			collection_data["MintFees"],
-			collection_data["MintFeesToken"],
-			collection_data["RoyaltyFeesPercetage"],
-		},
-	)
+	mint_rules, err := GetMintRules(collection_data)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta_types := []string{"uint256", "uint256", "bytes32", "bytes32", "uint256", "address", "uint256"}
+	meta_values := []interface{}{
+		collection_data["MintStart"],
+		collection_data["MintEnd"],
+		solsha3.SoliditySHA3("string", collection_data["BaseUri"]),
+		mint_users_hash,
+		collection_data["MintFees"],
+		collection_data["MintFeesToken"],
+		collection_data["RoyaltyFeesPercetage"],
+	}
+	base_uri_hash := solsha3.SoliditySHA3([]string{"string"}, []interface{}{collection_data["BaseUri"]})
+	message_types := []string{"address", "address", "uint256", "uint256", "bytes32", "uint256", "address", "uint256", "bytes32"}
+	message_values := []interface{}{
+		collection_data["ContractAddress"],
+		collection_data["Owner"],
+		collection_data["MintStart"],
+		collection_data["MintEnd"],
+		mint_users_hash,
+		collection_data["MintFees"],
+		collection_data["MintFeesToken"],
+		collection_data["RoyaltyFeesPercetage"],
+		base_uri_hash,
+	}
+	if mint_rules != nil {
+		mint_rules_hash, err := mint_rules.Hash()
+		if err != nil {
+			return nil, nil, err
+		}
+		meta_types = append(meta_types, "bytes32")
+		meta_values = append(meta_values, mint_rules_hash)
+		message_types = append(message_types, "bytes32")
+		message_values = append(message_values, mint_rules_hash)
+		// the counts the limits are checked against change with every mint, so only the leaf commits them
+		mint_counts_hash, err := GetMintCountsHash(collection_data)
+		if err != nil {
+			return nil, nil, err
+		}
+		meta_types = append(meta_types, "bytes32")
+		meta_values = append(meta_values, mint_counts_hash)
+	}
+	royalty_splits, err := GetRoyaltySplits(collection_data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if royalty_splits != nil {
+		royalty_splits_hash := RoyaltySplitsHash(royalty_splits)
+		meta_types = append(meta_types, "bytes32")
+		meta_values = append(meta_values, royalty_splits_hash)
+		message_types = append(message_types, "bytes32")
+		message_values = append(message_values, royalty_splits_hash)
+	}
+	meta_hash := solsha3.SoliditySHA3(meta_types, meta_values)
 	hash := solsha3.SoliditySHA3(
 		[]string{"address", "address", "bytes32"},
 		[]interface{}{
@@ -250,20 +317,22 @@ func ProcessAndVerifyCollectionData(collection_data map[string]interface{}) (boo
 			meta_hash,
 		},
 	)
-	base_uri_hash := solsha3.SoliditySHA3([]string{"string"}, []interface{}{collection_data["BaseUri"]})
-	message := solsha3.SoliditySHA3(
-		[]string{"address", "address", "uint256", "uint256", "bytes32", "uint256", "address", "uint256", "bytes32"},
-		[]interface{}{
-			collection_data["ContractAddress"],
-			collection_data["Owner"],
-			collection_data["MintStart"],
-			collection_data["MintEnd"],
-			mint_users_hash,
-			collection_data["MintFees"],
-			collection_data["MintFeesToken"],
-			collection_data["RoyaltyFeesPercetage"],
-			base_uri_hash,
-		},
-	)
+	message := solsha3.SoliditySHA3(message_types, message_values)
+	return hash, message, nil
+}
+
+// ProcessAndVerifyCollectionData checks the owner's signature over a newly created collection and returns its leaf hash.
+func ProcessAndVerifyCollectionData(collection_data map[string]interface{}) (bool, []byte) {
+	hash, message, err := getCollectionHashes(collection_data)
+	if err != nil {
+		return false, nil
+	}
 	return EthVerify(hex.EncodeToString(message), collection_data["Signature"].(string), collection_data["Owner"].(string)), hash
 }
+
+// GetCollectionLeafHash hashes a collection without checking any signature. Collections loaded from the
+// previous state go through VerifyCollectionData instead.
+func GetCollectionLeafHash(collection_data map[string]interface{}) ([]byte, error) {
+	hash, _, err := getCollectionHashes(collection_data)
+	return hash, err
+}
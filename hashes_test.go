@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"os"
 	"reflect"
 	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 func TestQueueItemHash(t *testing.T) {
@@ -94,6 +98,23 @@ func TestWithdrawalHash(t *testing.T) {
 	}
 }
 
+func TestWithdrawalHashNative(t *testing.T) {
+	to := "0xCcFf350Ef46B85228d6650a802107e58BF6A32Ab"
+	withdrawal := []Transaction{{Type: "withdrawal", To: to, CurrencyOrNftContractAddress: NativeCurrency, AmountOrNftTokenId: "5"}}
+	withdrawal_hash, _, _, _, _, withdrawal_type, ok := WithdrawalHash(withdrawal)
+	if !ok {
+		t.Errorf("Failed to hash withdrawal")
+		return
+	}
+	if !reflect.DeepEqual(withdrawal_type, []int{2}) {
+		t.Errorf("Expected native withdrawal type 2 got %v", withdrawal_type)
+	}
+	encoded, _ := hex.DecodeString("02" + to[2:] + NativeCurrency[2:] + fmt.Sprintf("%064x", 5) + "00")
+	if !bytes.Equal(withdrawal_hash, crypto.Keccak256(encoded)) {
+		t.Errorf("Unexpected native withdrawal hash %x", withdrawal_hash)
+	}
+}
+
 func TestWithdrawalQueueHash(t *testing.T) {
 	transactions := make([]Transaction, 0)
 	transactions_file, err := os.Open("test_data/transactions.json")
@@ -209,8 +230,8 @@ func TestNftWithdrawalQueueHash(t *testing.T) {
 func TestGetOptimizedNonce(t *testing.T) {
 	used_lister_nonce := []uint{1, 2, 3, 4, 6, 8, 21}
 	expected_optimized_nonce := []uint{0, 4, 6, 8, 21}
-	optimized_nonce := GetOptimizedNonce(used_lister_nonce)
-	if !reflect.DeepEqual(optimized_nonce, expected_optimized_nonce) {
+	optimized_nonce, err := GetOptimizedNonce(used_lister_nonce)
+	if err != nil || !reflect.DeepEqual(optimized_nonce, expected_optimized_nonce) {
 		t.Errorf("Failed to get optimized nonce expected %v got %v", expected_optimized_nonce, optimized_nonce)
 		return
 	}
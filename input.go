@@ -25,6 +25,13 @@ type Transaction struct {
 	MintFees                     string
 	MintFeesToken                string
 	CreatedAt                    time.Time
+	ListerNonces                 []uint
+	CancelBelowNonce             uint
+	MintProof                    []string
+	MintProofIndex               uint
+	MintPhase                    uint
+	BaseUri                      string
+	RoyaltyFeesPercetage         string
 }
 
 type Trade struct {
@@ -45,6 +52,11 @@ type Trade struct {
 	NumeFees           string
 	L2Minted           bool
 	CreatedAt          time.Time
+	OfferNonce         uint
+	OfferQuantity      uint
+	SellerNonce        uint
+	ListExpiry         uint64
+	BuyExpiry          uint64
 }
 
 type ValidatorKeys struct {
@@ -66,7 +78,7 @@ type InputData struct {
 	AddressPublicKeyData map[string]string
 	NewNftCollections    []map[string]interface{}
 	OldNftCollections    []map[string]interface{}
-	UserListerNonce      map[string][]uint
+	UserListerNonce      map[string]*NonceSet
 }
 
 func GetData(path string) (InputData, string, error) {
@@ -90,12 +102,12 @@ func GetData(path string) (InputData, string, error) {
 	if err != nil {
 		return input_data, "", err
 	}
+	// optional, simulate computes it
 	plan, err = os.ReadFile(path + "/new_balances.json")
-	if err != nil {
-		return input_data, "", err
+	if err == nil {
+		err = json.Unmarshal(plan, &input_data.NewUserBalances)
 	}
-	err = json.Unmarshal(plan, &input_data.NewUserBalances)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return input_data, "", err
 	}
 
@@ -115,12 +127,12 @@ func GetData(path string) (InputData, string, error) {
 	if err != nil {
 		return input_data, "", err
 	}
+	// optional, simulate computes it
 	plan, err = os.ReadFile(path + "/new_user_balance_order.json")
-	if err != nil {
-		return input_data, "", err
+	if err == nil {
+		err = json.Unmarshal(plan, &input_data.NewUserBalanceOrder)
 	}
-	err = json.Unmarshal(plan, &input_data.NewUserBalanceOrder)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return input_data, "", err
 	}
 	plan, err = os.ReadFile(path + "/old_user_balance_order.json")
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// LeafSetEntrySize is the size of one (index, leaf) entry of the leaf set: a four byte big-endian index
+// followed by the 32 byte leaf.
+const LeafSetEntrySize = 36
+
+// EncodeLeafSet writes every leaf of the account tree, empty accounts included, in index order.
+func EncodeLeafSet(tree *MerkleTree) []byte {
+	leaf_set := make([]byte, 0, len(tree.Nodes[0])*LeafSetEntrySize)
+	for i, node := range tree.Nodes[0] {
+		leaf_set = binary.BigEndian.AppendUint32(leaf_set, uint32(i))
+		leaf := make([]byte, 32)
+		copy(leaf[32-len(node.Data):], node.Data)
+		leaf_set = append(leaf_set, leaf...)
+	}
+	return leaf_set
+}
+
+// LeafSetHash is the keccak256 commitment to an encoded leaf set.
+func LeafSetHash(leaf_set []byte) []byte {
+	return crypto.Keccak256(leaf_set)
+}
+
+// LoadLeafSet rebuilds the account tree from an encoded leaf set and checks it against the signed root.
+func LoadLeafSet(leaf_set []byte, root []byte) (*MerkleTree, error) {
+	if len(leaf_set) == 0 || len(leaf_set)%LeafSetEntrySize != 0 {
+		return nil, fmt.Errorf("leaf set size %d is not a multiple of %d", len(leaf_set), LeafSetEntrySize)
+	}
+	leaves := make([][]byte, len(leaf_set)/LeafSetEntrySize)
+	for i := range leaves {
+		entry := leaf_set[i*LeafSetEntrySize : (i+1)*LeafSetEntrySize]
+		if index := binary.BigEndian.Uint32(entry[:4]); index != uint32(i) {
+			return nil, fmt.Errorf("leaf set entry %d has index %d", i, index)
+		}
+		leaves[i] = entry[4:]
+	}
+	tree := NewMerkleTreeSync(leaves)
+	if !bytes.Equal(tree.Root, root) {
+		return nil, fmt.Errorf("leaf set root %x does not match %x", tree.Root, root)
+	}
+	return tree, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestLeafSet(t *testing.T) {
+	input_data, _, err := GetData("./test_data")
+	if err != nil {
+		t.Errorf("Error reading test data " + err.Error())
+		return
+	}
+	state, err := Simulate(input_data, nil)
+	if err != nil {
+		t.Errorf("Error in simulate " + err.Error())
+		return
+	}
+	tree, err := GetAccountTree(state.UsersOrdered, len(state.UsersOrdered), state.Balances, state.BalanceOrder, state.UsersNonce, state.UserListerNonce, 16, 8)
+	if err != nil {
+		t.Errorf("Error building account tree " + err.Error())
+		return
+	}
+	leaf_set := EncodeLeafSet(tree)
+	if len(leaf_set) != 16*LeafSetEntrySize {
+		t.Errorf("Expected 16 entries got %d bytes", len(leaf_set))
+	}
+	loaded, err := LoadLeafSet(leaf_set, common.FromHex(state.Root))
+	if err != nil {
+		t.Errorf("Error loading leaf set " + err.Error())
+		return
+	}
+	for i := range tree.Nodes[0] {
+		if !bytes.Equal(loaded.Nodes[0][i].Data, tree.Nodes[0][i].Data) {
+			t.Errorf("Leaf %d differs after loading", i)
+		}
+	}
+	if !bytes.Equal(LeafSetHash(leaf_set), LeafSetHash(EncodeLeafSet(loaded))) {
+		t.Errorf("Expected the same commitment for the rebuilt tree")
+	}
+
+	tampered := append([]byte{}, leaf_set...)
+	tampered[LeafSetEntrySize+4] ^= 1
+	if _, err := LoadLeafSet(tampered, common.FromHex(state.Root)); err == nil {
+		t.Errorf("Expected a tampered leaf to fail the root check")
+	}
+	reordered := append([]byte{}, leaf_set...)
+	reordered[3] = 1
+	if _, err := LoadLeafSet(reordered, common.FromHex(state.Root)); err == nil {
+		t.Errorf("Expected an out of order index to fail")
+	}
+	if _, err := LoadLeafSet(leaf_set[:len(leaf_set)-1], common.FromHex(state.Root)); err == nil {
+		t.Errorf("Expected a truncated leaf set to fail")
+	}
+}
@@ -1,18 +1,15 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
+	"os"
 	"strconv"
-
-	// "strings"
-	"sync"
+	"strings"
 	"time"
 
-	solsha3 "github.com/miguelmota/go-solidity-sha3"
 	"github.com/schollz/progressbar/v3"
 )
 
@@ -28,404 +25,173 @@ func CopyMap(m map[string]map[string]string) map[string]map[string]string {
 }
 
 func main() {
-
-	defer TimeTrack(time.Now(), "main")
-	settlement_started_at := time.Now()
-
-	input_data, md5_sum_str, err := GetData("./data")
-	if err != nil {
-		fmt.Println("read err", err)
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		RunSimulate("./data")
+		return
 	}
-
-	max_num_balances, err := strconv.Atoi(input_data.MetaData["max_num_balances"].(string))
-	if err != nil {
-		fmt.Println("error in max_num_balances")
+	if len(os.Args) > 3 && os.Args[1] == "exit" {
+		state_file := ""
+		if len(os.Args) > 4 {
+			state_file = os.Args[4]
+		}
+		RunExit("./data", os.Args[2], os.Args[3], state_file)
 		return
 	}
-	max_num_users, err := strconv.Atoi(input_data.MetaData["max_num_users"].(string))
-	if err != nil {
-		fmt.Println("error in max_num_users")
+	if len(os.Args) > 3 && os.Args[1] == "verify-leaf-set" {
+		RunVerifyLeafSet(os.Args[2], os.Args[3])
 		return
 	}
-	max_num_collections, err := strconv.Atoi(input_data.MetaData["max_num_collections"].(string))
-	if err != nil {
-		fmt.Println("error in max_num_collections")
-		return
-	}
-	var nft_collection_data = make([][]byte, max_num_collections)
-	nft_zero_hash := solsha3.SoliditySHA3(
-		[]string{"address", "address", "bytes32"},
-		[]interface{}{
-			"0x0000000000000000000000000000000000000000",
-			"0x0000000000000000000000000000000000000000",
-			"0x0000000000000000000000000000000000000000",
-		},
-	)
-	for i := 0; i < len(input_data.OldNftCollections); i++ {
-		verfied, hash := ProcessAndVerifyCollectionData(input_data.OldNftCollections[i])
-		if !verfied {
-			fmt.Println("error in verifying nft collection")
-			return
-		}
-		nft_collection_data[i] = hash
+	if len(os.Args) > 2 && os.Args[1] == "decode-message" {
+		RunDecodeMessage(os.Args[2])
+		return
 	}
-	for i := len(input_data.OldNftCollections); i < max_num_collections; i++ {
-		nft_collection_data[i] = nft_zero_hash
+	if len(os.Args) > 2 && os.Args[1] == "cosign" {
+		RunCosign("./data", os.Args[2])
+		return
 	}
-	nft_collection_tree := NewMerkleTree(nft_collection_data)
-
-	var prev_val_hash = make([][]byte, max_num_users)
-	var empty_balances_data = make([][]byte, max_num_balances)
-	zero_hash := solsha3.SoliditySHA3(
-		[]string{"address", "uint256", "uint256", "uint256"},
-		[]interface{}{
-			"0x0000000000000000000000000000000000000000",
-			"0",
-			"0",
-			"0",
-		},
-	)
-	for i := 0; i < max_num_balances; i++ {
-		empty_balances_data[i] = zero_hash
+	if len(os.Args) > 2 && os.Args[1] == "test-vectors" {
+		data_dirs := os.Args[3:]
+		if len(data_dirs) == 0 {
+			data_dirs = []string{"./data"}
+		}
+		RunTestVectors(os.Args[2], data_dirs)
+		return
 	}
 
-	// MAX_GO_ROUTINES := 4000
-	// sem := make(chan int, MAX_GO_ROUTINES)
-	empty_balances_tree := NewMerkleTree(empty_balances_data)
-	old_user_nonce := input_data.MetaData["old_users_nonce"].(map[string]interface{})
-	var wg sync.WaitGroup
-
-	// ordered_bar := progressbar.Default(int64(len(input_data.MetaData["users_ordered"].([]interface{}))))
-	for i, u := range input_data.MetaData["users_ordered"].([]interface{}) {
-		if i > len(input_data.OldUserBalances) {
-			break
-		}
-		wg.Add(1)
-		// if i > 4000 {
-		// 	sem <- 1
-		// }
-		go func(i int, u interface{}) {
-			balances_root, ok := GetBalancesRoot(input_data.OldUserBalances[u.(string)], input_data.OldUserBalanceOrder[u.(string)], max_num_balances)
-			if !ok {
-				fmt.Println("error in getting balances root")
-				return
-			}
-			nonce := uint(0)
-			if old_user_nonce[u.(string)] != nil {
-				nonce = uint(old_user_nonce[u.(string)].(float64))
-			}
-			leaf := GetLeafHash(fmt.Sprintf("%040s", u.(string)), "0x"+balances_root, nonce, input_data.UserListerNonce[u.(string)])
-			prev_val_hash[i] = leaf
-			// if strings.ToLower(u.(string)) == "" {
-			// 	fmt.Println("user", u.(string))
-			// 	fmt.Println("balancesRoot", balances_root)
-			// 	fmt.Println("old_user_nonce", nonce)
-			// 	fmt.Println("user_lister_nonce", input_data.UserListerNonce[u.(string)])
-			// 	fmt.Println("leaf", hex.EncodeToString(leaf))
-			// }
-			// fmt.Println(u,hex.EncodeToString(leaf), balances_root, nonce, input_data.UserListerNonce[u.(string)], "init")
-			wg.Done()
-			// ordered_bar.Add(1)
-			// if i > 4000 {
-			// 	<-sem
-			// }
-		}(i, u)
-	}
-	wg.Wait()
-	// empty_bar := progressbar.Default(int64(max_num_users - len(input_data.OldUserBalances)))
-	for i := len(input_data.OldUserBalances); i < max_num_users; i++ {
-		wg.Add(1)
-		go func(i int) {
-			leaf := GetLeafHash("0x"+fmt.Sprintf("%040s", strconv.FormatUint(uint64(i), 16)), "0x"+hex.EncodeToString(empty_balances_tree.Root), 0, []uint{})
-			prev_val_hash[i] = leaf
-			wg.Done()
-			// empty_bar.Add(1)
-		}(i)
-	}
-	wg.Wait()
+	defer TimeTrack(time.Now(), "main")
+	settlement_started_at := time.Now()
 
-	prev_acc_tree_time := time.Now()
-	tree := NewMerkleTree(prev_val_hash)
-	// fmt.Println(hex.EncodeToString(tree.Root))
-	// return
-	currencies := []string{}
-	for _, c := range input_data.MetaData["currencies"].([]interface{}) {
-		currencies = append(currencies, c.(string))
-	}
-	fmt.Println("prev acc tree time", time.Since(prev_acc_tree_time))
-	input_transactions := []Transaction{}
-	for _, tx := range input_data.Transactions {
-		if t, ok := tx.(map[string]interface{}); ok {
-			if t["Type"] != "nft_trade" {
-				transaction := Transaction{
-					Id:                           uint(t["Id"].(float64)),
-					From:                         t["From"].(string),
-					To:                           t["To"].(string),
-					AmountOrNftTokenId:           t["AmountOrNftTokenId"].(string),
-					Nonce:                        uint(t["Nonce"].(float64)),
-					CurrencyOrNftContractAddress: t["CurrencyOrNftContractAddress"].(string),
-					Type:                         t["Type"].(string),
-					Signature:                    t["Signature"].(string),
-					IsInvalid:                    t["IsInvalid"].(bool),
-					L2Minted:                     t["L2Minted"].(bool),
-					Data:                         t["Data"].(string),
-				}
-				input_transactions = append(input_transactions, transaction)
-			}
-		}
+	input_data, _, err := GetData("./data")
+	if err != nil {
+		fmt.Println("read err", err)
 	}
-	init_state_balances := CopyMap(input_data.OldUserBalances)
-	user_nonce_tracker := map[string]uint64{}
-	for k, v := range input_data.MetaData["old_users_nonce"].(map[string]interface{}) {
-		user_nonce_tracker[k] = uint64(v.(float64))
+	if input_data.NewUserBalances == nil {
+		fmt.Println("new_balances.json is required, use simulate to compute it")
+		return
 	}
-	new_balances, has_process, users_updated_map, err := TransitionState(init_state_balances, input_data.Transactions, currencies, append(input_data.OldNftCollections, input_data.NewNftCollections...), input_data.UserListerNonce, input_data.MetaData, user_nonce_tracker)
+
+	options := NewTransitionOptions(input_data.MetaData)
+	settlement, err := BuildSettlement(input_data, options)
 	if err != nil {
 		fmt.Println(err)
 		fmt.Println("error in transition state")
 		return
 	}
-	// PrettyPrint("users_updated_map", users_updated_map)
-	// PrettyPrint("user_nonce_tracker", user_nonce_tracker)
-
-	for _, v := range input_data.MetaData["users_ordered"].([]interface{}) {
-		if _, ok := new_balances[v.(string)]; !ok {
-			new_balances[v.(string)] = make(map[string]string)
-			new_balances[v.(string)][input_data.MetaData["fee_currency_token"].(string)] = "0"
-		} else {
-			if _, ok := new_balances[v.(string)][input_data.MetaData["fee_currency_token"].(string)]; !ok {
-				new_balances[v.(string)][input_data.MetaData["fee_currency_token"].(string)] = "0"
-			}
-		}
+	execution := settlement.Execution
+	new_balances := execution.Result.Balances
+	execution_trace_hash, err := WriteExecutionTrace(options.Trace, "./data/execution_trace.jsonl")
+	if err != nil {
+		fmt.Println("error writing execution trace", err)
+		return
+	}
+	if len(options.Rejected) > 0 {
+		fmt.Println(len(options.Rejected), "transactions rejected")
 	}
 
 	result := NestedMapsEqual(new_balances, input_data.NewUserBalances)
 	if !result {
-		PrettyPrint("new_balances", new_balances)
-		PrettyPrint("input_data.NewUserBalances", input_data.NewUserBalances)
-		fmt.Println("new_balances and input_data.NewUserBalances are not equal")
-		return
-	}
-	bn := int(input_data.MetaData["block_number"].(float64))
-	// var users_updated map[string]string
-	var sm sync.Map
-	var prev_tree_root []byte
-	var prev_ctree_root []byte
-	prev_ctree_root = append(prev_ctree_root, nft_collection_tree.Root...)
-	prev_tree_root = append(prev_tree_root, tree.Root...)
-
-	new_acc_tree_time := time.Now()
-	// update_bar := progressbar.Default(int64(len(input_data.MetaData["users_ordered"].([]interface{}))))
-	for i, u := range input_data.MetaData["users_ordered"].([]interface{}) {
-		if users_updated_map[u.(string)] || i > len(input_data.OldUserBalances)-1 {
-			wg.Add(1)
-			// go func(i int, u interface{}) {
-			balances_root, ok := GetBalancesRoot(input_data.NewUserBalances[u.(string)], input_data.NewUserBalanceOrder[u.(string)], max_num_balances)
-			if !ok {
-				fmt.Println("error in getting balances root new")
-				return
-			}
-			leaf := GetLeafHash(u.(string), "0x"+balances_root, uint(user_nonce_tracker[u.(string)]), input_data.UserListerNonce[u.(string)])
-			sm.Store(u.(string), hex.EncodeToString(leaf))
-			tree.UpdateLeaf(i, hex.EncodeToString(leaf))
-			// if strings.ToLower(u.(string)) == "" {
-			// 	fmt.Println("user", u.(string))
-			// 	fmt.Println("balancesRoot", balances_root)
-			// 	fmt.Println("old_user_nonce", uint(user_nonce_tracker[u.(string)]))
-			// 	fmt.Println("user_lister_nonce", input_data.UserListerNonce[u.(string)])
-			// 	fmt.Println("leaf", hex.EncodeToString(leaf))
-			// }
-			wg.Done()
-			// update_bar.Add(1)
-			// }(i, u)
+		diff := DiffBalances(input_data.NewUserBalances, new_balances, input_data.Transactions, input_data.MetaData, append(input_data.OldNftCollections, input_data.NewNftCollections...))
+		diff_data, err := json.MarshalIndent(diff, "", "  ")
+		if err == nil {
+			err = os.WriteFile("./data/balance_diff.json", diff_data, 0644)
 		}
-	}
-	wg.Wait()
-	fmt.Println("new acc tree time", time.Since(new_acc_tree_time))
-
-	updated_ntf_collections := make(map[int]string)
-	for i := len(input_data.OldNftCollections); i < len(input_data.NewNftCollections); i++ {
-		verfied, hash := ProcessAndVerifyCollectionData(input_data.NewNftCollections[i])
-		if !verfied {
-			fmt.Println("error in verifying nft collection")
-			return
+		if err != nil {
+			fmt.Println("error writing balance diff", err)
 		}
-		nft_collection_tree.UpdateLeaf(i, hex.EncodeToString(hash))
-		updated_ntf_collections[i] = hex.EncodeToString(hash)
+		fmt.Println("new_balances and input_data.NewUserBalances are not equal,", len(diff), "mismatches written to ./data/balance_diff.json")
+		return
 	}
+	bn := int(input_data.MetaData["block_number"].(float64))
 
-	// find leaves and upload
-	leafMap := make(map[int]string)
-	for i := 0; i < len(tree.Nodes[0]); i++ {
-		leaf := tree.Nodes[0][i].Data
-		leafMap[i] = hex.EncodeToString(leaf)
+	// publish every account leaf so the tree can be rebuilt without the operator
+	leaf_set := EncodeLeafSet(execution.AccountTree)
+	err = os.WriteFile("./data/leaf_set.bin", leaf_set, 0644)
+	if err != nil {
+		fmt.Println("error writing leaf set", err)
+		return
 	}
+	leaf_set_hash := hex.EncodeToString(LeafSetHash(leaf_set))
+	fmt.Println("leaf_set_hash", leaf_set_hash)
 
-	// Convert the `leafMap` map to a JSON string.
-	leafData, err := json.Marshal(leafMap)
+	public_data := settlement.PublicData
+	err = os.WriteFile("./data/public_data.bin", public_data, 0644)
 	if err != nil {
-		panic(err)
+		fmt.Println("error writing public data", err)
+		return
 	}
-	// Upload Merkle leafData to S3
-	md5_leaf_data := md5.Sum(bytes.TrimRight(leafData, "\n"))
-	md5_leaf_data_str := hex.EncodeToString(md5_leaf_data[:])
-	fmt.Println("md5_leaf_data_str", md5_leaf_data_str)
-
-	//Upload Public Transaction Data to S3
-	// public_transaction_data := GenerateTransactionPublicData(input_transactions, input_data.AddressPublicKeyData, input_data.MetaData["block_number"].(float64))
-	// _ = public_transaction_data
-
-	var new_tree_root []byte
-	new_tree_root = append(new_tree_root, tree.Root...)
-	var new_ctree_root []byte
-	new_ctree_root = append(new_ctree_root, nft_collection_tree.Root...)
-	fmt.Println(hex.EncodeToString(prev_tree_root), hex.EncodeToString(new_tree_root), md5_sum_str, bn, hex.EncodeToString(prev_ctree_root), hex.EncodeToString(new_ctree_root))
-
-	message := ""
-	var queue_hash []byte
-	var queue_index int
-	var queue_len int
-
-	var nft_queue_hash []byte
-	var nft_queue_index int
-	var nft_queue_len int
-
-	var withdrawal_hash []byte
-	withdrawal_amounts_or_token_id := make([]string, 0)
-	withdrawal_addresses := make([]string, 0)
-	withdrawal_currency_or_nft_contract := make([]string, 0)
-	withdrawal_l2_minted := make([]bool, 0)
-	withdrawal_type := make([]int, 0)
-
-	cw_addresses := make([]string, 0)
-	cw_token_ids := make([]string, 0)
-	cw_amounts := make([]string, 0)
-	var cw_queue_hash []byte
-	var cw_queue_index int
-	var cw_queue_len int
+	public_data_hash := hex.EncodeToString(PublicDataHash(public_data))
 
-	nft_cw_addresses := make([]string, 0)
-	nft_cw_token_ids := make([]string, 0)
-	nft_cw_amounts := make([]string, 0)
-	var nft_cw_queue_hash []byte
-	var nft_cw_queue_index int
-	var nft_cw_queue_len int
-	nft_cw_l2_minted := make([]bool, 0)
-	var ok bool
-
-	md5_sum_str = "0000000000000000000000000000000000000000000000000000000000000000"
-	md5_leaf_data_str = "0000000000000000000000000000000000000000000000000000000000000000"
-
-	message = hex.EncodeToString(prev_tree_root) + hex.EncodeToString(new_tree_root) + fmt.Sprintf("%064s", md5_sum_str) + fmt.Sprintf("%064x", bn) + hex.EncodeToString(prev_ctree_root) + hex.EncodeToString(new_ctree_root)
-	if has_process.HasDeposit {
-		last_handled_queue_index, err := strconv.Atoi(input_data.MetaData["last_handled_queue_index"].(string))
-		if err != nil {
-			fmt.Println("error in queue size")
-			return
-		}
-		queue_hash, queue_len, ok = QueueHash(input_transactions, "deposit")
-		if !ok {
-			fmt.Println("error in getting queue hash")
-			return
-		}
-		message += fmt.Sprintf("%064x", queue_len+last_handled_queue_index) + fmt.Sprintf("%064s", hex.EncodeToString(queue_hash))
-		queue_index = queue_len + last_handled_queue_index
-	}
-	if has_process.HasContractWithdrawal {
-		last_handled_cw_queue_index, err := strconv.Atoi(input_data.MetaData["last_handled_cw_queue_index"].(string))
-		if err != nil {
-			fmt.Println("error in queue size")
-			return
-		}
-		cw_queue_hash, cw_queue_len, cw_addresses, cw_amounts, cw_token_ids, ok = WithdrawalQueueHash(input_transactions)
-		if !ok {
-			fmt.Println("error in getting cw queue hash")
-			return
-		}
-		message += fmt.Sprintf("%064x", cw_queue_len+last_handled_cw_queue_index) + fmt.Sprintf("%064s", hex.EncodeToString(cw_queue_hash))
-		cw_queue_index = cw_queue_len + last_handled_cw_queue_index
+	settlement_message := settlement.Message
+	fmt.Println(execution.Result.PrevRoot, execution.Result.Root, public_data_hash, bn, execution.Result.PrevNftRoot, execution.Result.NftRoot)
+	rejected_transactions_hash := ""
+	if settlement.RejectedTransactionsHash != nil {
+		rejected_transactions_hash = "0x" + hex.EncodeToString(settlement.RejectedTransactionsHash)
 	}
-	if has_process.HasNFTDeposit {
-		last_handled_nft_queue_index, err := strconv.Atoi(input_data.MetaData["last_handled_nft_queue_index"].(string))
-		if err != nil {
-			fmt.Println("error in queue size")
-			return
-		}
-		nft_queue_hash, nft_queue_len, ok = QueueHash(input_transactions, "nft_deposit")
-		if !ok {
-			fmt.Println("error in getting queue hash")
-			return
-		}
-		message += fmt.Sprintf("%064x", nft_queue_len+last_handled_nft_queue_index) + fmt.Sprintf("%064s", hex.EncodeToString(nft_queue_hash))
-		nft_queue_index = nft_queue_len + last_handled_nft_queue_index
-	}
-	if has_process.HasNFTContractWithdrawal {
-		last_handled_nft_cw_queue_index, err := strconv.Atoi(input_data.MetaData["last_handled_nft_cw_queue_index"].(string))
-		if err != nil {
-			fmt.Println("error in queue size")
-			return
-		}
-		nft_cw_queue_hash, nft_cw_queue_len, nft_cw_addresses, nft_cw_amounts, nft_cw_token_ids, nft_cw_l2_minted, ok = NftWithdrawalQueueHash(input_transactions)
-		if !ok {
-			fmt.Println("error in getting cw queue hash")
-			return
-		}
-		message += fmt.Sprintf("%064x", nft_cw_queue_len+last_handled_nft_cw_queue_index) + fmt.Sprintf("%064s", hex.EncodeToString(nft_cw_queue_hash))
-		nft_cw_queue_index = nft_cw_queue_len + last_handled_nft_cw_queue_index
-	}
-	if has_process.HasWithdrawal {
-		withdrawal_hash, withdrawal_amounts_or_token_id, withdrawal_l2_minted, withdrawal_addresses, withdrawal_currency_or_nft_contract, withdrawal_type, ok = WithdrawalHash(input_transactions)
-		if !ok {
-			fmt.Println("error in getting withdrawal_hash")
-			return
-		}
-		message += fmt.Sprintf("%064s", hex.EncodeToString(withdrawal_hash))
+	message := settlement_message.Encode()
+	signing_threshold, err := SigningThreshold(input_data.MetaData, len(input_data.ValidatorKeys))
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
-	signature, aggregated_public_key, _, _, err := SignMessage(message, input_data.ValidatorKeys)
+	signature, aggregated_public_key, failed_to_decrypt, signers, err := SignMessage(message, input_data.ValidatorKeys, signing_threshold)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	users_updated := map[string]interface{}{}
-	sm.Range(func(key, value interface{}) bool {
-		users_updated[fmt.Sprint(key)] = value
-		return true
-	})
-
+	if len(failed_to_decrypt) > 0 {
+		fmt.Println(len(failed_to_decrypt), "validator keys failed to decrypt", failed_to_decrypt)
+	}
 	bn_str := strconv.Itoa(bn)
 	signature_recorded_at := time.Now()
 	response := SettlementRequest{
 		SettlementId:                         uint(input_data.MetaData["settlement_id"].(float64)),
-		Root:                                 hex.EncodeToString(new_tree_root),
-		NftRoot:                              hex.EncodeToString(new_ctree_root),
+		Root:                                 strings.TrimPrefix(execution.Result.Root, "0x"),
+		NftRoot:                              strings.TrimPrefix(execution.Result.NftRoot, "0x"),
 		AggregatedSignature:                  signature,
 		AggregatedPublicKeyComponents:        aggregated_public_key,
+		SigningThreshold:                     signing_threshold,
+		Signers:                              signers,
+		SignerBitmap:                         SignerBitmap(signers),
+		FailedToDecrypt:                      failed_to_decrypt,
 		Message:                              message,
+		SettlementMessage:                    settlement_message,
 		BlockNumber:                          bn_str,
 		SignatureRecordedAt:                  signature_recorded_at,
 		SettlementStartedAt:                  settlement_started_at,
-		QueueHash:                            "0x" + hex.EncodeToString(queue_hash),
-		QueueIndex:                           queue_index,
-		NftQueueHash:                         "0x" + hex.EncodeToString(nft_queue_hash),
-		NftQueueIndex:                        nft_queue_index,
-		WithdrawalHash:                       "0x" + hex.EncodeToString(withdrawal_hash),
-		WithdrawalAmountOrTokenId:            withdrawal_amounts_or_token_id,
-		WithdrawalAddresses:                  withdrawal_addresses,
-		WithdrawalCurrencyOrNftContract:      withdrawal_currency_or_nft_contract,
-		WithdrawalL2Minted:                   withdrawal_l2_minted,
-		WithdrawalType:                       withdrawal_type,
-		ContractWithdrawalAddresses:          cw_addresses,
-		ContractWithdrawalQueueIndex:         cw_queue_index,
-		ContractWithdrawalAmounts:            cw_amounts,
-		ContractWithdrawalTokens:             cw_token_ids,
-		NftContractWithdrawalAddresses:       nft_cw_addresses,
-		NftContractWithdrawalQueueIndex:      nft_cw_queue_index,
-		NftContractWithdrawalTokensIds:       nft_cw_amounts,
-		NftContractWithdrawalContractAddress: nft_cw_token_ids,
-		NftContractWithdrawalL2Minted:        nft_cw_l2_minted,
-		UsersUpdated:                         users_updated,
-		UserListerNonce:                      input_data.UserListerNonce,
-		NftCollectionsCreated:                updated_ntf_collections,
+		QueueHash:                            "0x" + hex.EncodeToString(settlement.QueueHash),
+		QueueIndex:                           settlement.QueueIndex,
+		NftQueueHash:                         "0x" + hex.EncodeToString(settlement.NftQueueHash),
+		NftQueueIndex:                        settlement.NftQueueIndex,
+		WithdrawalHash:                       "0x" + hex.EncodeToString(settlement.WithdrawalHash),
+		WithdrawalAmountOrTokenId:            settlement.WithdrawalAmountOrTokenId,
+		WithdrawalAddresses:                  settlement.WithdrawalAddresses,
+		WithdrawalCurrencyOrNftContract:      settlement.WithdrawalCurrencyOrNftContract,
+		WithdrawalL2Minted:                   settlement.WithdrawalL2Minted,
+		WithdrawalType:                       settlement.WithdrawalType,
+		ContractWithdrawalAddresses:          settlement.ContractWithdrawalAddresses,
+		ContractWithdrawalQueueIndex:         settlement.ContractWithdrawalQueueIndex,
+		ContractWithdrawalAmounts:            settlement.ContractWithdrawalAmounts,
+		ContractWithdrawalTokens:             settlement.ContractWithdrawalTokens,
+		NftContractWithdrawalAddresses:       settlement.NftContractWithdrawalAddresses,
+		NftContractWithdrawalQueueIndex:      settlement.NftContractWithdrawalQueueIndex,
+		NftContractWithdrawalTokensIds:       settlement.NftContractWithdrawalTokensIds,
+		NftContractWithdrawalContractAddress: settlement.NftContractWithdrawalContractAddress,
+		NftContractWithdrawalL2Minted:        settlement.NftContractWithdrawalL2Minted,
+		UsersUpdated:                         execution.UsersUpdated,
+		UserListerNonce:                      execution.Result.UserListerNonce,
+		UsedListerNonceFormat:                UsedListerNonceFormat,
+		NftCollectionsCreated:                execution.NftCollectionsCreated,
+		NftCollectionsUpdated:                execution.NftCollectionsUpdated,
+		NftCollectionsData:                   execution.NftCollectionsData,
+		UserBalanceOrder:                     execution.UserBalanceOrder,
+		ExecutionTraceHash:                   execution_trace_hash,
+		RejectedTransactions:                 options.Rejected,
+		RejectedTransactionsHash:             rejected_transactions_hash,
+		PublicData:                           "0x" + hex.EncodeToString(public_data),
+		PublicDataHash:                       "0x" + public_data_hash,
+		LeafSetHash:                          "0x" + leaf_set_hash,
+		NumeFeesCollected:                    execution.Result.NumeFeesCollected,
+		NftMintCounts:                        execution.Result.NftMintCounts,
 	}
 
 	dummybar := progressbar.Default(1)
@@ -435,3 +201,184 @@ func main() {
 	// PrettyPrint("", response.SettlementId)
 
 }
+
+func RunSimulate(path string) {
+	defer TimeTrack(time.Now(), "simulate")
+	input_data, _, err := GetData(path)
+	if err != nil {
+		fmt.Println("read err", err)
+		return
+	}
+	options := NewTransitionOptions(input_data.MetaData)
+	result, err := Simulate(input_data, options)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("error in simulate")
+		return
+	}
+	result.ExecutionTraceHash, err = WriteExecutionTrace(options.Trace, path+"/execution_trace.jsonl")
+	if err != nil {
+		fmt.Println("error writing execution trace", err)
+		return
+	}
+	fmt.Println("^") // delimiter
+	PrettyPrint("", result)
+}
+
+// RunExit prints the exit package of user for the state at the last signed root, read from path, or for a
+// persisted simulation result when state_file is given. The state must hash to root.
+func RunExit(path string, user string, root string, state_file string) {
+	input_data, _, err := GetData(path)
+	if err != nil {
+		fmt.Println("read err", err)
+		return
+	}
+	max_num_balances, err := strconv.Atoi(input_data.MetaData["max_num_balances"].(string))
+	if err != nil {
+		fmt.Println("error in max_num_balances")
+		return
+	}
+	max_num_users, err := strconv.Atoi(input_data.MetaData["max_num_users"].(string))
+	if err != nil {
+		fmt.Println("error in max_num_users")
+		return
+	}
+	state := GetExitState(input_data)
+	if state_file != "" {
+		plan, err := os.ReadFile(state_file)
+		if err == nil {
+			state = SimulationResult{}
+			err = json.Unmarshal(plan, &state)
+		}
+		if err != nil {
+			fmt.Println("error reading state", err)
+			return
+		}
+	}
+	exit_package, err := BuildExitPackage(state, user, root, max_num_users, max_num_balances)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("error in exit package")
+		return
+	}
+	fmt.Println("^") // delimiter
+	PrettyPrint("", exit_package)
+}
+
+// RunVerifyLeafSet rebuilds the account tree from a published leaf set file and checks it against root.
+func RunVerifyLeafSet(leaf_set_file string, root string) {
+	leaf_set, err := os.ReadFile(leaf_set_file)
+	if err != nil {
+		fmt.Println("error reading leaf set", err)
+		return
+	}
+	root_bytes, err := hex.DecodeString(strings.TrimPrefix(root, "0x"))
+	if err != nil {
+		fmt.Println("error in root", err)
+		return
+	}
+	tree, err := LoadLeafSet(leaf_set, root_bytes)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("leaf set of", len(tree.Nodes[0]), "leaves matches root", root, "hash", "0x"+hex.EncodeToString(LeafSetHash(leaf_set)))
+}
+
+// RunDecodeMessage prints the fields of an encoded settlement message.
+func RunDecodeMessage(encoded string) {
+	message, err := DecodeSettlementMessage(encoded)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("error in settlement message")
+		return
+	}
+	fmt.Println("^") // delimiter
+	PrettyPrint("", message)
+}
+
+// RunTestVectors writes the vector suite of data_dirs to output_file for the contract tests.
+func RunTestVectors(output_file string, data_dirs []string) {
+	suite, err := BuildTestVectors(data_dirs)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("error in test vectors")
+		return
+	}
+	data, err := json.MarshalIndent(suite, "", "  ")
+	if err == nil {
+		err = os.WriteFile(output_file, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		fmt.Println("error writing test vectors", err)
+		return
+	}
+	fmt.Println("test vectors version", suite.Version, "written to", output_file)
+}
+
+// RunCosign settles the batch in path as one validator of a cosigning network. The node signs with only its own
+// key, decrypted from validators.json, and authenticates to its peers with the key in COSIGN_IDENTITY_KEY.
+func RunCosign(path string, config_file string) {
+	defer TimeTrack(time.Now(), "cosign")
+	var config CosignConfig
+	plan, err := os.ReadFile(config_file)
+	if err == nil {
+		err = json.Unmarshal(plan, &config)
+	}
+	if err != nil {
+		fmt.Println("error reading cosign config", err)
+		return
+	}
+	identity, err := LoadIdentityKey(os.Getenv("COSIGN_IDENTITY_KEY"))
+	if err != nil {
+		fmt.Println("error in COSIGN_IDENTITY_KEY", err)
+		return
+	}
+	input_data, _, err := GetData(path)
+	if err != nil {
+		fmt.Println("read err", err)
+		return
+	}
+	settlement, err := BuildSettlement(input_data, NewTransitionOptions(input_data.MetaData))
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("error in settlement message")
+		return
+	}
+	message := settlement.Message
+	if err := CheckCosignValidators(config, input_data.ValidatorKeys); err != nil {
+		fmt.Println(err)
+		return
+	}
+	config.Quorum, err = SigningThreshold(input_data.MetaData, len(OrderedValidators(input_data.ValidatorKeys)))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	validator_keys := input_data.ValidatorKeys[config.Validator]
+	key, err := DecryptValidatorKey(config.Validator, validator_keys)
+	if err != nil {
+		fmt.Println("error decrypting validator key", err)
+		return
+	}
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		fmt.Println("error listening for cosign peers", err)
+		return
+	}
+	node, err := NewCosignNode(config, listener, identity, KeyPartialSigner(key))
+	if err != nil {
+		listener.Close()
+		fmt.Println(err)
+		return
+	}
+	defer node.Close()
+	result, err := node.Cosign(uint64(input_data.MetaData["settlement_id"].(float64)), message)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("error in cosign")
+		return
+	}
+	fmt.Println("^") // delimiter
+	PrettyPrint("", result)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	solsha3 "github.com/miguelmota/go-solidity-sha3"
+)
+
+// MintPhase is a time-boxed mint window with its own price and allowlist. Start is inclusive and
+// End exclusive, both unix seconds.
+type MintPhase struct {
+	Start         *big.Int
+	End           *big.Int
+	MintFees      *big.Int
+	MintFeesToken string
+	Allowlist     map[string]interface{}
+}
+
+// MintRules are the optional collection-level limits. A zero MaxSupply or MaxMintsPerWallet means unlimited.
+type MintRules struct {
+	MaxSupply         *big.Int
+	MaxMintsPerWallet *big.Int
+	Phases            []MintPhase
+}
+
+func parseCollectionUint(value interface{}, name string) (*big.Int, error) {
+	if value == nil {
+		return big.NewInt(0), nil
+	}
+	amount, ok := new(big.Int).SetString(fmt.Sprint(value), 10)
+	if !ok || amount.Sign() < 0 {
+		return nil, fmt.Errorf("nft collection %s is not valid", name)
+	}
+	return amount, nil
+}
+
+// GetMintRules reads MaxSupply, MaxMintsPerWallet and MintPhases from the collection data. It returns
+// nil when none are set so collections signed before these settings keep their leaf hash.
+func GetMintRules(collection map[string]interface{}) (*MintRules, error) {
+	phases, _ := collection["MintPhases"].([]interface{})
+	if collection["MaxSupply"] == nil && collection["MaxMintsPerWallet"] == nil && len(phases) == 0 {
+		return nil, nil
+	}
+	var err error
+	rules := &MintRules{}
+	rules.MaxSupply, err = parseCollectionUint(collection["MaxSupply"], "max supply")
+	if err != nil {
+		return nil, err
+	}
+	rules.MaxMintsPerWallet, err = parseCollectionUint(collection["MaxMintsPerWallet"], "max mints per wallet")
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range phases {
+		phase_data, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("nft collection mint phase %d is not valid", i)
+		}
+		phase := MintPhase{Allowlist: phase_data}
+		phase.Start, err = parseCollectionUint(phase_data["Start"], "mint phase start")
+		if err != nil {
+			return nil, err
+		}
+		phase.End, err = parseCollectionUint(phase_data["End"], "mint phase end")
+		if err != nil {
+			return nil, err
+		}
+		if phase.End.Cmp(phase.Start) != 1 {
+			return nil, fmt.Errorf("nft collection mint phase %d ends before it starts", i)
+		}
+		phase.MintFees, err = parseCollectionUint(phase_data["MintFees"], "mint phase fees")
+		if err != nil {
+			return nil, err
+		}
+		phase.MintFeesToken, _ = phase_data["MintFeesToken"].(string)
+		if phase.MintFeesToken == "" {
+			return nil, fmt.Errorf("nft collection mint phase %d fees token is not valid", i)
+		}
+		if _, err := GetMintAllowlistRoot(phase_data); err != nil {
+			return nil, err
+		}
+		rules.Phases = append(rules.Phases, phase)
+	}
+	return rules, nil
+}
+
+// GetMintUsersHash is the allowlist commitment: the Merkle root when MintUsersRoot is set, otherwise
+// the packed hash of the MintUsers list.
+func GetMintUsersHash(allowlist map[string]interface{}) ([]byte, error) {
+	root, err := GetMintAllowlistRoot(allowlist)
+	if err != nil || root != nil {
+		return root, err
+	}
+	types := []string{}
+	values := []interface{}{}
+	mint_users, _ := allowlist["MintUsers"].([]interface{})
+	for _, t := range mint_users {
+		types = append(types, "address")
+		values = append(values, t)
+	}
+	return solsha3.SoliditySHA3(types, values), nil
+}
+
+// Hash commits the rules into the collection leaf and the owner's signed message.
+func (rules *MintRules) Hash() ([]byte, error) {
+	types := []string{}
+	values := []interface{}{}
+	for _, phase := range rules.Phases {
+		mint_users_hash, err := GetMintUsersHash(phase.Allowlist)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, "bytes32")
+		values = append(values, solsha3.SoliditySHA3(
+			[]string{"uint256", "uint256", "uint256", "address", "bytes32"},
+			[]interface{}{phase.Start.String(), phase.End.String(), phase.MintFees.String(), phase.MintFeesToken, mint_users_hash},
+		))
+	}
+	phases_hash := solsha3.SoliditySHA3(types, values)
+	return solsha3.SoliditySHA3(
+		[]string{"uint256", "uint256", "bytes32"},
+		[]interface{}{rules.MaxSupply.String(), rules.MaxMintsPerWallet.String(), phases_hash},
+	), nil
+}
+
+// ActivePhase returns the phase open at minted_at, or nil when the collection has no phases.
+func (rules *MintRules) ActivePhase(minted_at time.Time) (*MintPhase, error) {
+	if len(rules.Phases) == 0 {
+		return nil, nil
+	}
+	if minted_at.IsZero() {
+		return nil, fmt.Errorf("mint timestamp missing")
+	}
+	now := big.NewInt(minted_at.Unix())
+	for i := range rules.Phases {
+		if rules.Phases[i].Start.Cmp(now) != 1 && rules.Phases[i].End.Cmp(now) == 1 {
+			return &rules.Phases[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no active mint phase")
+}
+
+// GetMintCounts returns the collection's minted supply and the wallet's mint count carried over from
+// previous batches in MintedCount and WalletMintCounts. They are committed in the collection leaf by
+// GetMintCountsHash.
+func GetMintCounts(collection map[string]interface{}, user string) (*big.Int, *big.Int, error) {
+	minted, err := parseCollectionUint(collection["MintedCount"], "minted count")
+	if err != nil {
+		return nil, nil, err
+	}
+	wallet_counts, _ := collection["WalletMintCounts"].(map[string]interface{})
+	wallet_minted, err := parseCollectionUint(wallet_counts[strings.ToLower(user)], "wallet mint count")
+	if err != nil {
+		return nil, nil, err
+	}
+	return minted, wallet_minted, nil
+}
+
+// GetMintCountsHash commits MintedCount followed by every wallet and its count in address order.
+func GetMintCountsHash(collection map[string]interface{}) ([]byte, error) {
+	minted, err := parseCollectionUint(collection["MintedCount"], "minted count")
+	if err != nil {
+		return nil, err
+	}
+	wallet_counts, _ := collection["WalletMintCounts"].(map[string]interface{})
+	wallets := []string{}
+	for wallet := range wallet_counts {
+		wallets = append(wallets, wallet)
+	}
+	sort.Strings(wallets)
+	types := []string{"uint256"}
+	values := []interface{}{minted.String()}
+	for _, wallet := range wallets {
+		if !common.IsHexAddress(wallet) {
+			return nil, fmt.Errorf("nft collection wallet mint count address is not valid")
+		}
+		count, err := parseCollectionUint(wallet_counts[wallet], "wallet mint count")
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, "address", "uint256")
+		values = append(values, wallet, count.String())
+	}
+	return solsha3.SoliditySHA3(types, values), nil
+}
+
+// RecordMint returns a copy of the collection with its minted counts bumped for user. The collection passed
+// in is left untouched.
+func RecordMint(collection map[string]interface{}, user string) (map[string]interface{}, error) {
+	minted, wallet_minted, err := GetMintCounts(collection, user)
+	if err != nil {
+		return nil, err
+	}
+	recorded := make(map[string]interface{})
+	for k, v := range collection {
+		recorded[k] = v
+	}
+	wallet_counts := make(map[string]interface{})
+	if previous, ok := collection["WalletMintCounts"].(map[string]interface{}); ok {
+		for k, v := range previous {
+			wallet_counts[k] = v
+		}
+	}
+	wallet_counts[strings.ToLower(user)] = wallet_minted.Add(wallet_minted, big.NewInt(1)).String()
+	recorded["WalletMintCounts"] = wallet_counts
+	recorded["MintedCount"] = minted.Add(minted, big.NewInt(1)).String()
+	return recorded, nil
+}
+
+// GetCollectionMintCounts collects MintedCount and WalletMintCounts per contract so they can be fed back
+// into the collection data of the next batch.
+func GetCollectionMintCounts(nft_collections []map[string]interface{}) map[string]interface{} {
+	mint_counts := make(map[string]interface{})
+	for _, collection := range nft_collections {
+		if collection["MintedCount"] == nil {
+			continue
+		}
+		mint_counts[collection["ContractAddress"].(string)] = map[string]interface{}{
+			"MintedCount":      collection["MintedCount"],
+			"WalletMintCounts": collection["WalletMintCounts"],
+		}
+	}
+	return mint_counts
+}
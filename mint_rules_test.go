@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+
+	solsha3 "github.com/miguelmota/go-solidity-sha3"
+)
+
+func newTestMint(key *ecdsa.PrivateKey, to string, token_id string, mint_fees string, phase uint, created_at time.Time) Transaction {
+	transaction := Transaction{
+		To:                           to,
+		AmountOrNftTokenId:           token_id,
+		Nonce:                        1,
+		CurrencyOrNftContractAddress: testNftContract,
+		Type:                         "nft_mint",
+		NumeFees:                     "100000000000000000",
+		MintFees:                     mint_fees,
+		MintFeesToken:                testFeeCurrency,
+		MintPhase:                    phase,
+		CreatedAt:                    created_at,
+	}
+	message := solsha3.SoliditySHA3(
+		[]string{"uint256", "address", "address", "uint256", "address", "uint256", "uint256"},
+		[]interface{}{strconv.Itoa(int(transaction.Nonce)), transaction.CurrencyOrNftContractAddress, transaction.To, transaction.MintFees, transaction.MintFeesToken, transaction.NumeFees, strconv.Itoa(int(phase))},
+	)
+	transaction.Signature = signTestMessage(key, hex.EncodeToString(message))
+	return transaction
+}
+
+func TestGetMintRules(t *testing.T) {
+	rules, err := GetMintRules(map[string]interface{}{"MintUsers": []interface{}{}})
+	if rules != nil || err != nil {
+		t.Errorf("Expected no mint rules got %v %v", rules, err)
+	}
+	invalid := []map[string]interface{}{
+		{"MaxSupply": "-1"},
+		{"MaxMintsPerWallet": "abc"},
+		{"MintPhases": []interface{}{"phase"}},
+		{"MintPhases": []interface{}{map[string]interface{}{"Start": "20", "End": "10", "MintFees": "1", "MintFeesToken": testFeeCurrency}}},
+		{"MintPhases": []interface{}{map[string]interface{}{"Start": "10", "End": "20", "MintFees": "1"}}},
+	}
+	for i, collection := range invalid {
+		if _, err := GetMintRules(collection); err == nil {
+			t.Errorf("Test %d: expected error for invalid mint rules", i)
+		}
+	}
+}
+
+func TestVerifyMintDataRules(t *testing.T) {
+	minter, minter_address := newTestAccount()
+	other, other_address := newTestAccount()
+	collection := map[string]interface{}{
+		"ContractAddress":   testNftContract,
+		"MintStart":         "10",
+		"MintEnd":           "100",
+		"MintUsers":         []interface{}{},
+		"MintFees":          "1000",
+		"MintFeesToken":     testFeeCurrency,
+		"MaxSupply":         "2",
+		"MaxMintsPerWallet": "1",
+		"MintPhases": []interface{}{
+			map[string]interface{}{"Start": "1000", "End": "2000", "MintFees": "500", "MintFeesToken": testFeeCurrency, "MintUsers": []interface{}{minter_address}},
+			map[string]interface{}{"Start": "2000", "End": "3000", "MintFees": "1000", "MintFeesToken": testFeeCurrency},
+		},
+	}
+	nft_collections_map := map[string]map[string]interface{}{testNftContract: collection}
+	allowlist_phase := time.Unix(1500, 0)
+	public_phase := time.Unix(2500, 0)
+	meta_data := map[string]interface{}{"settlement_start_time": float64(1000), "settlement_end_time": float64(4000)}
+
+	if err := verifyMintData(newTestMint(minter, minter_address, "11", "500", 0, allowlist_phase), nft_collections_map, meta_data); err != nil {
+		t.Errorf("Expected allowlisted mint to pass got %s", err.Error())
+	}
+	if err := verifyMintData(newTestMint(other, other_address, "11", "500", 0, allowlist_phase), nft_collections_map, meta_data); err == nil {
+		t.Errorf("Expected error when minting outside the phase allowlist")
+	}
+	if err := verifyMintData(newTestMint(other, other_address, "11", "500", 1, public_phase), nft_collections_map, meta_data); err == nil {
+		t.Errorf("Expected error when paying the previous phase price")
+	}
+	if err := verifyMintData(newTestMint(other, other_address, "11", "1000", 1, time.Unix(3500, 0)), nft_collections_map, meta_data); err == nil {
+		t.Errorf("Expected error when no phase is active")
+	}
+	if err := verifyMintData(newTestMint(other, other_address, "11", "500", 0, public_phase), nft_collections_map, meta_data); err == nil {
+		t.Errorf("Expected error when the signed phase is not active")
+	}
+	backdated := newTestMint(other, other_address, "11", "1000", 1, public_phase)
+	backdated.CreatedAt = allowlist_phase
+	backdated.MintFees = "500"
+	if err := verifyMintData(backdated, nft_collections_map, meta_data); err == nil {
+		t.Errorf("Expected error when the mint is moved into a cheaper phase")
+	}
+	backdated = newTestMint(minter, minter_address, "11", "500", 0, allowlist_phase)
+	if err := verifyMintData(backdated, nft_collections_map, map[string]interface{}{"settlement_start_time": float64(2000), "settlement_end_time": float64(4000)}); err == nil {
+		t.Errorf("Expected error when the mint is dated before the settlement window")
+	}
+	if err := verifyMintData(backdated, nft_collections_map, map[string]interface{}{}); err == nil {
+		t.Errorf("Expected error when a phased mint has no settlement window")
+	}
+
+	recorded, err := RecordMint(collection, minter_address)
+	if err != nil || collection["MintedCount"] != nil {
+		t.Errorf("Expected RecordMint to copy the collection got %v", err)
+		return
+	}
+	nft_collections_map[testNftContract] = recorded
+	if err := verifyMintData(newTestMint(minter, minter_address, "12", "1000", 1, public_phase), nft_collections_map, meta_data); err == nil {
+		t.Errorf("Expected error when the wallet reached its mint limit")
+	}
+	if err := verifyMintData(newTestMint(other, other_address, "12", "1000", 1, public_phase), nft_collections_map, meta_data); err != nil {
+		t.Errorf("Expected public mint to pass got %s", err.Error())
+	}
+	recorded, _ = RecordMint(recorded, other_address)
+	nft_collections_map[testNftContract] = recorded
+	third, third_address := newTestAccount()
+	if err := verifyMintData(newTestMint(third, third_address, "13", "1000", 1, public_phase), nft_collections_map, meta_data); err == nil {
+		t.Errorf("Expected error when the collection reached max supply")
+	}
+	counts := GetCollectionMintCounts([]map[string]interface{}{recorded})
+	if counts[testNftContract].(map[string]interface{})["MintedCount"] != "2" {
+		t.Errorf("Expected minted count 2 got %v", counts[testNftContract])
+	}
+}
+
+func TestProcessAndVerifyCollectionDataMintRules(t *testing.T) {
+	collection_data := map[string]interface{}{
+		"Owner":                "0x46714661eecb6f07065dcb4bf3d9b772dcefa63a",
+		"ContractAddress":      "0xedb6375347e060b055d6af9842ba8c55e3d93e3a",
+		"BaseUri":              "https://ipfs.io/ipfs/QmVLbfDpBj9XxXCCgWwhshpAQE9X23skZ8SfpUPn29HhnQ",
+		"MintStart":            "10",
+		"MintEnd":              "100",
+		"MintUsers":            []interface{}{"0x46714661eecb6f07065dcb4bf3d9b772dcefa63a"},
+		"MintFees":             "1000",
+		"MintFeesToken":        "0xEe146Fac7b2fce5FdBE31C36d89cF92f6b006F80",
+		"RoyaltyFeesPercetage": "10",
+		"Signature":            "0x4e55606dd8904ffd61bb8aea4c1d8ab3fcec635dbe6abed6c3bce9a1afafc30914d756433fe1b5e748f1962f04a0f5cbf6e60c345a4c1a2e586eb66154a116061c",
+	}
+	verified, hash := ProcessAndVerifyCollectionData(collection_data)
+	if !verified {
+		t.Errorf("Failed to verify collection data")
+		return
+	}
+	collection_data["MintedCount"] = "5"
+	if _, counted_hash := ProcessAndVerifyCollectionData(collection_data); hex.EncodeToString(counted_hash) != hex.EncodeToString(hash) {
+		t.Errorf("Mint counts should not change the collection hash")
+	}
+	collection_data["MaxSupply"] = "50"
+	verified, capped_hash := ProcessAndVerifyCollectionData(collection_data)
+	if verified {
+		t.Errorf("Expected mint rules to be covered by the owner signature")
+	}
+	if hex.EncodeToString(capped_hash) == hex.EncodeToString(hash) {
+		t.Errorf("Expected mint rules to change the collection hash")
+	}
+	_, message, _ := getCollectionHashes(collection_data)
+	recorded, err := RecordMint(collection_data, "0x46714661eecb6f07065dcb4bf3d9b772dcefa63a")
+	if err != nil {
+		t.Errorf("Error recording mint " + err.Error())
+		return
+	}
+	minted_hash, minted_message, _ := getCollectionHashes(recorded)
+	if hex.EncodeToString(minted_hash) == hex.EncodeToString(capped_hash) {
+		t.Errorf("Expected the mint counts to be committed in the collection leaf")
+	}
+	if hex.EncodeToString(minted_message) != hex.EncodeToString(message) {
+		t.Errorf("Mint counts should not change the owner signed message")
+	}
+}
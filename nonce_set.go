@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// UsedListerNonceFormat versions the usedListerNonce encoding in the settlement output. Format 1 was a flat
+// list of nonces per user, format 2 writes [start, end] pairs and adds the offer fills.
+const UsedListerNonceFormat = 2
+
+// MaxExpandedListerNonces bounds the nonces a set may hold outside its leading run. Those are hashed one by one,
+// so a loaded range like [5, 1000000000000] would otherwise stall the enclave.
+const MaxExpandedListerNonces = 1 << 16
+
+// NonceRange is an inclusive run of used nonces.
+type NonceRange struct {
+	Start uint
+	End   uint
+}
+
+// NonceSet is an ordered set of used lister nonces kept as sorted, disjoint and non-adjacent ranges,
+// so consecutive nonces (for example a bulk cancel) cost a single range. Nonce 0 is never a member.
+// A nil *NonceSet is a valid empty set for reads.
+//
+// The fills of the user's collection offers are kept next to it by offer nonce. Offer nonces are a namespace
+// of their own: filling an offer never uses a lister nonce.
+type NonceSet struct {
+	ranges      []NonceRange
+	offer_fills map[uint]uint
+}
+
+// NewNonceSet builds a set from a legacy list of nonces, which may be unsorted. Lists holding nonce 0 or a
+// duplicate are rejected: the slice-based encoding committed them differently, so no set has their hash.
+func NewNonceSet(nonces []uint) (*NonceSet, error) {
+	sorted := make([]uint, len(nonces))
+	copy(sorted, nonces)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	set := &NonceSet{}
+	for i, nonce := range sorted {
+		if nonce == 0 {
+			return nil, fmt.Errorf("legacy lister nonce list contains nonce 0")
+		}
+		if i > 0 && sorted[i-1] == nonce {
+			return nil, fmt.Errorf("legacy lister nonce list contains nonce %d twice", nonce)
+		}
+		last := len(set.ranges) - 1
+		if last >= 0 && nonce <= set.ranges[last].End+1 {
+			if nonce > set.ranges[last].End {
+				set.ranges[last].End = nonce
+			}
+			continue
+		}
+		set.ranges = append(set.ranges, NonceRange{Start: nonce, End: nonce})
+	}
+	return set, nil
+}
+
+func GetOrCreateNonceSet(used_lister_nonce map[string]*NonceSet, user string) *NonceSet {
+	if used_lister_nonce[user] == nil {
+		used_lister_nonce[user] = &NonceSet{}
+	}
+	return used_lister_nonce[user]
+}
+
+func (set *NonceSet) Contains(nonce uint) bool {
+	if set == nil {
+		return false
+	}
+	i := sort.Search(len(set.ranges), func(i int) bool { return set.ranges[i].End >= nonce })
+	return i < len(set.ranges) && set.ranges[i].Start <= nonce
+}
+
+// Add inserts nonce and reports whether it was unused. Nonce 0 is rejected.
+func (set *NonceSet) Add(nonce uint) bool {
+	if nonce == 0 || set.Contains(nonce) {
+		return false
+	}
+	set.AddRange(nonce, nonce)
+	return true
+}
+
+// AddRange marks every nonce in [start, end] as used, merging with neighbouring ranges.
+func (set *NonceSet) AddRange(start uint, end uint) {
+	if start == 0 {
+		start = 1
+	}
+	if end < start {
+		return
+	}
+	i := sort.Search(len(set.ranges), func(i int) bool { return set.ranges[i].End+1 >= start })
+	j := i
+	for j < len(set.ranges) && set.ranges[j].Start <= end+1 {
+		if set.ranges[j].Start < start {
+			start = set.ranges[j].Start
+		}
+		if set.ranges[j].End > end {
+			end = set.ranges[j].End
+		}
+		j++
+	}
+	merged := make([]NonceRange, 0, len(set.ranges)-(j-i)+1)
+	merged = append(merged, set.ranges[:i]...)
+	merged = append(merged, NonceRange{Start: start, End: end})
+	merged = append(merged, set.ranges[j:]...)
+	set.ranges = merged
+}
+
+func (set *NonceSet) Copy() *NonceSet {
+	copied := &NonceSet{ranges: set.Ranges()}
+	if set != nil && len(set.offer_fills) > 0 {
+		copied.offer_fills = make(map[uint]uint)
+		for nonce, fills := range set.offer_fills {
+			copied.offer_fills[nonce] = fills
+		}
+	}
+	return copied
+}
+
+// OfferFills returns how many times the collection offer with nonce has been filled.
+func (set *NonceSet) OfferFills(nonce uint) uint {
+	if set == nil {
+		return 0
+	}
+	return set.offer_fills[nonce]
+}
+
+func (set *NonceSet) FillOffer(nonce uint) {
+	if set.offer_fills == nil {
+		set.offer_fills = make(map[uint]uint)
+	}
+	set.offer_fills[nonce]++
+}
+
+// OfferNonces lists the nonces of the filled offers in ascending order.
+func (set *NonceSet) OfferNonces() []uint {
+	nonces := []uint{}
+	if set == nil {
+		return nonces
+	}
+	for nonce := range set.offer_fills {
+		nonces = append(nonces, nonce)
+	}
+	sort.Slice(nonces, func(i, j int) bool { return nonces[i] < nonces[j] })
+	return nonces
+}
+
+func (set *NonceSet) Len() uint {
+	if set == nil {
+		return 0
+	}
+	count := uint(0)
+	for _, r := range set.ranges {
+		count += r.End - r.Start + 1
+	}
+	return count
+}
+
+// expandedLen counts the nonces outside the leading run 1..k, which is all walkOptimized visits one by one.
+func (set *NonceSet) expandedLen() uint {
+	count := set.Len()
+	if set != nil && len(set.ranges) > 0 && set.ranges[0].Start == 1 {
+		count -= set.ranges[0].End
+	}
+	return count
+}
+
+func (set *NonceSet) Ranges() []NonceRange {
+	if set == nil {
+		return []NonceRange{}
+	}
+	ranges := make([]NonceRange, len(set.ranges))
+	copy(ranges, set.ranges)
+	return ranges
+}
+
+// Nonces expands the set into the legacy sorted list.
+func (set *NonceSet) Nonces() []uint {
+	nonces := []uint{}
+	for _, r := range set.Ranges() {
+		for n := r.Start; n <= r.End; n++ {
+			nonces = append(nonces, n)
+		}
+	}
+	return nonces
+}
+
+// Optimized returns the committed encoding, identical to what GetOptimizedNonce produced for the legacy list:
+// a leading run 1..k is written as 0, k and every other nonce is listed individually.
+func (set *NonceSet) Optimized() []uint {
+	optimized := []uint{}
+	set.walkOptimized(func(n uint) { optimized = append(optimized, n) })
+	return optimized
+}
+
+func (set *NonceSet) walkOptimized(visit func(uint)) {
+	ranges := set.Ranges()
+	if len(ranges) > 0 && ranges[0].Start == 1 {
+		visit(0)
+		visit(ranges[0].End)
+		ranges = ranges[1:]
+	}
+	for _, r := range ranges {
+		for n := r.Start; n <= r.End; n++ {
+			visit(n)
+		}
+	}
+}
+
+// Hash is the used lister nonce hash committed in the account leaf by GetLeafHash: keccak256 over the
+// packed uint256 values of Optimized, or empty bytes for an empty set. It is streamed so large sets
+// are never expanded in memory. Once the user has filled offers it is keccak256 over that hash as bytes32,
+// zero for no lister nonces, followed by an offer nonce and fill count pair of uint256 per offer in nonce
+// order, so accounts without offers keep their leaf.
+func (set *NonceSet) Hash() []byte {
+	word := make([]byte, 32)
+	lister_nonce_hash := []byte{}
+	if set.Len() > 0 {
+		hasher := crypto.NewKeccakState()
+		set.walkOptimized(func(n uint) {
+			new(big.Int).SetUint64(uint64(n)).FillBytes(word)
+			hasher.Write(word)
+		})
+		lister_nonce_hash = hasher.Sum(nil)
+	}
+	offer_nonces := set.OfferNonces()
+	if len(offer_nonces) == 0 {
+		return lister_nonce_hash
+	}
+	hasher := crypto.NewKeccakState()
+	hasher.Write(common.LeftPadBytes(lister_nonce_hash, 32))
+	for _, nonce := range offer_nonces {
+		for _, n := range []uint{nonce, set.offer_fills[nonce]} {
+			new(big.Int).SetUint64(uint64(n)).FillBytes(word)
+			hasher.Write(word)
+		}
+	}
+	return hasher.Sum(nil)
+}
+
+// nonceSetJSON is the form a set with filled offers is written in, each offer as an [offer nonce, fills] pair.
+type nonceSetJSON struct {
+	ListerNonces [][2]uint `json:"listerNonces"`
+	OfferFills   [][2]uint `json:"offerFills"`
+}
+
+// MarshalJSON writes the set as a list of [start, end] pairs, or as a nonceSetJSON object when the user has
+// filled offers.
+func (set *NonceSet) MarshalJSON() ([]byte, error) {
+	pairs := [][2]uint{}
+	for _, r := range set.Ranges() {
+		pairs = append(pairs, [2]uint{r.Start, r.End})
+	}
+	offer_nonces := set.OfferNonces()
+	if len(offer_nonces) == 0 {
+		return json.Marshal(pairs)
+	}
+	offer_fills := [][2]uint{}
+	for _, nonce := range offer_nonces {
+		offer_fills = append(offer_fills, [2]uint{nonce, set.offer_fills[nonce]})
+	}
+	return json.Marshal(nonceSetJSON{ListerNonces: pairs, OfferFills: offer_fills})
+}
+
+// UnmarshalJSON accepts both the [start, end] pair list written by MarshalJSON and the legacy
+// flat list of nonces, so used_lister_nonce.json files from before the migration still load.
+func (set *NonceSet) UnmarshalJSON(data []byte) error {
+	var object nonceSetJSON
+	if err := json.Unmarshal(data, &object); err == nil {
+		lister_nonces, err := json.Marshal(object.ListerNonces)
+		if err == nil {
+			err = set.UnmarshalJSON(lister_nonces)
+		}
+		if err != nil {
+			return err
+		}
+		for _, pair := range object.OfferFills {
+			if pair[1] == 0 {
+				return fmt.Errorf("invalid offer fill entry %v", pair)
+			}
+			if set.offer_fills == nil {
+				set.offer_fills = make(map[uint]uint)
+			}
+			set.offer_fills[pair[0]] = pair[1]
+		}
+		return nil
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	nonces := []uint{}
+	pairs := []NonceRange{}
+	for _, item := range items {
+		var nonce uint
+		if err := json.Unmarshal(item, &nonce); err == nil {
+			nonces = append(nonces, nonce)
+			continue
+		}
+		var pair [2]uint
+		if err := json.Unmarshal(item, &pair); err != nil || pair[1] < pair[0] || pair[1] == ^uint(0) {
+			return fmt.Errorf("invalid used lister nonce entry %s", string(item))
+		}
+		pairs = append(pairs, NonceRange{Start: pair[0], End: pair[1]})
+	}
+	legacy, err := NewNonceSet(nonces)
+	if err != nil {
+		return err
+	}
+	*set = *legacy
+	for _, r := range pairs {
+		set.AddRange(r.Start, r.End)
+	}
+	if set.expandedLen() > MaxExpandedListerNonces {
+		return fmt.Errorf("used lister nonce ranges hold more than %d nonces outside the leading run", MaxExpandedListerNonces)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"sort"
+	"testing"
+
+	solsha3 "github.com/miguelmota/go-solidity-sha3"
+)
+
+// legacyOptimizedNonce is the slice-based encoding the NonceSet commitment replaced, kept as the reference.
+func legacyOptimizedNonce(used_lister_nonce []uint) []uint {
+	optimized_used_lister_nonce := []uint{}
+	sort.Slice(used_lister_nonce, func(i, j int) bool { return used_lister_nonce[i] < used_lister_nonce[j] })
+	last_optimized_nonce := uint(0)
+	for i, nonce := range used_lister_nonce {
+		if uint(i+1) == nonce {
+			last_optimized_nonce = nonce
+			continue
+		} else {
+			if last_optimized_nonce != 0 {
+				optimized_used_lister_nonce = append([]uint{0}, optimized_used_lister_nonce...)
+				optimized_used_lister_nonce = append(optimized_used_lister_nonce, last_optimized_nonce)
+				last_optimized_nonce = 0
+			}
+			optimized_used_lister_nonce = append(optimized_used_lister_nonce, nonce)
+		}
+	}
+	if last_optimized_nonce != 0 {
+		optimized_used_lister_nonce = append([]uint{0}, optimized_used_lister_nonce...)
+		optimized_used_lister_nonce = append(optimized_used_lister_nonce, last_optimized_nonce)
+	}
+	return optimized_used_lister_nonce
+}
+
+func legacyListerNonceHash(used_lister_nonce []uint) []byte {
+	if len(used_lister_nonce) == 0 {
+		return []byte{}
+	}
+	types := []string{}
+	values := []interface{}{}
+	for _, nonce := range legacyOptimizedNonce(append([]uint{}, used_lister_nonce...)) {
+		types = append(types, "uint256")
+		values = append(values, big.NewInt(int64(nonce)))
+	}
+	return solsha3.SoliditySHA3(types, values)
+}
+
+func TestNonceSetAddAndContains(t *testing.T) {
+	set := &NonceSet{}
+	for _, nonce := range []uint{5, 3, 9, 4, 1} {
+		if !set.Add(nonce) {
+			t.Errorf("Expected nonce %d to be added", nonce)
+		}
+	}
+	if set.Add(3) || set.Add(0) {
+		t.Errorf("Expected reused and zero nonces to be rejected")
+	}
+	for _, nonce := range []uint{1, 3, 4, 5, 9} {
+		if !set.Contains(nonce) {
+			t.Errorf("Expected set to contain %d", nonce)
+		}
+	}
+	for _, nonce := range []uint{0, 2, 6, 8, 10} {
+		if set.Contains(nonce) {
+			t.Errorf("Expected set not to contain %d", nonce)
+		}
+	}
+	expected_ranges := []NonceRange{{1, 1}, {3, 5}, {9, 9}}
+	if !reflect.DeepEqual(set.Ranges(), expected_ranges) {
+		t.Errorf("Expected ranges %v, got %v", expected_ranges, set.Ranges())
+	}
+	set.AddRange(1, 8)
+	if !reflect.DeepEqual(set.Ranges(), []NonceRange{{1, 9}}) {
+		t.Errorf("Expected ranges [{1 9}], got %v", set.Ranges())
+	}
+	if set.Len() != 9 {
+		t.Errorf("Expected 9 nonces, got %d", set.Len())
+	}
+}
+
+func TestNonceSetHashCompatibility(t *testing.T) {
+	lists := [][]uint{
+		{},
+		{1},
+		{3},
+		{1, 2, 3, 4, 6, 8, 21},
+		{21, 8, 6, 4, 3, 2, 1},
+		{2, 3, 4, 10},
+		{1, 2, 5, 6, 7},
+	}
+	for _, list := range lists {
+		set, err := NewNonceSet(list)
+		if err != nil || !bytes.Equal(set.Hash(), legacyListerNonceHash(list)) {
+			t.Errorf("Hash mismatch for %v", list)
+		}
+	}
+	// the legacy encoding committed these lists differently from any set, so they are rejected
+	for _, list := range [][]uint{{1, 1, 2}, {3, 5, 3}, {0, 1}} {
+		if _, err := NewNonceSet(list); err == nil {
+			t.Errorf("Expected an error for %v, legacy encoding %v", list, legacyOptimizedNonce(append([]uint{}, list...)))
+		}
+	}
+	var empty *NonceSet
+	if len(empty.Hash()) != 0 {
+		t.Errorf("Expected empty hash for nil set")
+	}
+}
+
+func TestNonceSetJSONMigration(t *testing.T) {
+	var legacy map[string]*NonceSet
+	err := json.Unmarshal([]byte(`{"0xabc": [8, 1, 2, 3, 21]}`), &legacy)
+	if err != nil {
+		t.Errorf("Error decoding legacy nonces " + err.Error())
+		return
+	}
+	encoded, err := json.Marshal(legacy)
+	if err != nil {
+		t.Errorf("Error encoding nonces " + err.Error())
+		return
+	}
+	if string(encoded) != `{"0xabc":[[1,3],[8,8],[21,21]]}` {
+		t.Errorf("Unexpected encoding %s", string(encoded))
+	}
+	var migrated map[string]*NonceSet
+	err = json.Unmarshal(encoded, &migrated)
+	if err != nil {
+		t.Errorf("Error decoding migrated nonces " + err.Error())
+		return
+	}
+	if !reflect.DeepEqual(migrated["0xabc"].Nonces(), []uint{1, 2, 3, 8, 21}) {
+		t.Errorf("Expected [1 2 3 8 21], got %v", migrated["0xabc"].Nonces())
+	}
+	if err := json.Unmarshal([]byte(`{"0xabc": [8, 1, 2, 8]}`), &legacy); err == nil {
+		t.Errorf("Expected an error for a legacy list with a duplicate nonce")
+	}
+}
+
+func TestNonceSetOfferFills(t *testing.T) {
+	set, _ := NewNonceSet([]uint{1, 2})
+	lister_nonce_hash := set.Hash()
+	set.FillOffer(7)
+	set.FillOffer(7)
+	if set.Contains(7) || set.OfferFills(7) != 2 {
+		t.Errorf("Expected offer 7 filled twice outside the lister nonces, got %d", set.OfferFills(7))
+	}
+	if bytes.Equal(set.Hash(), lister_nonce_hash) {
+		t.Errorf("Expected the offer fills to change the hash")
+	}
+	encoded, err := json.Marshal(set)
+	if err != nil {
+		t.Errorf("Error encoding nonces " + err.Error())
+		return
+	}
+	if string(encoded) != `{"listerNonces":[[1,2]],"offerFills":[[7,2]]}` {
+		t.Errorf("Unexpected encoding %s", string(encoded))
+	}
+	decoded := &NonceSet{}
+	err = json.Unmarshal(encoded, decoded)
+	if err != nil {
+		t.Errorf("Error decoding nonces " + err.Error())
+		return
+	}
+	if !bytes.Equal(decoded.Hash(), set.Hash()) || decoded.OfferFills(7) != 2 {
+		t.Errorf("Expected the decoded set to equal the encoded one")
+	}
+	copied := set.Copy()
+	copied.FillOffer(7)
+	if set.OfferFills(7) != 2 {
+		t.Errorf("Expected Copy not to share offer fills")
+	}
+}
+
+func TestNonceSetRejectsOversizedRanges(t *testing.T) {
+	set := &NonceSet{}
+	if err := json.Unmarshal([]byte(`[[5,1000000000000]]`), set); err == nil {
+		t.Errorf("Expected an oversized range to be rejected")
+	}
+	if err := json.Unmarshal([]byte(`[[1,1000000000000],[1000000000002,1000000000010]]`), set); err != nil {
+		t.Errorf("Expected a long leading run to load, got %v", err)
+		return
+	}
+	if len(set.Hash()) != 32 {
+		t.Errorf("Expected a hash for the loaded set")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// PublicDataTypes gives each transaction type its one byte code in the public data, by position.
+var PublicDataTypes = []string{"deposit", "withdrawal", "transfer", "contract_withdrawal", "nft_deposit", "nft_withdrawal", "nft_transfer", "nft_contract_withdrawal", "nft_mint", "nft_trade", "collection_offer", "cancel_listing", "collection_update", "collection_transfer"}
+
+const (
+	publicDataAddress = iota
+	publicDataUint
+	publicDataFlag
+	publicDataBytes
+	publicDataUints
+)
+
+type publicDataField struct {
+	name string
+	kind int
+}
+
+// publicDataSchema lists, per transaction type, the fields written after the type code in order. It is shared by
+// EncodePublicData and DecodePublicData so the two cannot drift apart.
+var publicDataSchema = map[string][]publicDataField{
+	"deposit":                 {{"To", publicDataAddress}, {"CurrencyOrNftContractAddress", publicDataAddress}, {"AmountOrNftTokenId", publicDataUint}},
+	"nft_deposit":             {{"To", publicDataAddress}, {"CurrencyOrNftContractAddress", publicDataAddress}, {"AmountOrNftTokenId", publicDataUint}, {"L2Minted", publicDataFlag}},
+	"contract_withdrawal":     {{"From", publicDataAddress}, {"CurrencyOrNftContractAddress", publicDataAddress}, {"AmountOrNftTokenId", publicDataUint}},
+	"nft_contract_withdrawal": {{"From", publicDataAddress}, {"CurrencyOrNftContractAddress", publicDataAddress}, {"AmountOrNftTokenId", publicDataUint}},
+	"withdrawal":              {{"From", publicDataAddress}, {"To", publicDataAddress}, {"CurrencyOrNftContractAddress", publicDataAddress}, {"AmountOrNftTokenId", publicDataUint}, {"Nonce", publicDataUint}},
+	"nft_withdrawal":          {{"From", publicDataAddress}, {"To", publicDataAddress}, {"CurrencyOrNftContractAddress", publicDataAddress}, {"AmountOrNftTokenId", publicDataUint}, {"Nonce", publicDataUint}},
+	"transfer":                {{"From", publicDataAddress}, {"To", publicDataAddress}, {"CurrencyOrNftContractAddress", publicDataAddress}, {"AmountOrNftTokenId", publicDataUint}, {"Nonce", publicDataUint}, {"NumeFees", publicDataUint}},
+	"nft_transfer":            {{"From", publicDataAddress}, {"To", publicDataAddress}, {"CurrencyOrNftContractAddress", publicDataAddress}, {"AmountOrNftTokenId", publicDataUint}, {"Nonce", publicDataUint}, {"NumeFees", publicDataUint}},
+	"nft_mint":                {{"To", publicDataAddress}, {"CurrencyOrNftContractAddress", publicDataAddress}, {"AmountOrNftTokenId", publicDataUint}, {"Nonce", publicDataUint}, {"MintFees", publicDataUint}, {"MintFeesToken", publicDataAddress}, {"NumeFees", publicDataUint}, {"L2Minted", publicDataFlag}},
+	"nft_trade":               {{"From", publicDataAddress}, {"To", publicDataAddress}, {"NftContractAddress", publicDataAddress}, {"NftTokenId", publicDataUint}, {"Currency", publicDataAddress}, {"BuyAmount", publicDataUint}, {"RoyaltyAmount", publicDataUint}, {"NumeFees", publicDataUint}, {"ListerNonce", publicDataUint}, {"BuyerNonce", publicDataUint}, {"L2Minted", publicDataFlag}},
+	"collection_offer":        {{"From", publicDataAddress}, {"To", publicDataAddress}, {"NftContractAddress", publicDataAddress}, {"NftTokenId", publicDataUint}, {"Currency", publicDataAddress}, {"BuyAmount", publicDataUint}, {"RoyaltyAmount", publicDataUint}, {"NumeFees", publicDataUint}, {"OfferNonce", publicDataUint}, {"SellerNonce", publicDataUint}, {"L2Minted", publicDataFlag}},
+	"cancel_listing":          {{"From", publicDataAddress}, {"Nonce", publicDataUint}, {"ListerNonces", publicDataUints}, {"CancelBelowNonce", publicDataUint}},
+	"collection_update":       {{"From", publicDataAddress}, {"CurrencyOrNftContractAddress", publicDataAddress}, {"Nonce", publicDataUint}, {"RoyaltyFeesPercetage", publicDataUint}, {"MintFees", publicDataUint}, {"MintFeesToken", publicDataAddress}, {"BaseUri", publicDataBytes}},
+	"collection_transfer":     {{"From", publicDataAddress}, {"CurrencyOrNftContractAddress", publicDataAddress}, {"To", publicDataAddress}, {"Nonce", publicDataUint}},
+}
+
+type publicDataWriter struct {
+	data []byte
+	err  error
+}
+
+func (w *publicDataWriter) address(name string, value interface{}) {
+	address, _ := value.(string)
+	if !common.IsHexAddress(address) {
+		if w.err == nil {
+			w.err = fmt.Errorf("invalid %s address %q", name, address)
+		}
+		return
+	}
+	w.data = append(w.data, common.HexToAddress(address).Bytes()...)
+}
+
+// number writes an unsigned integer as one length byte followed by its minimal big-endian bytes.
+func (w *publicDataWriter) number(n *big.Int) {
+	if n == nil || n.Sign() < 0 || len(n.Bytes()) > 32 {
+		if w.err == nil {
+			w.err = fmt.Errorf("invalid number %v", n)
+		}
+		return
+	}
+	w.data = append(w.data, byte(len(n.Bytes())))
+	w.data = append(w.data, n.Bytes()...)
+}
+
+// uint writes a decimal string field, or a JSON number field such as Nonce.
+func (w *publicDataWriter) uint(value interface{}) {
+	switch value := value.(type) {
+	case string:
+		n, ok := new(big.Int).SetString(value, 10)
+		if !ok {
+			n = nil
+		}
+		w.number(n)
+	case float64:
+		w.number(new(big.Int).SetUint64(uint64(value)))
+	default:
+		w.number(nil)
+	}
+}
+
+func (w *publicDataWriter) flag(value interface{}) {
+	if value, _ := value.(bool); value {
+		w.data = append(w.data, 1)
+	} else {
+		w.data = append(w.data, 0)
+	}
+}
+
+// bytes writes a string field with a two byte length prefix, so it can be at most 65535 bytes long.
+func (w *publicDataWriter) bytes(name string, value interface{}) {
+	s, _ := value.(string)
+	if len(s) > math.MaxUint16 {
+		if w.err == nil {
+			w.err = fmt.Errorf("%s is %d bytes, longer than %d", name, len(s), math.MaxUint16)
+		}
+		return
+	}
+	w.data = binary.BigEndian.AppendUint16(w.data, uint16(len(s)))
+	w.data = append(w.data, s...)
+}
+
+// EncodePublicData encodes one transaction compactly: its type code followed by the fields needed to replay it
+// on the previous state. Signatures are left out, they were checked by the enclave.
+func EncodePublicData(t map[string]interface{}) ([]byte, error) {
+	tx_type, _ := t["Type"].(string)
+	code := -1
+	for i, name := range PublicDataTypes {
+		if name == tx_type {
+			code = i
+		}
+	}
+	if code == -1 {
+		return nil, fmt.Errorf("no public data encoding for %q", tx_type)
+	}
+	w := &publicDataWriter{data: []byte{byte(code)}}
+	for _, field := range publicDataSchema[tx_type] {
+		switch field.kind {
+		case publicDataAddress:
+			w.address(field.name, t[field.name])
+		case publicDataUint:
+			w.uint(t[field.name])
+		case publicDataFlag:
+			w.flag(t[field.name])
+		case publicDataBytes:
+			w.bytes(field.name, t[field.name])
+		case publicDataUints:
+			values, _ := t[field.name].([]interface{})
+			w.number(big.NewInt(int64(len(values))))
+			for _, v := range values {
+				w.uint(v)
+			}
+		}
+	}
+	return w.data, w.err
+}
+
+type publicDataReader struct {
+	data []byte
+	err  error
+}
+
+func (r *publicDataReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = fmt.Errorf("public data truncated")
+		return nil
+	}
+	value := r.data[:n]
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *publicDataReader) address() interface{} {
+	return strings.ToLower(common.BytesToAddress(r.next(common.AddressLength)).Hex())
+}
+
+// number reads a value written by publicDataWriter.number, rejecting lengths over 32 bytes and leading zeros so
+// that every number has a single encoding.
+func (r *publicDataReader) number() *big.Int {
+	length := r.next(1)
+	if r.err != nil {
+		return nil
+	}
+	if length[0] > 32 {
+		r.err = fmt.Errorf("invalid number length %d", length[0])
+		return nil
+	}
+	value := r.next(int(length[0]))
+	if r.err == nil && len(value) > 0 && value[0] == 0 {
+		r.err = fmt.Errorf("number not minimally encoded")
+	}
+	if r.err != nil {
+		return nil
+	}
+	return new(big.Int).SetBytes(value)
+}
+
+func (r *publicDataReader) uint() interface{} {
+	if n := r.number(); n != nil {
+		return n.String()
+	}
+	return ""
+}
+
+func (r *publicDataReader) flag() interface{} {
+	value := r.next(1)
+	if r.err != nil {
+		return false
+	}
+	if value[0] > 1 {
+		r.err = fmt.Errorf("invalid flag %d", value[0])
+	}
+	return value[0] == 1
+}
+
+func (r *publicDataReader) bytes() interface{} {
+	length := r.next(2)
+	if r.err != nil {
+		return ""
+	}
+	return string(r.next(int(binary.BigEndian.Uint16(length))))
+}
+
+// DecodePublicData splits the public data of a batch back into its transactions, each with its Type and the
+// fields of its schema: addresses in lower case hex, numbers as decimal strings. It fails on an unknown type code
+// or on data that ends inside a transaction.
+func DecodePublicData(data []byte) ([]map[string]interface{}, error) {
+	transactions := []map[string]interface{}{}
+	r := &publicDataReader{data: data}
+	for len(r.data) > 0 {
+		code := r.next(1)[0]
+		if int(code) >= len(PublicDataTypes) {
+			return nil, fmt.Errorf("unknown public data type %d for transaction number %v", code, len(transactions)+1)
+		}
+		tx_type := PublicDataTypes[code]
+		t := map[string]interface{}{"Type": tx_type}
+		for _, field := range publicDataSchema[tx_type] {
+			switch field.kind {
+			case publicDataAddress:
+				t[field.name] = r.address()
+			case publicDataUint:
+				t[field.name] = r.uint()
+			case publicDataFlag:
+				t[field.name] = r.flag()
+			case publicDataBytes:
+				t[field.name] = r.bytes()
+			case publicDataUints:
+				values := []interface{}{}
+				count := r.number()
+				if count != nil && count.Cmp(big.NewInt(int64(len(r.data)))) > 0 {
+					r.err = fmt.Errorf("public data truncated")
+				}
+				for i := int64(0); r.err == nil && i < count.Int64(); i++ {
+					values = append(values, r.uint())
+				}
+				t[field.name] = values
+			}
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("%s for transaction number %v", r.err.Error(), len(transactions)+1)
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions, nil
+}
+
+// GetPublicData concatenates the public data of every transaction applied in the batch, leaving out contract
+// withdrawals marked invalid and transactions rejected in skip mode.
+func GetPublicData(transactions []interface{}, rejected []RejectedTransaction) ([]byte, error) {
+	rejected_numbers := make(map[int]bool)
+	for _, r := range rejected {
+		rejected_numbers[r.Number] = true
+	}
+	public_data := []byte{}
+	for i, tx := range transactions {
+		t, ok := tx.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid transaction type")
+		}
+		if is_invalid, _ := t["IsInvalid"].(bool); is_invalid || rejected_numbers[i+1] {
+			continue
+		}
+		data, err := EncodePublicData(t)
+		if err != nil {
+			return nil, fmt.Errorf("%s for transaction number %v", err.Error(), i+1)
+		}
+		public_data = append(public_data, data...)
+	}
+	return public_data, nil
+}
+
+// PublicDataHash is the keccak256 commitment to the public data signed in the settlement message.
+func PublicDataHash(public_data []byte) []byte {
+	return crypto.Keccak256(public_data)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEncodePublicData(t *testing.T) {
+	deposit := map[string]interface{}{
+		"Type":                         "deposit",
+		"From":                         "deposit.From",
+		"To":                           "0xccff350ef46b85228d6650a802107e58bf6a32ab",
+		"CurrencyOrNftContractAddress": testFeeCurrency,
+		"AmountOrNftTokenId":           "256",
+	}
+	data, err := EncodePublicData(deposit)
+	if err != nil {
+		t.Errorf("Error encoding deposit " + err.Error())
+		return
+	}
+	expected := "00" + "ccff350ef46b85228d6650a802107e58bf6a32ab" + "ee146fac7b2fce5fdbe31c36d89cf92f6b006f80" + "020100"
+	if hex.EncodeToString(data) != expected {
+		t.Errorf("Expected %s got %s", expected, hex.EncodeToString(data))
+	}
+	deposit["AmountOrNftTokenId"] = "-1"
+	if _, err := EncodePublicData(deposit); err == nil {
+		t.Errorf("Expected an error for a negative amount")
+	}
+	deposit["AmountOrNftTokenId"] = "1"
+	deposit["To"] = "deposit.To"
+	if _, err := EncodePublicData(deposit); err == nil {
+		t.Errorf("Expected an error for an invalid address")
+	}
+	if _, err := EncodePublicData(map[string]interface{}{"Type": "unknown"}); err == nil {
+		t.Errorf("Expected an error for an unknown type")
+	}
+	update := map[string]interface{}{
+		"Type":                         "collection_update",
+		"From":                         "0xccff350ef46b85228d6650a802107e58bf6a32ab",
+		"CurrencyOrNftContractAddress": testNftContract,
+		"Nonce":                        float64(1),
+		"RoyaltyFeesPercetage":         "5",
+		"MintFees":                     "0",
+		"MintFeesToken":                testFeeCurrency,
+		"BaseUri":                      strings.Repeat("a", 65535),
+	}
+	if _, err := EncodePublicData(update); err != nil {
+		t.Errorf("Error encoding the longest base uri " + err.Error())
+	}
+	update["BaseUri"] = strings.Repeat("a", 65536)
+	if _, err := EncodePublicData(update); err == nil {
+		t.Errorf("Expected an error for a base uri longer than 65535 bytes")
+	}
+}
+
+func TestGetPublicData(t *testing.T) {
+	input_data, _, err := GetData("./test_data")
+	if err != nil {
+		t.Errorf("Error reading test data " + err.Error())
+		return
+	}
+	public_data, err := GetPublicData(input_data.Transactions, nil)
+	if err != nil {
+		t.Errorf("Error in public data " + err.Error())
+		return
+	}
+	// transactions 26 and 27 are contract withdrawals marked invalid
+	applied := []byte{}
+	for i, tx := range input_data.Transactions {
+		if i == 25 || i == 26 {
+			continue
+		}
+		data, _ := EncodePublicData(tx.(map[string]interface{}))
+		applied = append(applied, data...)
+	}
+	if !bytes.Equal(public_data, applied) {
+		t.Errorf("Expected the public data of the applied transactions only")
+	}
+	rejected := []RejectedTransaction{{TransactionRef: TransactionRef{Number: 30, Id: 3, Type: "nft_transfer"}}}
+	without_rejected, err := GetPublicData(input_data.Transactions, rejected)
+	if err != nil {
+		t.Errorf("Error in public data " + err.Error())
+		return
+	}
+	last, _ := EncodePublicData(input_data.Transactions[29].(map[string]interface{}))
+	if !bytes.Equal(without_rejected, public_data[:len(public_data)-len(last)]) {
+		t.Errorf("Expected the rejected transaction to be left out")
+	}
+	if bytes.Equal(PublicDataHash(public_data), PublicDataHash(without_rejected)) {
+		t.Errorf("Expected the commitment to change with the applied transactions")
+	}
+}
+
+func TestDecodePublicData(t *testing.T) {
+	input_data, _, err := GetData("./test_data")
+	if err != nil {
+		t.Errorf("Error reading test data " + err.Error())
+		return
+	}
+	public_data, err := GetPublicData(input_data.Transactions, nil)
+	if err != nil {
+		t.Errorf("Error in public data " + err.Error())
+		return
+	}
+	decoded, err := DecodePublicData(public_data)
+	if err != nil {
+		t.Errorf("Error decoding public data " + err.Error())
+		return
+	}
+	applied := []map[string]interface{}{}
+	for _, tx := range input_data.Transactions {
+		if is_invalid, _ := tx.(map[string]interface{})["IsInvalid"].(bool); !is_invalid {
+			applied = append(applied, tx.(map[string]interface{}))
+		}
+	}
+	if len(decoded) != len(applied) {
+		t.Errorf("Expected %d transactions got %d", len(applied), len(decoded))
+		return
+	}
+	for i, tx := range applied {
+		if decoded[i]["Type"] != tx["Type"] {
+			t.Errorf("Expected type %v got %v for transaction %d", tx["Type"], decoded[i]["Type"], i)
+			continue
+		}
+		for _, field := range publicDataSchema[tx["Type"].(string)] {
+			expected, got := fmt.Sprint(tx[field.name]), fmt.Sprint(decoded[i][field.name])
+			if field.kind == publicDataUints {
+				got = strings.ReplaceAll(got, " ", ",")
+				expected = strings.ReplaceAll(expected, " ", ",")
+			}
+			if field.kind == publicDataBytes && tx[field.name] == nil {
+				expected = ""
+			}
+			if !strings.EqualFold(expected, got) {
+				t.Errorf("Expected %s %s got %s for transaction %d", field.name, expected, got, i)
+			}
+		}
+		data, err := EncodePublicData(decoded[i])
+		if err != nil {
+			t.Errorf("Error encoding decoded transaction " + err.Error())
+			continue
+		}
+		original, _ := EncodePublicData(tx)
+		if !bytes.Equal(data, original) {
+			t.Errorf("Expected the decoded transaction %d to encode to the same bytes", i)
+		}
+	}
+
+	if _, err := DecodePublicData(public_data[:len(public_data)-1]); err == nil {
+		t.Errorf("Expected an error for truncated public data")
+	}
+	if _, err := DecodePublicData(append(append([]byte{}, public_data...), byte(len(PublicDataTypes)))); err == nil {
+		t.Errorf("Expected an error for an unknown type code")
+	}
+	if _, err := DecodePublicData([]byte{0, 0}); err == nil {
+		t.Errorf("Expected an error for a transaction cut inside an address")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	solsha3 "github.com/miguelmota/go-solidity-sha3"
+)
+
+// Rejection codes classify why a transaction was rejected. They are committed in the signed message, so a
+// code must never change meaning once released; new failure classes get new codes.
+const (
+	RejectInvalidTransaction = 1
+	RejectSignature          = 2
+	RejectNonce              = 3
+	RejectFees               = 4
+	RejectBalance            = 5
+	RejectNftOwnership       = 6
+	RejectOrderExpiry        = 7
+	RejectCollectionOffer    = 8
+	RejectMint               = 9
+	RejectCollection         = 10
+	RejectCancel             = 11
+)
+
+// RejectedTransaction is a transaction left out of the batch in skip mode, with the code of its failure class
+// and the error that rejected it. Only the code is committed, the reason is for the report.
+type RejectedTransaction struct {
+	TransactionRef
+	Code   uint   `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// rejectionError tags a transaction error with its rejection code.
+type rejectionError struct {
+	code uint
+	err  error
+}
+
+func (e *rejectionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *rejectionError) Unwrap() error {
+	return e.err
+}
+
+func withReason(code uint, err error) error {
+	return &rejectionError{code: code, err: err}
+}
+
+// RejectionCode returns the code err was tagged with, or RejectInvalidTransaction for an untagged error.
+func RejectionCode(err error) uint {
+	var rejection *rejectionError
+	if errors.As(err, &rejection) {
+		return rejection.code
+	}
+	return RejectInvalidTransaction
+}
+
+// IsRejectable reports whether a failing transaction may be skipped. Deposits and contract withdrawals come
+// from the L1 queues, which are settled in full or not at all.
+func IsRejectable(tx interface{}) bool {
+	t, ok := tx.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	switch t["Type"] {
+	case "deposit", "nft_deposit", "contract_withdrawal", "nft_contract_withdrawal":
+		return false
+	}
+	return true
+}
+
+// RejectedTransactionsHash commits the rejected list, in batch order, into the signed message. The reason text
+// is left out: it is not stable across releases, while the code is.
+func RejectedTransactionsHash(rejected []RejectedTransaction) []byte {
+	types := []string{}
+	values := []interface{}{}
+	for _, r := range rejected {
+		types = append(types, "uint256", "uint256", "string", "uint256")
+		values = append(values, fmt.Sprint(r.Number), fmt.Sprint(r.Id), r.Type, fmt.Sprint(r.Code))
+	}
+	return solsha3.SoliditySHA3(types, values)
+}
+
+type balanceSnapshot struct {
+	balances     map[string]string
+	exists       bool
+	updated      bool
+	nonce        uint64
+	has_nonce    bool
+	lister_nonce *NonceSet
+	cw_invalid   map[string]bool
+}
+
+// transactionCheckpoint saves the parts of the batch state a single transaction can change: the accounts of
+// its From, To, the nume user and the collection revenue recipients, the NFT it moves, its collection and
+// offer fill counter, so that a rejected transaction can be rolled back.
+type transactionCheckpoint struct {
+	transaction          map[string]interface{}
+	state_balances       map[string]map[string]string
+	has_process          *HasProcess
+	saved_has_process    HasProcess
+	users_updated_map    map[string]bool
+	nume_fees_collected  map[string]string
+	saved_nume_fees      map[string]string
+	used_lister_nonce    map[string]*NonceSet
+	user_nonce_tracker   map[string]uint64
+	cw_should_be_invalid map[string]map[string]bool
+	users                map[string]balanceSnapshot
+	nft_owners           NftOwnerIndex
+	nft_owner_keys       map[string]*string
+	nft_collections_map  map[string]map[string]interface{}
+	collection_contract  string
+	collection           map[string]interface{}
+}
+
+func newTransactionCheckpoint(t map[string]interface{}, state_balances map[string]map[string]string, has_process *HasProcess, users_updated_map map[string]bool, nume_fees_collected map[string]string, nft_collections_map map[string]map[string]interface{}, nft_owners NftOwnerIndex, cw_should_be_invalid map[string]map[string]bool, used_lister_nonce map[string]*NonceSet, user_nonce_tracker map[string]uint64, nume_address string) *transactionCheckpoint {
+	field := func(name string) string {
+		value, _ := t[name].(string)
+		return value
+	}
+	checkpoint := &transactionCheckpoint{
+		transaction:          t,
+		state_balances:       state_balances,
+		has_process:          has_process,
+		saved_has_process:    *has_process,
+		users_updated_map:    users_updated_map,
+		nume_fees_collected:  nume_fees_collected,
+		saved_nume_fees:      make(map[string]string),
+		used_lister_nonce:    used_lister_nonce,
+		user_nonce_tracker:   user_nonce_tracker,
+		cw_should_be_invalid: cw_should_be_invalid,
+		users:                make(map[string]balanceSnapshot),
+		nft_owners:           nft_owners,
+		nft_owner_keys:       make(map[string]*string),
+	}
+	for k, v := range nume_fees_collected {
+		checkpoint.saved_nume_fees[k] = v
+	}
+
+	users := []string{field("From"), field("To"), nume_address}
+	for _, contract := range []string{field("CurrencyOrNftContractAddress"), field("NftContractAddress")} {
+		if collection, ok := nft_collections_map[contract]; ok && checkpoint.collection == nil {
+			checkpoint.nft_collections_map = nft_collections_map
+			checkpoint.collection_contract = contract
+			checkpoint.collection = collection
+			users = append(users, GetRevenueRecipients(collection)...)
+		}
+	}
+	for _, u := range users {
+		if _, ok := checkpoint.users[u]; ok {
+			continue
+		}
+		snapshot := balanceSnapshot{updated: users_updated_map[u]}
+		if balances, ok := state_balances[u]; ok {
+			snapshot.exists = true
+			snapshot.balances = make(map[string]string)
+			for k, v := range balances {
+				snapshot.balances[k] = v
+			}
+		}
+		snapshot.nonce, snapshot.has_nonce = user_nonce_tracker[u]
+		if set, ok := used_lister_nonce[u]; ok {
+			snapshot.lister_nonce = set.Copy()
+		}
+		if cw_invalid, ok := cw_should_be_invalid[u]; ok {
+			snapshot.cw_invalid = make(map[string]bool)
+			for k, v := range cw_invalid {
+				snapshot.cw_invalid[k] = v
+			}
+		}
+		checkpoint.users[u] = snapshot
+	}
+
+	for _, key := range []string{NftKey(field("CurrencyOrNftContractAddress"), field("AmountOrNftTokenId")), NftKey(field("NftContractAddress"), field("NftTokenId"))} {
+		if owner, ok := nft_owners[key]; ok {
+			checkpoint.nft_owner_keys[key] = &owner
+		} else {
+			checkpoint.nft_owner_keys[key] = nil
+		}
+	}
+	return checkpoint
+}
+
+// restore puts back everything saved by newTransactionCheckpoint. Collections are only ever replaced by
+// changed copies, so the saved collection map is put back as is.
+func (checkpoint *transactionCheckpoint) restore() {
+	*checkpoint.has_process = checkpoint.saved_has_process
+	for k := range checkpoint.nume_fees_collected {
+		delete(checkpoint.nume_fees_collected, k)
+	}
+	for k, v := range checkpoint.saved_nume_fees {
+		checkpoint.nume_fees_collected[k] = v
+	}
+	for u, snapshot := range checkpoint.users {
+		if snapshot.exists {
+			checkpoint.state_balances[u] = snapshot.balances
+		} else {
+			delete(checkpoint.state_balances, u)
+		}
+		if snapshot.updated {
+			checkpoint.users_updated_map[u] = true
+		} else {
+			delete(checkpoint.users_updated_map, u)
+		}
+		if snapshot.has_nonce {
+			checkpoint.user_nonce_tracker[u] = snapshot.nonce
+		} else {
+			delete(checkpoint.user_nonce_tracker, u)
+		}
+		if snapshot.lister_nonce != nil {
+			checkpoint.used_lister_nonce[u] = snapshot.lister_nonce
+		} else {
+			delete(checkpoint.used_lister_nonce, u)
+		}
+		if snapshot.cw_invalid != nil {
+			checkpoint.cw_should_be_invalid[u] = snapshot.cw_invalid
+		} else {
+			delete(checkpoint.cw_should_be_invalid, u)
+		}
+	}
+	for key, owner := range checkpoint.nft_owner_keys {
+		if owner != nil {
+			checkpoint.nft_owners[key] = *owner
+		} else {
+			delete(checkpoint.nft_owners, key)
+		}
+	}
+	if checkpoint.collection != nil {
+		checkpoint.nft_collections_map[checkpoint.collection_contract] = checkpoint.collection
+	}
+}
+
+func (checkpoint *transactionCheckpoint) rejected(number int, err error) RejectedTransaction {
+	id, _ := checkpoint.transaction["Id"].(float64)
+	tx_type, _ := checkpoint.transaction["Type"].(string)
+	return RejectedTransaction{TransactionRef: TransactionRef{Number: number, Id: uint(id), Type: tx_type}, Code: RejectionCode(err), Reason: err.Error()}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// transitionTestData runs the batch of input_data on a copy of its previous state and also returns the
+// post-state collections.
+func transitionTestData(input_data InputData, options *TransitionOptions) (map[string]map[string]string, map[string]uint64, []map[string]interface{}, error) {
+	currencies := []string{}
+	for _, c := range input_data.MetaData["currencies"].([]interface{}) {
+		currencies = append(currencies, c.(string))
+	}
+	user_nonce_tracker := map[string]uint64{}
+	for k, v := range input_data.MetaData["old_users_nonce"].(map[string]interface{}) {
+		user_nonce_tracker[k] = uint64(v.(float64))
+	}
+	nft_collections := append(append([]map[string]interface{}{}, input_data.OldNftCollections...), input_data.NewNftCollections...)
+	new_balances, _, _, _, err := TransitionStateWithOptions(CopyMap(input_data.OldUserBalances), input_data.Transactions, currencies, nft_collections, input_data.UserListerNonce, input_data.MetaData, user_nonce_tracker, options)
+	return new_balances, user_nonce_tracker, nft_collections, err
+}
+
+func TestTransitionStateSkipInvalid(t *testing.T) {
+	corrupt := func(input_data InputData) {
+		txs := input_data.Transactions
+		txs[13].(map[string]interface{})["Data"] = txs[14].(map[string]interface{})["Data"]
+		txs[28].(map[string]interface{})["BuySignature"] = txs[28].(map[string]interface{})["ListSignature"]
+	}
+	input_data, _, err := GetData("./test_data")
+	if err != nil {
+		t.Errorf("Error reading test data " + err.Error())
+		return
+	}
+	corrupt(input_data)
+	if _, _, _, err := transitionTestData(input_data, nil); err == nil {
+		t.Errorf("Expected the batch to fail without skip mode")
+	}
+
+	input_data, _, _ = GetData("./test_data")
+	corrupt(input_data)
+	options := &TransitionOptions{SkipInvalid: true, Trace: &ExecutionTrace{}}
+	balances, nonces, skipped_collections, err := transitionTestData(input_data, options)
+	if err != nil {
+		t.Errorf("Error in transition state " + err.Error())
+		return
+	}
+	numbers := []int{}
+	codes := []uint{}
+	for _, r := range options.Rejected {
+		numbers = append(numbers, r.Number)
+		codes = append(codes, r.Code)
+		if trace_entry := options.Trace.Entries[r.Number-1]; trace_entry.Rejected != r.Reason || len(trace_entry.BalanceChanges) != 0 || len(trace_entry.NftMoves) != 0 {
+			t.Errorf("Unexpected trace entry for rejected transaction %v", trace_entry)
+		}
+	}
+	// the trade of token 12 is rejected, so the buyer cannot transfer it on
+	if !reflect.DeepEqual(numbers, []int{14, 29, 30}) {
+		t.Errorf("Expected transactions 14, 29 and 30 rejected got %v", options.Rejected)
+	}
+	if !reflect.DeepEqual(codes, []uint{RejectSignature, RejectSignature, RejectNftOwnership}) {
+		t.Errorf("Unexpected rejection codes %v", codes)
+	}
+	skipped_lister_nonce := input_data.UserListerNonce
+	skipped_mint_counts := GetCollectionMintCounts(skipped_collections)
+
+	input_data, _, _ = GetData("./test_data")
+	kept := []interface{}{}
+	for i, tx := range input_data.Transactions {
+		if i != 13 && i != 28 && i != 29 {
+			kept = append(kept, tx)
+		}
+	}
+	input_data.Transactions = kept
+	expected_balances, expected_nonces, expected_collections, err := transitionTestData(input_data, nil)
+	if err != nil {
+		t.Errorf("Error in transition state " + err.Error())
+		return
+	}
+	if !NestedMapsEqual(balances, expected_balances) {
+		t.Errorf("Rejected transactions changed the balances %v", DiffBalances(expected_balances, balances, nil, input_data.MetaData, nil))
+	}
+	if !reflect.DeepEqual(nonces, expected_nonces) {
+		t.Errorf("Rejected transactions changed the nonces")
+	}
+	if !reflect.DeepEqual(skipped_lister_nonce, input_data.UserListerNonce) {
+		t.Errorf("Rejected transactions consumed lister nonces")
+	}
+	if !reflect.DeepEqual(skipped_mint_counts, GetCollectionMintCounts(expected_collections)) {
+		t.Errorf("Rejected transactions changed the mint counts")
+	}
+	if string(RejectedTransactionsHash(options.Rejected)) == string(RejectedTransactionsHash(options.Rejected[:2])) {
+		t.Errorf("Expected the rejected hash to commit to every entry")
+	}
+	reworded := append([]RejectedTransaction{}, options.Rejected...)
+	reworded[0].Reason = "reworded"
+	if string(RejectedTransactionsHash(options.Rejected)) != string(RejectedTransactionsHash(reworded)) {
+		t.Errorf("Expected the rejected hash to ignore the reason text")
+	}
+	reworded[0].Code = RejectNonce
+	if string(RejectedTransactionsHash(options.Rejected)) == string(RejectedTransactionsHash(reworded)) {
+		t.Errorf("Expected the rejected hash to commit to the code")
+	}
+
+	input_data, _, _ = GetData("./test_data")
+	input_data.Transactions[24].(map[string]interface{})["AmountOrNftTokenId"] = "1000000000000000000000"
+	options = &TransitionOptions{SkipInvalid: true}
+	if _, _, _, err := transitionTestData(input_data, options); err == nil {
+		t.Errorf("Expected a failing contract withdrawal to fail the batch in skip mode")
+	}
+}
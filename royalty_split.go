@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	solsha3 "github.com/miguelmota/go-solidity-sha3"
+)
+
+const TotalSplitBps = 10000
+
+// RoyaltySplit is one payee of a collection's royalty and mint revenue, in basis points.
+type RoyaltySplit struct {
+	Recipient string
+	Bps       *big.Int
+}
+
+// GetRoyaltySplits reads the optional RoyaltySplits list of {"Recipient", "Bps"} entries from the collection
+// data. The basis points must add up to TotalSplitBps. It returns nil when no split is configured.
+func GetRoyaltySplits(collection map[string]interface{}) ([]RoyaltySplit, error) {
+	split_data, _ := collection["RoyaltySplits"].([]interface{})
+	if len(split_data) == 0 {
+		return nil, nil
+	}
+	splits := []RoyaltySplit{}
+	seen := make(map[string]bool)
+	total := big.NewInt(0)
+	for i, s := range split_data {
+		entry, ok := s.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("nft collection royalty split %d is not valid", i)
+		}
+		recipient, _ := entry["Recipient"].(string)
+		if !common.IsHexAddress(recipient) || seen[strings.ToLower(recipient)] {
+			return nil, fmt.Errorf("nft collection royalty split %d recipient is not valid", i)
+		}
+		seen[strings.ToLower(recipient)] = true
+		bps, ok := new(big.Int).SetString(fmt.Sprint(entry["Bps"]), 10)
+		if !ok || bps.Sign() != 1 {
+			return nil, fmt.Errorf("nft collection royalty split %d bps is not valid", i)
+		}
+		total.Add(total, bps)
+		splits = append(splits, RoyaltySplit{Recipient: strings.ToLower(recipient), Bps: bps})
+	}
+	if total.Cmp(big.NewInt(TotalSplitBps)) != 0 {
+		return nil, fmt.Errorf("nft collection royalty splits add up to %s bps instead of %d", total.String(), TotalSplitBps)
+	}
+	return splits, nil
+}
+
+// RoyaltySplitsHash commits the splits, in their listed order, into the collection leaf and the owner's signed message.
+func RoyaltySplitsHash(splits []RoyaltySplit) []byte {
+	types := []string{}
+	values := []interface{}{}
+	for _, split := range splits {
+		types = append(types, "address", "uint256")
+		values = append(values, split.Recipient, split.Bps.String())
+	}
+	return solsha3.SoliditySHA3(types, values)
+}
+
+// SplitAmount divides amount by basis points, rounding every share down. The rounding remainder goes to the
+// first recipient so the shares always add up to amount.
+func SplitAmount(amount *big.Int, splits []RoyaltySplit) []*big.Int {
+	shares := make([]*big.Int, len(splits))
+	remainder := new(big.Int).Set(amount)
+	for i, split := range splits {
+		shares[i] = new(big.Int).Mul(amount, split.Bps)
+		shares[i].Div(shares[i], big.NewInt(TotalSplitBps))
+		remainder.Sub(remainder, shares[i])
+	}
+	if len(shares) > 0 {
+		shares[0].Add(shares[0], remainder)
+	}
+	return shares
+}
+
+// PayCollectionRevenue moves a royalty or mint fee from payer to the collection's split recipients, or to the
+// owner when no split is configured, and marks every paid recipient as updated. Recipients whose share rounds
+// down to zero are skipped so they get no balance entry.
+func PayCollectionRevenue(state_balances map[string]map[string]string, payer string, currency string, amount *big.Int, collection map[string]interface{}, users_updated_map map[string]bool, trace *ExecutionTrace, kind string) (map[string]map[string]string, error) {
+	if collection == nil {
+		return state_balances, fmt.Errorf("nft collection not found")
+	}
+	splits, err := GetRoyaltySplits(collection)
+	if err != nil {
+		return state_balances, err
+	}
+	if splits == nil {
+		owner := collection["Owner"].(string)
+		users_updated_map[owner] = true
+		state_balances, err = DeductFees(state_balances, payer, currency, amount, owner)
+		if err != nil {
+			return state_balances, err
+		}
+		trace.Transfer(payer, owner, currency, amount, kind)
+		return state_balances, nil
+	}
+	for i, share := range SplitAmount(amount, splits) {
+		if share.Sign() == 0 {
+			continue
+		}
+		users_updated_map[splits[i].Recipient] = true
+		state_balances, err = DeductFees(state_balances, payer, currency, share, splits[i].Recipient)
+		if err != nil {
+			return state_balances, err
+		}
+		trace.Transfer(payer, splits[i].Recipient, currency, share, kind)
+	}
+	return state_balances, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestGetRoyaltySplits(t *testing.T) {
+	splits, err := GetRoyaltySplits(map[string]interface{}{"Owner": testNumeUser})
+	if splits != nil || err != nil {
+		t.Errorf("Expected no royalty splits got %v %v", splits, err)
+	}
+	invalid := [][]interface{}{
+		{map[string]interface{}{"Recipient": testNumeUser, "Bps": "9999"}},
+		{map[string]interface{}{"Recipient": "0x1234", "Bps": "10000"}},
+		{map[string]interface{}{"Recipient": testNumeUser, "Bps": "0"}, map[string]interface{}{"Recipient": testNftContract, "Bps": "10000"}},
+		{map[string]interface{}{"Recipient": testNumeUser, "Bps": "5000"}, map[string]interface{}{"Recipient": testNumeUser, "Bps": "5000"}},
+	}
+	for i, split_data := range invalid {
+		if _, err := GetRoyaltySplits(map[string]interface{}{"RoyaltySplits": split_data}); err == nil {
+			t.Errorf("Test %d: expected error for invalid royalty splits", i)
+		}
+	}
+}
+
+func TestSplitAmount(t *testing.T) {
+	splits := []RoyaltySplit{
+		{Recipient: "0xa", Bps: big.NewInt(3333)},
+		{Recipient: "0xb", Bps: big.NewInt(3333)},
+		{Recipient: "0xc", Bps: big.NewInt(3334)},
+	}
+	tests := []struct {
+		amount   int64
+		expected []string
+	}{
+		{10000, []string{"3333", "3333", "3334"}},
+		{100, []string{"34", "33", "33"}},
+		{1, []string{"1", "0", "0"}},
+		{0, []string{"0", "0", "0"}},
+	}
+	for _, test := range tests {
+		shares := SplitAmount(big.NewInt(test.amount), splits)
+		for i := range shares {
+			if shares[i].String() != test.expected[i] {
+				t.Errorf("SplitAmount(%d) = %v, want %v", test.amount, shares, test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestTransitionStateRoyaltySplits(t *testing.T) {
+	buyer, buyer_address := newTestAccount()
+	seller, seller_address := newTestAccount()
+	_, owner_address := newTestAccount()
+	_, first_payee := newTestAccount()
+	_, second_payee := newTestAccount()
+	state_balances := map[string]map[string]string{
+		buyer_address:  {testFeeCurrency: "1000000000000000000", testTradeCurrency: "1000"},
+		seller_address: {testNftContract + "-1": "yes"},
+	}
+	nft_collections := []map[string]interface{}{{
+		"ContractAddress":      testNftContract,
+		"Owner":                owner_address,
+		"RoyaltyFeesPercetage": "10",
+		"RoyaltySplits": []interface{}{
+			map[string]interface{}{"Recipient": first_payee, "Bps": "7000"},
+			map[string]interface{}{"Recipient": second_payee, "Bps": "3000"},
+		},
+	}}
+	transactions := []interface{}{newCollectionOfferFill(seller, seller_address, buyer, buyer_address, "1", 1)}
+	new_balances, _, users_updated_map, _, err := TransitionState(state_balances, transactions, []string{}, nft_collections, map[string]*NonceSet{}, newTestMetaData(), map[string]uint64{})
+	if err != nil {
+		t.Errorf("Error in transition state " + err.Error())
+		return
+	}
+	if new_balances[first_payee][testTradeCurrency] != "7" || new_balances[second_payee][testTradeCurrency] != "3" {
+		t.Errorf("Unexpected royalty split %v %v", new_balances[first_payee], new_balances[second_payee])
+	}
+	if _, ok := new_balances[owner_address]; ok {
+		t.Errorf("Owner should not receive royalties when splits are set")
+	}
+	if !users_updated_map[first_payee] || !users_updated_map[second_payee] {
+		t.Errorf("Expected royalty recipients to be marked as updated")
+	}
+}
+
+func TestPayCollectionRevenueSkipsZeroShares(t *testing.T) {
+	_, payer := newTestAccount()
+	_, first_payee := newTestAccount()
+	_, second_payee := newTestAccount()
+	state_balances := map[string]map[string]string{payer: {testTradeCurrency: "1"}}
+	collection := map[string]interface{}{
+		"ContractAddress": testNftContract,
+		"RoyaltySplits": []interface{}{
+			map[string]interface{}{"Recipient": first_payee, "Bps": "7000"},
+			map[string]interface{}{"Recipient": second_payee, "Bps": "3000"},
+		},
+	}
+	users_updated_map := map[string]bool{}
+	new_balances, err := PayCollectionRevenue(state_balances, payer, testTradeCurrency, big.NewInt(1), collection, users_updated_map, nil, "royalty")
+	if err != nil {
+		t.Errorf("Error paying collection revenue " + err.Error())
+		return
+	}
+	if new_balances[first_payee][testTradeCurrency] != "1" {
+		t.Errorf("Expected the first recipient to receive the whole amount got %v", new_balances[first_payee])
+	}
+	if _, ok := new_balances[second_payee]; ok || users_updated_map[second_payee] {
+		t.Errorf("Expected a zero share recipient to be skipped")
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SettlementMessageWords is the number of 32 byte slots of an encoded SettlementMessage. Every field has a fixed
+// slot, so the message is the ABI encoding of a static tuple and the verifier can abi.decode it.
+const SettlementMessageWords = 17
+
+// Presence bits of the Flags slot, in the order the sections used to be appended.
+const (
+	FlagDeposit = 1 << iota
+	FlagContractWithdrawal
+	FlagNftDeposit
+	FlagNftContractWithdrawal
+	FlagWithdrawal
+	FlagRejectedTransactions
+)
+
+// SettlementMessage is the message signed by the validators. The slots of a section whose Has flag is unset
+// must be zero.
+type SettlementMessage struct {
+	PrevRoot                 common.Hash `json:"prevRoot"`
+	NewRoot                  common.Hash `json:"newRoot"`
+	PublicDataHash           common.Hash `json:"publicDataHash"`
+	BlockNumber              uint64      `json:"blockNumber"`
+	PrevCollectionRoot       common.Hash `json:"prevCollectionRoot"`
+	NewCollectionRoot        common.Hash `json:"newCollectionRoot"`
+	HasDeposit               bool        `json:"hasDeposit"`
+	HasContractWithdrawal    bool        `json:"hasContractWithdrawal"`
+	HasNftDeposit            bool        `json:"hasNftDeposit"`
+	HasNftContractWithdrawal bool        `json:"hasNftContractWithdrawal"`
+	HasWithdrawal            bool        `json:"hasWithdrawal"`
+	HasRejectedTransactions  bool        `json:"hasRejectedTransactions"`
+	QueueIndex               uint64      `json:"queueIndex"`
+	QueueHash                common.Hash `json:"queueHash"`
+	CWQueueIndex             uint64      `json:"cwQueueIndex"`
+	CWQueueHash              common.Hash `json:"cwQueueHash"`
+	NftQueueIndex            uint64      `json:"nftQueueIndex"`
+	NftQueueHash             common.Hash `json:"nftQueueHash"`
+	NftCWQueueIndex          uint64      `json:"nftCwQueueIndex"`
+	NftCWQueueHash           common.Hash `json:"nftCwQueueHash"`
+	WithdrawalHash           common.Hash `json:"withdrawalHash"`
+	RejectedTransactionsHash common.Hash `json:"rejectedTransactionsHash"`
+}
+
+func (message SettlementMessage) Flags() uint64 {
+	flags := uint64(0)
+	for bit, set := range []bool{message.HasDeposit, message.HasContractWithdrawal, message.HasNftDeposit, message.HasNftContractWithdrawal, message.HasWithdrawal, message.HasRejectedTransactions} {
+		if set {
+			flags |= 1 << bit
+		}
+	}
+	return flags
+}
+
+func uintWord(n uint64) common.Hash {
+	return common.BigToHash(new(big.Int).SetUint64(n))
+}
+
+// words lists the slots in encoding order: the six header fields, the flags and then each section.
+func (message SettlementMessage) words() []common.Hash {
+	return []common.Hash{
+		message.PrevRoot,
+		message.NewRoot,
+		message.PublicDataHash,
+		uintWord(message.BlockNumber),
+		message.PrevCollectionRoot,
+		message.NewCollectionRoot,
+		uintWord(message.Flags()),
+		uintWord(message.QueueIndex),
+		message.QueueHash,
+		uintWord(message.CWQueueIndex),
+		message.CWQueueHash,
+		uintWord(message.NftQueueIndex),
+		message.NftQueueHash,
+		uintWord(message.NftCWQueueIndex),
+		message.NftCWQueueHash,
+		message.WithdrawalHash,
+		message.RejectedTransactionsHash,
+	}
+}
+
+// Encode returns the hex message passed to SignMessage.
+func (message SettlementMessage) Encode() string {
+	encoded := ""
+	for _, word := range message.words() {
+		encoded += hex.EncodeToString(word.Bytes())
+	}
+	return encoded
+}
+
+func wordToUint(word common.Hash, name string) (uint64, error) {
+	n := word.Big()
+	if !n.IsUint64() {
+		return 0, fmt.Errorf("settlement message %s out of range", name)
+	}
+	return n.Uint64(), nil
+}
+
+// DecodeSettlementMessage parses a message produced by Encode, with or without 0x, and rejects unknown flags
+// and data in the slots of absent sections.
+func DecodeSettlementMessage(encoded string) (SettlementMessage, error) {
+	var message SettlementMessage
+	data, err := hex.DecodeString(strings.TrimPrefix(encoded, "0x"))
+	if err != nil {
+		return message, err
+	}
+	if len(data) != SettlementMessageWords*32 {
+		return message, fmt.Errorf("settlement message is %d bytes instead of %d", len(data), SettlementMessageWords*32)
+	}
+	words := make([]common.Hash, SettlementMessageWords)
+	for i := range words {
+		words[i] = common.BytesToHash(data[i*32 : (i+1)*32])
+	}
+	flags, err := wordToUint(words[6], "flags")
+	if err != nil {
+		return message, err
+	}
+	if flags >= FlagRejectedTransactions<<1 {
+		return message, fmt.Errorf("settlement message has unknown flags %b", flags)
+	}
+	message = SettlementMessage{
+		PrevRoot:                 words[0],
+		NewRoot:                  words[1],
+		PublicDataHash:           words[2],
+		PrevCollectionRoot:       words[4],
+		NewCollectionRoot:        words[5],
+		QueueHash:                words[8],
+		CWQueueHash:              words[10],
+		NftQueueHash:             words[12],
+		NftCWQueueHash:           words[14],
+		WithdrawalHash:           words[15],
+		RejectedTransactionsHash: words[16],
+		HasDeposit:               flags&FlagDeposit != 0,
+		HasContractWithdrawal:    flags&FlagContractWithdrawal != 0,
+		HasNftDeposit:            flags&FlagNftDeposit != 0,
+		HasNftContractWithdrawal: flags&FlagNftContractWithdrawal != 0,
+		HasWithdrawal:            flags&FlagWithdrawal != 0,
+		HasRejectedTransactions:  flags&FlagRejectedTransactions != 0,
+	}
+	numbers := []struct {
+		slot   int
+		target *uint64
+	}{
+		{3, &message.BlockNumber},
+		{7, &message.QueueIndex},
+		{9, &message.CWQueueIndex},
+		{11, &message.NftQueueIndex},
+		{13, &message.NftCWQueueIndex},
+	}
+	for _, number := range numbers {
+		*number.target, err = wordToUint(words[number.slot], fmt.Sprintf("slot %d", number.slot))
+		if err != nil {
+			return message, err
+		}
+	}
+	sections := []struct {
+		present bool
+		slots   []int
+	}{
+		{message.HasDeposit, []int{7, 8}},
+		{message.HasContractWithdrawal, []int{9, 10}},
+		{message.HasNftDeposit, []int{11, 12}},
+		{message.HasNftContractWithdrawal, []int{13, 14}},
+		{message.HasWithdrawal, []int{15}},
+		{message.HasRejectedTransactions, []int{16}},
+	}
+	for _, section := range sections {
+		for _, slot := range section.slots {
+			if !section.present && words[slot] != (common.Hash{}) {
+				return message, fmt.Errorf("settlement message slot %d is set for an absent section", slot)
+			}
+		}
+	}
+	return message, nil
+}
+
+// Settlement is a batch executed by ExecuteBatch together with the message the validators sign and the queue
+// and withdrawal lists reported next to it. The list fields are named after the SettlementRequest fields they fill.
+type Settlement struct {
+	Execution                            BatchExecution
+	Message                              SettlementMessage
+	PublicData                           []byte
+	QueueHash                            []byte
+	QueueIndex                           int
+	NftQueueHash                         []byte
+	NftQueueIndex                        int
+	WithdrawalHash                       []byte
+	WithdrawalAmountOrTokenId            []string
+	WithdrawalAddresses                  []string
+	WithdrawalCurrencyOrNftContract      []string
+	WithdrawalL2Minted                   []bool
+	WithdrawalType                       []int
+	ContractWithdrawalAddresses          []string
+	ContractWithdrawalQueueIndex         int
+	ContractWithdrawalAmounts            []string
+	ContractWithdrawalTokens             []string
+	NftContractWithdrawalAddresses       []string
+	NftContractWithdrawalQueueIndex      int
+	NftContractWithdrawalTokensIds       []string
+	NftContractWithdrawalContractAddress []string
+	NftContractWithdrawalL2Minted        []bool
+	RejectedTransactionsHash             []byte
+}
+
+// BuildSettlement executes the batch of input_data and derives the message the validators sign. main, the
+// cosign nodes and the test vectors all build their message here, so every node settling the same inputs
+// arrives at the same message. A section is present when the batch processed a transaction of its type.
+func BuildSettlement(input_data InputData, options *TransitionOptions) (Settlement, error) {
+	settlement := Settlement{
+		WithdrawalAmountOrTokenId:            []string{},
+		WithdrawalAddresses:                  []string{},
+		WithdrawalCurrencyOrNftContract:      []string{},
+		WithdrawalL2Minted:                   []bool{},
+		WithdrawalType:                       []int{},
+		ContractWithdrawalAddresses:          []string{},
+		ContractWithdrawalAmounts:            []string{},
+		ContractWithdrawalTokens:             []string{},
+		NftContractWithdrawalAddresses:       []string{},
+		NftContractWithdrawalTokensIds:       []string{},
+		NftContractWithdrawalContractAddress: []string{},
+		NftContractWithdrawalL2Minted:        []bool{},
+	}
+	var err error
+	settlement.Execution, err = ExecuteBatch(input_data, options)
+	if err != nil {
+		return settlement, err
+	}
+	result := settlement.Execution.Result
+	settlement.PublicData, err = GetPublicData(input_data.Transactions, result.Rejected)
+	if err != nil {
+		return settlement, err
+	}
+	block_number, _ := input_data.MetaData["block_number"].(float64)
+	message := SettlementMessage{
+		PrevRoot:           common.HexToHash(result.PrevRoot),
+		NewRoot:            common.HexToHash(result.Root),
+		PublicDataHash:     common.BytesToHash(PublicDataHash(settlement.PublicData)),
+		BlockNumber:        uint64(block_number),
+		PrevCollectionRoot: common.HexToHash(result.PrevNftRoot),
+		NewCollectionRoot:  common.HexToHash(result.NftRoot),
+	}
+	last_handled := func(key string) (int, error) {
+		value, _ := input_data.MetaData[key].(string)
+		index, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("error in %s", key)
+		}
+		return index, nil
+	}
+
+	has_process := settlement.Execution.HasProcess
+	queue_transactions := GetQueueTransactions(input_data.Transactions, result.Rejected)
+	var ok bool
+	if has_process.HasDeposit {
+		index, err := last_handled("last_handled_queue_index")
+		if err != nil {
+			return settlement, err
+		}
+		var queue_len int
+		settlement.QueueHash, queue_len, ok = QueueHash(queue_transactions, "deposit")
+		if !ok {
+			return settlement, fmt.Errorf("error in getting queue hash")
+		}
+		settlement.QueueIndex = index + queue_len
+		message.HasDeposit = true
+		message.QueueIndex = uint64(settlement.QueueIndex)
+		message.QueueHash = common.BytesToHash(settlement.QueueHash)
+	}
+	if has_process.HasContractWithdrawal {
+		index, err := last_handled("last_handled_cw_queue_index")
+		if err != nil {
+			return settlement, err
+		}
+		var cw_queue_hash []byte
+		var cw_queue_len int
+		cw_queue_hash, cw_queue_len, settlement.ContractWithdrawalAddresses, settlement.ContractWithdrawalAmounts, settlement.ContractWithdrawalTokens, ok = WithdrawalQueueHash(queue_transactions)
+		if !ok {
+			return settlement, fmt.Errorf("error in getting cw queue hash")
+		}
+		settlement.ContractWithdrawalQueueIndex = index + cw_queue_len
+		message.HasContractWithdrawal = true
+		message.CWQueueIndex = uint64(settlement.ContractWithdrawalQueueIndex)
+		message.CWQueueHash = common.BytesToHash(cw_queue_hash)
+	}
+	if has_process.HasNFTDeposit {
+		index, err := last_handled("last_handled_nft_queue_index")
+		if err != nil {
+			return settlement, err
+		}
+		var nft_queue_len int
+		settlement.NftQueueHash, nft_queue_len, ok = QueueHash(queue_transactions, "nft_deposit")
+		if !ok {
+			return settlement, fmt.Errorf("error in getting queue hash")
+		}
+		settlement.NftQueueIndex = index + nft_queue_len
+		message.HasNftDeposit = true
+		message.NftQueueIndex = uint64(settlement.NftQueueIndex)
+		message.NftQueueHash = common.BytesToHash(settlement.NftQueueHash)
+	}
+	if has_process.HasNFTContractWithdrawal {
+		index, err := last_handled("last_handled_nft_cw_queue_index")
+		if err != nil {
+			return settlement, err
+		}
+		var nft_cw_queue_hash []byte
+		var nft_cw_queue_len int
+		nft_cw_queue_hash, nft_cw_queue_len, settlement.NftContractWithdrawalAddresses, settlement.NftContractWithdrawalTokensIds, settlement.NftContractWithdrawalContractAddress, settlement.NftContractWithdrawalL2Minted, ok = NftWithdrawalQueueHash(queue_transactions)
+		if !ok {
+			return settlement, fmt.Errorf("error in getting cw queue hash")
+		}
+		settlement.NftContractWithdrawalQueueIndex = index + nft_cw_queue_len
+		message.HasNftContractWithdrawal = true
+		message.NftCWQueueIndex = uint64(settlement.NftContractWithdrawalQueueIndex)
+		message.NftCWQueueHash = common.BytesToHash(nft_cw_queue_hash)
+	}
+	if has_process.HasWithdrawal {
+		settlement.WithdrawalHash, settlement.WithdrawalAmountOrTokenId, settlement.WithdrawalL2Minted, settlement.WithdrawalAddresses, settlement.WithdrawalCurrencyOrNftContract, settlement.WithdrawalType, ok = WithdrawalHash(queue_transactions)
+		if !ok {
+			return settlement, fmt.Errorf("error in getting withdrawal_hash")
+		}
+		message.HasWithdrawal = true
+		message.WithdrawalHash = common.BytesToHash(settlement.WithdrawalHash)
+	}
+	if options.GetSkipInvalid() {
+		settlement.RejectedTransactionsHash = RejectedTransactionsHash(result.Rejected)
+		message.HasRejectedTransactions = true
+		message.RejectedTransactionsHash = common.BytesToHash(settlement.RejectedTransactionsHash)
+	}
+	settlement.Message = message
+	return settlement, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// The vectors are shared with the Solidity verifier, which must abi.decode each encoded message into the
+// listed fields.
+func TestSettlementMessageVectors(t *testing.T) {
+	file, err := os.ReadFile("test_data/settlement_message_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var suite struct {
+		Version int `json:"version"`
+		Vectors []struct {
+			Name    string            `json:"name"`
+			Message SettlementMessage `json:"message"`
+			Encoded string            `json:"encoded"`
+		} `json:"vectors"`
+	}
+	if err := json.Unmarshal(file, &suite); err != nil {
+		t.Fatal(err)
+	}
+	if suite.Version != 1 || len(suite.Vectors) == 0 {
+		t.Fatalf("unexpected vector suite version %d with %d vectors", suite.Version, len(suite.Vectors))
+	}
+	for _, vector := range suite.Vectors {
+		encoded := vector.Message.Encode()
+		if "0x"+encoded != vector.Encoded {
+			t.Errorf("%s: encoded %s, expected %s", vector.Name, encoded, vector.Encoded)
+		}
+		if len(encoded) != SettlementMessageWords*64 {
+			t.Errorf("%s: encoded length %d", vector.Name, len(encoded))
+		}
+		decoded, err := DecodeSettlementMessage(vector.Encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", vector.Name, err)
+		}
+		if decoded != vector.Message {
+			t.Errorf("%s: decoded %+v, expected %+v", vector.Name, decoded, vector.Message)
+		}
+	}
+}
+
+func TestDecodeSettlementMessageErrors(t *testing.T) {
+	message := SettlementMessage{
+		PrevRoot:       common.HexToHash("0x01"),
+		NewRoot:        common.HexToHash("0x02"),
+		BlockNumber:    5,
+		HasWithdrawal:  true,
+		WithdrawalHash: common.HexToHash("0x03"),
+	}
+	encoded := message.Encode()
+	word := func(slot int, value string) string {
+		return encoded[:slot*64] + value + encoded[(slot+1)*64:]
+	}
+	cases := []struct {
+		name    string
+		encoded string
+		err     string
+	}{
+		{"short", encoded[:len(encoded)-64], "bytes instead of"},
+		{"not hex", "zz" + encoded[2:], "invalid byte"},
+		{"unknown flag", word(6, strings.Repeat("0", 62)+"40"), "unknown flags"},
+		{"absent section set", word(8, strings.Repeat("0", 63)+"1"), "absent section"},
+		{"absent queue index set", word(7, strings.Repeat("0", 63)+"1"), "absent section"},
+		{"block number overflow", word(3, "01"+strings.Repeat("0", 62)), "out of range"},
+	}
+	for _, c := range cases {
+		_, err := DecodeSettlementMessage(c.encoded)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected error containing %q, got %v", c.name, c.err, err)
+		}
+	}
+	if _, err := DecodeSettlementMessage(word(15, strings.Repeat("0", 64))); err != nil {
+		t.Errorf("zero hash of a present section should decode, got %v", err)
+	}
+}
+
+func TestBuildSettlementSections(t *testing.T) {
+	input_data, _, err := GetData("./test_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settlement, err := BuildSettlement(input_data, NewTransitionOptions(input_data.MetaData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	has_process := settlement.Execution.HasProcess
+	message := settlement.Message
+	if message.HasDeposit != has_process.HasDeposit || message.HasContractWithdrawal != has_process.HasContractWithdrawal || message.HasNftDeposit != has_process.HasNFTDeposit || message.HasNftContractWithdrawal != has_process.HasNFTContractWithdrawal || message.HasWithdrawal != has_process.HasWithdrawal {
+		t.Errorf("message sections %+v do not follow the processed transactions %+v", message, has_process)
+	}
+	if message.NewRoot != common.HexToHash(settlement.Execution.Result.Root) || message.PublicDataHash != common.BytesToHash(PublicDataHash(settlement.PublicData)) {
+		t.Errorf("message does not commit the executed batch")
+	}
+	if message.HasDeposit && message.QueueIndex != uint64(settlement.QueueIndex) {
+		t.Errorf("queue index %d, reported %d", message.QueueIndex, settlement.QueueIndex)
+	}
+}
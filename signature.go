@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,6 +18,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -24,19 +26,36 @@ import (
 	solsha3 "github.com/miguelmota/go-solidity-sha3"
 )
 
-func DecryptKeys(data map[string]ValidatorKeys, kms_client *kms.KMS) ([]string, []uint, []uint, error) {
+// OrderedValidators is the validator set sorted by the keys of validators.json, the hashed public keys. Signer
+// indexes and the signer bitmap are positions in this order, so the contract must register the validators in
+// the same order for a bitmap to select the right keys.
+func OrderedValidators(data map[string]ValidatorKeys) []string {
+	validators := make([]string, 0, len(data))
+	for k := range data {
+		validators = append(validators, k)
+	}
+	sort.Strings(validators)
+	return validators
+}
 
-	keys := make([]string, 0)
-	failed_to_decrypt := make([]uint, 0)
-	successfully_decrypted := make([]uint, 0)
+// DecryptKeys decrypts the validator keys that KMS releases. It returns the keys in validator order along with
+// the indexes of the validators that failed and of those that succeeded, which are the signers.
+func DecryptKeys(data map[string]ValidatorKeys, kms_client kmsiface.KMSAPI) ([]string, []uint, []uint, error) {
+	validators := OrderedValidators(data)
+	decrypted := make([]string, len(validators))
+	failed := make([]bool, len(validators))
+	decode_errs := make([]error, len(validators))
 	var global_err error
 	var wg sync.WaitGroup
-	for _, v := range data {
+	for i, k := range validators {
 		wg.Add(1)
-		go func(v ValidatorKeys) {
+		go func(i int, v ValidatorKeys) {
+			defer wg.Done()
 			b, err := base64.StdEncoding.DecodeString(v.EncryptedPrivateKey)
 			if err != nil {
-				global_err = err
+				decode_errs[i] = err
+				failed[i] = true
+				return
 			}
 			input := &kms.DecryptInput{
 				CiphertextBlob: b,
@@ -47,25 +66,61 @@ func DecryptKeys(data map[string]ValidatorKeys, kms_client *kms.KMS) ([]string,
 			result, err := kms_client.Decrypt(input)
 			if err != nil {
 				fmt.Println(err, v.CMKId)
-				// if user_status[k] {
-				// 	failed_to_decrypt = append(failed_to_decrypt, k)
-				// }
-			} else {
-				// if !user_status[k] {
-				// 	successfully_decrypted = append(successfully_decrypted, k)
-				// }
-				keys = append(keys, string(result.Plaintext))
+				failed[i] = true
+				return
 			}
-			wg.Done()
-		}(v)
+			decrypted[i] = string(result.Plaintext)
+		}(i, data[k])
 	}
 	wg.Wait()
+
+	keys := make([]string, 0)
+	failed_to_decrypt := make([]uint, 0)
+	successfully_decrypted := make([]uint, 0)
+	for i := range validators {
+		if decode_errs[i] != nil && global_err == nil {
+			global_err = decode_errs[i]
+		}
+		if failed[i] {
+			failed_to_decrypt = append(failed_to_decrypt, uint(i))
+			continue
+		}
+		keys = append(keys, decrypted[i])
+		successfully_decrypted = append(successfully_decrypted, uint(i))
+	}
 	if global_err != nil {
 		return keys, failed_to_decrypt, successfully_decrypted, global_err
 	}
 	return keys, failed_to_decrypt, successfully_decrypted, nil
 }
 
+// SigningThreshold is the number of validators that must sign a settlement, the signing_threshold of meta_data
+// or a majority of the validators when it is not set.
+func SigningThreshold(meta_data map[string]interface{}, num_validators int) (int, error) {
+	threshold := num_validators/2 + 1
+	if value, ok := meta_data["signing_threshold"].(string); ok {
+		t, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("error in signing_threshold")
+		}
+		threshold = t
+	}
+	if threshold < 1 || threshold > num_validators {
+		return 0, fmt.Errorf("signing threshold %d is not between 1 and the %d validators", threshold, num_validators)
+	}
+	return threshold, nil
+}
+
+// SignerBitmap sets bit i of a uint256 for each signer index i, so the contract can pick the public keys to
+// aggregate.
+func SignerBitmap(signers []uint) string {
+	bitmap := new(big.Int)
+	for _, i := range signers {
+		bitmap.SetBit(bitmap, int(i), 1)
+	}
+	return fmt.Sprintf("0x%064x", bitmap)
+}
+
 func AggregateSignature(message string, keys []string) (string, []string, error) {
 	os := runtime.GOOS
 	app := "./bn256_aggregatesign_" + os
@@ -90,7 +145,9 @@ func AggregateSignature(message string, keys []string) (string, []string, error)
 	return strings.TrimSpace(strings.Split(subres, `"`)[1]), aggregated_public_key_components, err
 }
 
-func SignMessage(message string, user_keys map[string]ValidatorKeys) (string, []string, []uint, []uint, error) {
+// SignMessage signs message with every validator key KMS releases and fails when fewer than threshold are
+// available. It returns the indexes of the validators that failed and of the signers, see OrderedValidators.
+func SignMessage(message string, user_keys map[string]ValidatorKeys, threshold int) (string, []string, []uint, []uint, error) {
 
 	sess := session.Must(session.NewSession())
 	kms_client := kms.New(sess, aws.NewConfig().WithRegion("us-east-1"))
@@ -100,6 +157,9 @@ func SignMessage(message string, user_keys map[string]ValidatorKeys) (string, []
 	if err != nil {
 		return "", aggregated_public_key_components, failed_to_decrypt, successfully_decrypted, err
 	}
+	if len(keys) < threshold {
+		return "", aggregated_public_key_components, failed_to_decrypt, successfully_decrypted, fmt.Errorf("decrypted %d validator keys, below the signing threshold of %d", len(keys), threshold)
+	}
 	signature, aggregated_public_key_components, err := AggregateSignature(message, keys)
 	if err != nil {
 		return "", aggregated_public_key_components, failed_to_decrypt, successfully_decrypted, err
@@ -108,6 +168,20 @@ func SignMessage(message string, user_keys map[string]ValidatorKeys) (string, []
 
 }
 
+// DecryptValidatorKey decrypts the key of a single validator, for a node that signs only with its own key.
+func DecryptValidatorKey(validator string, validator_keys ValidatorKeys) (string, error) {
+	sess := session.Must(session.NewSession())
+	kms_client := kms.New(sess, aws.NewConfig().WithRegion("us-east-1"))
+	keys, _, _, err := DecryptKeys(map[string]ValidatorKeys{validator: validator_keys}, kms_client)
+	if err != nil {
+		return "", err
+	}
+	if len(keys) != 1 {
+		return "", fmt.Errorf("failed to decrypt the key of validator %s", validator)
+	}
+	return keys[0], nil
+}
+
 func RecoverPlain(sighash common.Hash, R, S, Vb *big.Int, homestead bool) (string, string, common.Address, error) {
 	signature := ""
 	pubkey := ""
@@ -153,19 +227,42 @@ func decodeTransactionInputData(abi *abi.ABI, data []byte) (map[string]interface
 	return inputsMap, method.Name, nil
 }
 
+// NativeCurrency is the sentinel address standing for the chain's native asset
+// (ETH) in the currency list, in balances and in queue/withdrawal hashes.
+const NativeCurrency = "0xEeeeeEeeeEeEeeEeEeEeeEEEeeeeEeeeeeeeEEeE"
+
+func IsNativeCurrency(currency string) bool {
+	return strings.EqualFold(currency, NativeCurrency)
+}
+
 func GetAmountAndTokenAddress(tx *types.Transaction, currencies []string) (string, string, string, error) {
 	amount := ""
 	token_address := ""
+	if tx.To() == nil {
+		return amount, token_address, "", errors.New("invalid recipient")
+	}
 	to := tx.To().Hex()
 	index := -1
+	native_supported := false
 	for i, currency := range currencies {
+		if IsNativeCurrency(currency) {
+			native_supported = true
+			continue
+		}
 		if strings.EqualFold(currency, to) {
 			index = i
 			break
 		}
 	}
 	if index == -1 {
-		return tx.Value().String(), currencies[index], tx.To().Hex(), nil
+		// not a listed token, so this can only be a plain value transfer
+		if !native_supported {
+			return amount, token_address, to, errors.New("unsupported currency " + to)
+		}
+		if len(tx.Data()) != 0 {
+			return amount, token_address, to, errors.New("invalid data")
+		}
+		return tx.Value().String(), NativeCurrency, to, nil
 	}
 	if tx.Data() == nil {
 		return amount, token_address, to, errors.New("invalid data")
@@ -307,6 +404,87 @@ func NftTradeMessage(user, nft_contract_address, nft_token_id, currency_address,
 	return hex.EncodeToString(hash)
 }
 
+// NftTradeMessageWithExpiry is NftTradeMessage with the unix time after which the order is no longer valid.
+func NftTradeMessageWithExpiry(user, nft_contract_address, nft_token_id, currency_address, amount, bn string, trade_type uint, expiry uint64) string {
+	hash := solsha3.SoliditySHA3(
+		[]string{"address", "address", "uint256", "address", "uint256", "uint256", "uint256", "uint256"},
+		[]interface{}{
+			user,
+			nft_contract_address,
+			nft_token_id,
+			currency_address,
+			amount,
+			bn,
+			new(big.Int).SetUint64(uint64(trade_type)),
+			new(big.Int).SetUint64(expiry),
+		},
+	)
+	return hex.EncodeToString(hash)
+}
+
+func CollectionOfferMessage(user, nft_contract_address, currency_address, amount, quantity, nonce string, expiry uint64) string {
+	hash := solsha3.SoliditySHA3(
+		[]string{"address", "address", "address", "uint256", "uint256", "uint256", "uint256"},
+		[]interface{}{
+			user,
+			nft_contract_address,
+			currency_address,
+			amount,
+			quantity,
+			nonce,
+			new(big.Int).SetUint64(expiry),
+		},
+	)
+	return hex.EncodeToString(hash)
+}
+
+// CancelListingMessage is signed by a lister to mark the given lister nonces, and every nonce below
+// below_nonce, as used. nonce is the lister's account nonce so the cancellation cannot be replayed.
+func CancelListingMessage(user string, nonce uint, lister_nonces []uint, below_nonce uint) string {
+	types := []string{"address", "uint256", "uint256"}
+	values := []interface{}{
+		user,
+		new(big.Int).SetUint64(uint64(nonce)),
+		new(big.Int).SetUint64(uint64(below_nonce)),
+	}
+	for _, n := range lister_nonces {
+		types = append(types, "uint256")
+		values = append(values, new(big.Int).SetUint64(uint64(n)))
+	}
+	return hex.EncodeToString(solsha3.SoliditySHA3(types, values))
+}
+
+// CollectionUpdateMessage is signed by the collection owner to replace the base URI, royalty percentage and mint fee.
+func CollectionUpdateMessage(owner, nft_contract_address, base_uri, royalty_percentage, mint_fees, mint_fees_token string, nonce uint) string {
+	hash := solsha3.SoliditySHA3(
+		[]string{"address", "address", "bytes32", "uint256", "uint256", "address", "uint256"},
+		[]interface{}{
+			owner,
+			nft_contract_address,
+			solsha3.SoliditySHA3([]string{"string"}, []interface{}{base_uri}),
+			royalty_percentage,
+			mint_fees,
+			mint_fees_token,
+			new(big.Int).SetUint64(uint64(nonce)),
+		},
+	)
+	return hex.EncodeToString(hash)
+}
+
+// CollectionTransferMessage is signed by the collection owner to hand the collection to new_owner.
+func CollectionTransferMessage(owner, nft_contract_address, new_owner string, nonce uint) string {
+	hash := solsha3.SoliditySHA3(
+		[]string{"address", "address", "address", "uint256"},
+		[]interface{}{
+			owner,
+			nft_contract_address,
+			new_owner,
+			new(big.Int).SetUint64(uint64(nonce)),
+		},
+	)
+	return hex.EncodeToString(hash)
+}
+
 func EthVerify(message string, sig string, pubkey string) bool {
 	msg_bytes := []byte(message)
 	fullMessage := fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(msg_bytes), msg_bytes)
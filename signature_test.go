@@ -1,12 +1,20 @@
 package main
 
 import (
+	"encoding/base64"
+	"errors"
+	"math/big"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 )
 
 func skipCI(t *testing.T) {
@@ -89,7 +97,7 @@ func TestSignMessage(t *testing.T) {
 		EncryptedPrivateKey: "AQICAHh2fn5fQzf0pR+JWPGR8yLKZjEywJ8b8umBI9kzCAFVdAGN9n0CV+9w2tjYAqrVQWhcAAAAojCBnwYJKoZIhvcNAQcGoIGRMIGOAgEAMIGIBgkqhkiG9w0BBwEwHgYJYIZIAWUDBAEuMBEEDItcDL4lPiDkr7spewIBEIBbRb6Pltakos+qO7Ocpv0aiXT4GqF/8kMqm4pTFXMVO698rjL1u7PrudG09yiXvTVR3n/4hQrQf+LoGBi4CXTlc80z/f3OXTAB5tJCwNhOLAPgKZmo5X9MAT759A==",
 		CMKId:               "c53fe209-f0a7-42d2-baec-9d8f286f5ce1",
 	}
-	signature, _, _, _, err := SignMessage("10afdfd0a74398e23708f64b1ebdc41a78d85eebcb3b3d5fc7a9dd411f8f852d", user_keys)
+	signature, _, _, _, err := SignMessage("10afdfd0a74398e23708f64b1ebdc41a78d85eebcb3b3d5fc7a9dd411f8f852d", user_keys, 1)
 	if err != nil {
 		t.Errorf("Error signing message" + err.Error())
 		return
@@ -119,3 +127,107 @@ func TestEthVerify(t *testing.T) {
 		return
 	}
 }
+
+func TestGetAmountAndTokenAddressNative(t *testing.T) {
+	to := common.HexToAddress("0xCcFf350Ef46B85228d6650a802107e58BF6A32Ab")
+	tx := types.NewTx(&types.DynamicFeeTx{
+		ChainID: big.NewInt(710),
+		Nonce:   1,
+		To:      &to,
+		Value:   big.NewInt(1000000000000000000),
+	})
+	amount, currency, receiver, err := GetAmountAndTokenAddress(tx, []string{"0xEe146Fac7b2fce5FdBE31C36d89cF92f6b006F80", NativeCurrency})
+	if err != nil {
+		t.Errorf("Error getting amount " + err.Error())
+		return
+	}
+	if amount != "1000000000000000000" {
+		t.Errorf("Expected 1000000000000000000, got %s", amount)
+	}
+	if currency != NativeCurrency {
+		t.Errorf("Expected %s, got %s", NativeCurrency, currency)
+	}
+	if receiver != to.Hex() {
+		t.Errorf("Expected %s, got %s", to.Hex(), receiver)
+	}
+	_, _, _, err = GetAmountAndTokenAddress(tx, []string{"0xEe146Fac7b2fce5FdBE31C36d89cF92f6b006F80"})
+	if err == nil {
+		t.Errorf("Expected error for unlisted native currency")
+	}
+}
+
+func TestCollectionOfferMessage(t *testing.T) {
+	msg := CollectionOfferMessage("0xCcFf350Ef46B85228d6650a802107e58BF6A32Ab", "0x5FbDB2315678afecb367f032d93F642f64180aa3", "0x5FbDB2315678afecb367f032d93F642f64180aa3", "100", "2", "1", 1700000000)
+	if msg != "81a0d28ba295f59de6b1a65eb78a8bf563c06928b83d23727229cd9067e9a160" {
+		t.Errorf("Expected 81a0d28ba295f59de6b1a65eb78a8bf563c06928b83d23727229cd9067e9a160, got %s", msg)
+		return
+	}
+}
+
+func TestNftTradeMessageWithExpiry(t *testing.T) {
+	msg := NftTradeMessageWithExpiry("0xCcFf350Ef46B85228d6650a802107e58BF6A32Ab", "0x5FbDB2315678afecb367f032d93F642f64180aa3", "1", "0x5FbDB2315678afecb367f032d93F642f64180aa3", "1", "1", 0, 1700000000)
+	if msg != "0678da1251dcc61ba471d6423f77388204fe0ff7291595d9eef88e506df9013f" {
+		t.Errorf("Expected 0678da1251dcc61ba471d6423f77388204fe0ff7291595d9eef88e506df9013f, got %s", msg)
+		return
+	}
+}
+
+// testKMS releases the plaintext of every ciphertext except the ones listed in fail.
+type testKMS struct {
+	kmsiface.KMSAPI
+	fail map[string]bool
+}
+
+func (k testKMS) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	if k.fail[string(input.CiphertextBlob)] {
+		return nil, errors.New("AccessDeniedException")
+	}
+	return &kms.DecryptOutput{Plaintext: append([]byte("key-"), input.CiphertextBlob...)}, nil
+}
+
+func TestDecryptKeysSigners(t *testing.T) {
+	user_keys := make(map[string]ValidatorKeys)
+	for _, v := range []string{"d", "b", "a", "c"} {
+		user_keys[v] = ValidatorKeys{EncryptedPrivateKey: base64.StdEncoding.EncodeToString([]byte(v))}
+	}
+	for i := 0; i < 20; i++ {
+		keys, failed_to_decrypt, signers, err := DecryptKeys(user_keys, testKMS{fail: map[string]bool{"b": true, "d": true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, []string{"key-a", "key-c"}) || !reflect.DeepEqual(signers, []uint{0, 2}) || !reflect.DeepEqual(failed_to_decrypt, []uint{1, 3}) {
+			t.Fatalf("unexpected keys %v signers %v failed %v", keys, signers, failed_to_decrypt)
+		}
+	}
+	if bitmap := SignerBitmap([]uint{0, 2}); bitmap != "0x"+strings.Repeat("0", 63)+"5" {
+		t.Errorf("unexpected signer bitmap %s", bitmap)
+	}
+	if bitmap := SignerBitmap([]uint{255}); bitmap != "0x8"+strings.Repeat("0", 63) {
+		t.Errorf("unexpected signer bitmap %s", bitmap)
+	}
+
+	user_keys["e"] = ValidatorKeys{EncryptedPrivateKey: "not base64"}
+	if _, failed_to_decrypt, _, err := DecryptKeys(user_keys, testKMS{}); err == nil || !reflect.DeepEqual(failed_to_decrypt, []uint{4}) {
+		t.Errorf("expected a corrupt key to fail validator 4, got %v %v", failed_to_decrypt, err)
+	}
+}
+
+func TestSigningThreshold(t *testing.T) {
+	cases := []struct {
+		meta_data map[string]interface{}
+		threshold int
+		err       bool
+	}{
+		{map[string]interface{}{}, 4, false},
+		{map[string]interface{}{"signing_threshold": "5"}, 5, false},
+		{map[string]interface{}{"signing_threshold": "0"}, 0, true},
+		{map[string]interface{}{"signing_threshold": "8"}, 0, true},
+		{map[string]interface{}{"signing_threshold": "two"}, 0, true},
+	}
+	for _, c := range cases {
+		threshold, err := SigningThreshold(c.meta_data, 7)
+		if (err != nil) != c.err || threshold != c.threshold {
+			t.Errorf("%v: got %d %v", c.meta_data, threshold, err)
+		}
+	}
+}
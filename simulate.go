@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	solsha3 "github.com/miguelmota/go-solidity-sha3"
+)
+
+// SimulationResult is the post-state computed by the enclave from the previous state and the transactions alone.
+type SimulationResult struct {
+	Balances              map[string]map[string]string `json:"balances"`
+	BalanceOrder          map[string][]string          `json:"balanceOrder"`
+	UsersOrdered          []string                     `json:"usersOrdered"`
+	UsersNonce            map[string]uint64            `json:"usersNonce"`
+	UserListerNonce       map[string]*NonceSet         `json:"usedListerNonce"`
+	UsedListerNonceFormat uint                         `json:"usedListerNonceFormat"`
+	UsersUpdated          []string                     `json:"usersUpdated"`
+	NumeFeesCollected     map[string]string            `json:"numeFeesCollected"`
+	NftMintCounts         map[string]interface{}       `json:"nftMintCounts"`
+	PrevRoot              string                       `json:"prevRoot"`
+	Root                  string                       `json:"root"`
+	PrevNftRoot           string                       `json:"prevNftRoot"`
+	NftRoot               string                       `json:"nftRoot"`
+	ExecutionTraceHash    string                       `json:"executionTraceHash,omitempty"`
+	Rejected              []RejectedTransaction        `json:"rejectedTransactions,omitempty"`
+}
+
+// FillFeeCurrency gives every ordered user a fee currency balance so each account leaf has it.
+func FillFeeCurrency(balances map[string]map[string]string, users_ordered []string, fee_currency string) {
+	for _, u := range users_ordered {
+		if _, ok := balances[u]; !ok {
+			balances[u] = make(map[string]string)
+		}
+		if _, ok := balances[u][fee_currency]; !ok {
+			balances[u][fee_currency] = "0"
+		}
+	}
+}
+
+// GetAccountTree builds the account tree the way ExecuteBatch starts from it: the first num_users users of
+// users_ordered get their account leaf and every other slot up to max_num_users an empty account leaf.
+func GetAccountTree(users_ordered []string, num_users int, balances map[string]map[string]string, balance_order map[string][]string, users_nonce map[string]uint64, user_lister_nonce map[string]*NonceSet, max_num_users int, max_num_balances int) (*MerkleTree, error) {
+	if num_users > max_num_users {
+		return nil, fmt.Errorf("too many users %d max %d", num_users, max_num_users)
+	}
+	empty_balances_root, _ := GetBalancesRoot(map[string]string{}, []string{}, max_num_balances)
+	leaves := make([][]byte, max_num_users)
+	for i := 0; i < max_num_users; i++ {
+		if i < num_users {
+			u := users_ordered[i]
+			balances_root, ok := GetBalancesRoot(balances[u], balance_order[u], max_num_balances)
+			if !ok {
+				return nil, fmt.Errorf("too many balances for user %s", u)
+			}
+			leaves[i] = GetLeafHash(u, "0x"+balances_root, uint(users_nonce[u]), user_lister_nonce[u])
+		} else {
+			leaves[i] = GetLeafHash("0x"+fmt.Sprintf("%040s", strconv.FormatUint(uint64(i), 16)), "0x"+empty_balances_root, 0, nil)
+		}
+	}
+	return NewMerkleTreeSync(leaves), nil
+}
+
+// BatchExecution is what the enclave derives from the previous state and the transactions of a batch: the
+// post-state, the account and collection trees, and the leaves and collections the batch changed.
+type BatchExecution struct {
+	Result                SimulationResult
+	HasProcess            HasProcess
+	AccountTree           *MerkleTree
+	NftCollectionTree     *MerkleTree
+	NftCollections        []map[string]interface{}
+	NftCollectionsCreated map[int]string
+	NftCollectionsUpdated map[int]string
+	NftCollectionsData    map[int]interface{}
+	UsersUpdated          map[string]interface{}
+	UserBalanceOrder      map[string][]string
+}
+
+// ExecuteBatch runs TransitionState on the previous state and transactions of input_data and builds the trees
+// the way the settlement commits them. Only users updated by the batch and users placed after the previous ones
+// in users_ordered get a new leaf and balance order, every other leaf is kept. A user holding balances after the
+// batch must be placed in users_ordered. NewUserBalances and NewUserBalanceOrder are ignored.
+func ExecuteBatch(input_data InputData, options *TransitionOptions) (BatchExecution, error) {
+	var execution BatchExecution
+	max_num_balances, err := strconv.Atoi(input_data.MetaData["max_num_balances"].(string))
+	if err != nil {
+		return execution, fmt.Errorf("error in max_num_balances")
+	}
+	max_num_users, err := strconv.Atoi(input_data.MetaData["max_num_users"].(string))
+	if err != nil {
+		return execution, fmt.Errorf("error in max_num_users")
+	}
+	max_num_collections, err := strconv.Atoi(input_data.MetaData["max_num_collections"].(string))
+	if err != nil {
+		return execution, fmt.Errorf("error in max_num_collections")
+	}
+	fee_currency := input_data.MetaData["fee_currency_token"].(string)
+	users_ordered := []string{}
+	for _, u := range input_data.MetaData["users_ordered"].([]interface{}) {
+		users_ordered = append(users_ordered, u.(string))
+	}
+	if len(users_ordered) > max_num_users {
+		return execution, fmt.Errorf("too many users %d max %d", len(users_ordered), max_num_users)
+	}
+	num_old_users := len(input_data.OldUserBalances)
+	if num_old_users > len(users_ordered) {
+		return execution, fmt.Errorf("users_ordered misses previous users")
+	}
+	currencies := []string{}
+	for _, c := range input_data.MetaData["currencies"].([]interface{}) {
+		currencies = append(currencies, c.(string))
+	}
+	users_nonce := map[string]uint64{}
+	for k, v := range input_data.MetaData["old_users_nonce"].(map[string]interface{}) {
+		users_nonce[k] = uint64(v.(float64))
+	}
+	user_lister_nonce := map[string]*NonceSet{}
+	for u, set := range input_data.UserListerNonce {
+		user_lister_nonce[u] = set.Copy()
+	}
+
+	if len(input_data.OldNftCollections)+len(input_data.NewNftCollections) > max_num_collections {
+		return execution, fmt.Errorf("too many nft collections")
+	}
+	nft_zero_hash := solsha3.SoliditySHA3(
+		[]string{"address", "address", "bytes32"},
+		[]interface{}{ZeroAddress, ZeroAddress, ZeroAddress},
+	)
+	nft_collection_data := make([][]byte, max_num_collections)
+	for i := range nft_collection_data {
+		nft_collection_data[i] = nft_zero_hash
+	}
+	for i, collection := range input_data.OldNftCollections {
+		nft_collection_data[i], err = VerifyCollectionData(collection)
+		if err != nil {
+			return execution, err
+		}
+	}
+	// new collections are checked against the creation signature before updates in this batch can change them
+	for i, collection := range input_data.NewNftCollections {
+		if verified, _ := ProcessAndVerifyCollectionData(collection); !verified {
+			return execution, fmt.Errorf("invalid signature for new nft collection %d", i)
+		}
+	}
+	nft_collection_tree := NewMerkleTreeSync(nft_collection_data)
+	prev_nft_root := append([]byte{}, nft_collection_tree.Root...)
+	account_tree, err := GetAccountTree(users_ordered, num_old_users, input_data.OldUserBalances, input_data.OldUserBalanceOrder, users_nonce, user_lister_nonce, max_num_users, max_num_balances)
+	if err != nil {
+		return execution, err
+	}
+	prev_root := append([]byte{}, account_tree.Root...)
+
+	nft_collections := append(append([]map[string]interface{}{}, input_data.OldNftCollections...), input_data.NewNftCollections...)
+	balances, has_process, users_updated_map, nume_fees_collected, err := TransitionStateWithOptions(CopyMap(input_data.OldUserBalances), input_data.Transactions, currencies, nft_collections, user_lister_nonce, input_data.MetaData, users_nonce, options)
+	if err != nil {
+		return execution, err
+	}
+	FillFeeCurrency(balances, users_ordered, fee_currency)
+	known_users := make(map[string]bool)
+	for _, u := range users_ordered {
+		known_users[u] = true
+	}
+	for u := range balances {
+		if !known_users[u] {
+			return execution, fmt.Errorf("user %s is not in users_ordered", u)
+		}
+	}
+
+	balance_order := make(map[string][]string)
+	execution.UsersUpdated = make(map[string]interface{})
+	execution.UserBalanceOrder = make(map[string][]string)
+	for i, u := range users_ordered {
+		if !users_updated_map[u] && i < num_old_users {
+			balance_order[u] = input_data.OldUserBalanceOrder[u]
+			continue
+		}
+		balance_order[u], err = GetNewBalanceOrder(input_data.OldUserBalanceOrder[u], balances[u], fee_currency, max_num_balances)
+		if err != nil {
+			return execution, fmt.Errorf("%s for user %s", err.Error(), u)
+		}
+		balances_root, ok := GetBalancesRoot(balances[u], balance_order[u], max_num_balances)
+		if !ok {
+			return execution, fmt.Errorf("too many balances for user %s", u)
+		}
+		leaf := hex.EncodeToString(GetLeafHash(u, "0x"+balances_root, uint(users_nonce[u]), user_lister_nonce[u]))
+		if _, err := account_tree.UpdateLeaf(i, leaf); err != nil {
+			return execution, err
+		}
+		execution.UsersUpdated[u] = leaf
+		execution.UserBalanceOrder[u] = balance_order[u]
+	}
+
+	execution.NftCollectionsCreated = make(map[int]string)
+	execution.NftCollectionsUpdated = make(map[int]string)
+	execution.NftCollectionsData = make(map[int]interface{})
+	for i, collection := range nft_collections {
+		hash, err := GetCollectionLeafHash(collection)
+		if err != nil {
+			return execution, err
+		}
+		if i >= len(input_data.OldNftCollections) {
+			execution.NftCollectionsCreated[i] = hex.EncodeToString(hash)
+		} else if !bytes.Equal(hash, nft_collection_data[i]) {
+			execution.NftCollectionsUpdated[i] = hex.EncodeToString(hash)
+		} else {
+			continue
+		}
+		// the post-state data, with its recorded changes, is what the next batch loads and verifies
+		execution.NftCollectionsData[i] = collection
+		if _, err := nft_collection_tree.UpdateLeaf(i, hex.EncodeToString(hash)); err != nil {
+			return execution, err
+		}
+	}
+
+	users_updated := []string{}
+	for u, updated := range users_updated_map {
+		if updated {
+			users_updated = append(users_updated, strings.ToLower(u))
+		}
+	}
+	sort.Strings(users_updated)
+	execution.HasProcess = has_process
+	execution.AccountTree = account_tree
+	execution.NftCollectionTree = nft_collection_tree
+	execution.NftCollections = nft_collections
+	execution.Result = SimulationResult{
+		Balances:              balances,
+		BalanceOrder:          balance_order,
+		UsersOrdered:          users_ordered,
+		UsersNonce:            users_nonce,
+		UserListerNonce:       user_lister_nonce,
+		UsedListerNonceFormat: UsedListerNonceFormat,
+		UsersUpdated:          users_updated,
+		NumeFeesCollected:     nume_fees_collected,
+		NftMintCounts:         GetCollectionMintCounts(nft_collections),
+		PrevRoot:              "0x" + hex.EncodeToString(prev_root),
+		Root:                  "0x" + hex.EncodeToString(account_tree.Root),
+		PrevNftRoot:           "0x" + hex.EncodeToString(prev_nft_root),
+		NftRoot:               "0x" + hex.EncodeToString(nft_collection_tree.Root),
+		Rejected:              options.GetRejected(),
+	}
+	return execution, nil
+}
+
+// Simulate runs ExecuteBatch and returns the post-state.
+func Simulate(input_data InputData, options *TransitionOptions) (SimulationResult, error) {
+	execution, err := ExecuteBatch(input_data, options)
+	return execution.Result, err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSimulate(t *testing.T) {
+	input_data, _, err := GetData("./test_data")
+	if err != nil {
+		t.Errorf("Error reading test data " + err.Error())
+		return
+	}
+	expected_balances := input_data.NewUserBalances
+	input_data.NewUserBalances = nil
+	input_data.NewUserBalanceOrder = nil
+	result, err := Simulate(input_data, nil)
+	if err != nil {
+		t.Errorf("Error in simulate " + err.Error())
+		return
+	}
+	if !NestedMapsEqual(result.Balances, expected_balances) {
+		t.Errorf("Simulated balances do not match new_balances.json")
+	}
+	for _, u := range result.UsersOrdered {
+		for _, asset := range result.BalanceOrder[u] {
+			if _, ok := result.Balances[u][asset]; !ok && asset != ZeroAddress {
+				t.Errorf("Balance order of %s lists %s which the user does not hold", u, asset)
+			}
+		}
+	}
+	if result.Root == result.PrevRoot {
+		t.Errorf("Expected the account root to change")
+	}
+
+	input_data, _, _ = GetData("./test_data")
+	again, err := Simulate(input_data, nil)
+	if err != nil {
+		t.Errorf("Error in simulate " + err.Error())
+		return
+	}
+	if again.Root != result.Root || again.NftRoot != result.NftRoot || !reflect.DeepEqual(again.BalanceOrder, result.BalanceOrder) {
+		t.Errorf("Simulation is not deterministic")
+	}
+}
+
+func TestSimulateRequiresOrderedUsers(t *testing.T) {
+	input_data, _, err := GetData("./test_data")
+	if err != nil {
+		t.Errorf("Error reading test data " + err.Error())
+		return
+	}
+	users_ordered := input_data.MetaData["users_ordered"].([]interface{})
+	input_data.MetaData["users_ordered"] = users_ordered[:len(users_ordered)-1]
+	if _, err := Simulate(input_data, nil); err == nil || !strings.Contains(err.Error(), "is not in users_ordered") {
+		t.Errorf("Expected error for a user missing from users_ordered got %v", err)
+	}
+}
+
+func TestExecuteBatchKeepsUntouchedLeaves(t *testing.T) {
+	input_data, _, err := GetData("./test_data")
+	if err != nil {
+		t.Errorf("Error reading test data " + err.Error())
+		return
+	}
+	execution, err := ExecuteBatch(input_data, nil)
+	if err != nil {
+		t.Errorf("Error in execute batch " + err.Error())
+		return
+	}
+	result := execution.Result
+	tree, err := GetAccountTree(result.UsersOrdered, len(result.UsersOrdered), result.Balances, result.BalanceOrder, result.UsersNonce, result.UserListerNonce, 16, 8)
+	if err != nil {
+		t.Errorf("Error building account tree " + err.Error())
+		return
+	}
+	if "0x"+hex.EncodeToString(tree.Root) != result.Root {
+		t.Errorf("Expected the rebuilt account tree to match the executed one")
+	}
+	for i, u := range result.UsersOrdered {
+		if _, updated := execution.UsersUpdated[u]; !updated && i >= len(input_data.OldUserBalances) {
+			t.Errorf("Expected new user %s to get a leaf", u)
+		}
+		if _, updated := execution.UsersUpdated[u]; !updated && !reflect.DeepEqual(result.BalanceOrder[u], input_data.OldUserBalanceOrder[u]) {
+			t.Errorf("Expected untouched user %s to keep its balance order", u)
+		}
+	}
+}
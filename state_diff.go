@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// TransactionRef names a transaction by its position in the batch, counted from 1 like the TransitionState
+// errors, since Ids are only unique per transaction type.
+type TransactionRef struct {
+	Number int    `json:"number"`
+	Id     uint   `json:"id"`
+	Type   string `json:"type"`
+}
+
+// BalanceDiff is one (user, asset) where the computed post-state disagrees with the supplied one. Delta is
+// computed minus expected for token balances and empty for NFTs.
+type BalanceDiff struct {
+	User         string           `json:"user"`
+	Asset        string           `json:"asset"`
+	Expected     string           `json:"expected"`
+	Computed     string           `json:"computed"`
+	Delta        string           `json:"delta"`
+	Transactions []TransactionRef `json:"transactions"`
+}
+
+type balanceKey struct {
+	user  string
+	asset string
+}
+
+// GetRevenueRecipients lists who is credited with a collection's royalties and mint fees.
+func GetRevenueRecipients(collection map[string]interface{}) []string {
+	splits, err := GetRoyaltySplits(collection)
+	if err != nil || splits == nil {
+		owner, _ := collection["Owner"].(string)
+		return []string{owner}
+	}
+	recipients := []string{}
+	for _, split := range splits {
+		recipients = append(recipients, split.Recipient)
+	}
+	return recipients
+}
+
+// GetTransactionTouches lists the balances a transaction can debit or credit, from its type and fields alone.
+func GetTransactionTouches(t map[string]interface{}, fee_currency string, nume_user string, nft_collections_map map[string]map[string]interface{}) []balanceKey {
+	field := func(name string) string {
+		value, _ := t[name].(string)
+		return value
+	}
+	touches := []balanceKey{}
+	touch := func(user string, asset string) {
+		touches = append(touches, balanceKey{user, asset})
+	}
+	pay_fees := func(payer string) {
+		touch(payer, fee_currency)
+		touch(nume_user, fee_currency)
+	}
+	from, to := field("From"), field("To")
+	switch field("Type") {
+	case "deposit":
+		touch(to, field("CurrencyOrNftContractAddress"))
+	case "withdrawal", "contract_withdrawal":
+		touch(from, field("CurrencyOrNftContractAddress"))
+	case "transfer":
+		touch(from, field("CurrencyOrNftContractAddress"))
+		touch(to, field("CurrencyOrNftContractAddress"))
+		pay_fees(from)
+	case "nft_deposit":
+		touch(to, field("CurrencyOrNftContractAddress")+"-"+field("AmountOrNftTokenId"))
+	case "nft_withdrawal", "nft_contract_withdrawal":
+		touch(from, field("CurrencyOrNftContractAddress")+"-"+field("AmountOrNftTokenId"))
+	case "nft_transfer":
+		touch(from, field("CurrencyOrNftContractAddress")+"-"+field("AmountOrNftTokenId"))
+		touch(to, field("CurrencyOrNftContractAddress")+"-"+field("AmountOrNftTokenId"))
+		pay_fees(from)
+	case "nft_mint":
+		touch(to, field("CurrencyOrNftContractAddress")+"-"+field("AmountOrNftTokenId"))
+		touch(to, field("MintFeesToken"))
+		for _, recipient := range GetRevenueRecipients(nft_collections_map[field("CurrencyOrNftContractAddress")]) {
+			touch(recipient, field("MintFeesToken"))
+		}
+		pay_fees(to)
+	case "nft_trade", "collection_offer":
+		touch(from, field("NftContractAddress")+"-"+field("NftTokenId"))
+		touch(to, field("NftContractAddress")+"-"+field("NftTokenId"))
+		touch(from, field("Currency"))
+		touch(to, field("Currency"))
+		for _, recipient := range GetRevenueRecipients(nft_collections_map[field("NftContractAddress")]) {
+			touch(recipient, field("Currency"))
+		}
+		pay_fees(to)
+	}
+	return touches
+}
+
+// DiffBalances compares the computed post-state with the expected one and returns every mismatching
+// (user, asset), sorted, with the transactions of the batch that touched it.
+func DiffBalances(expected map[string]map[string]string, computed map[string]map[string]string, transactions []interface{}, meta_data map[string]interface{}, nft_collections []map[string]interface{}) []BalanceDiff {
+	nft_collections_map := make(map[string]map[string]interface{})
+	for _, nft_collection := range nft_collections {
+		nft_collections_map[nft_collection["ContractAddress"].(string)] = nft_collection
+	}
+	fee_currency, _ := meta_data["fee_currency_token"].(string)
+	nume_user, _ := meta_data["nume_user"].(string)
+	touched_by := make(map[balanceKey][]TransactionRef)
+	for i, tx := range transactions {
+		t, ok := tx.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id, _ := t["Id"].(float64)
+		tx_type, _ := t["Type"].(string)
+		ref := TransactionRef{Number: i + 1, Id: uint(id), Type: tx_type}
+		for _, key := range GetTransactionTouches(t, fee_currency, nume_user, nft_collections_map) {
+			refs := touched_by[key]
+			if len(refs) == 0 || refs[len(refs)-1].Number != ref.Number {
+				touched_by[key] = append(refs, ref)
+			}
+		}
+	}
+
+	keys := []balanceKey{}
+	for _, side := range []map[string]map[string]string{expected, computed} {
+		for user, balances := range side {
+			for asset := range balances {
+				if expected[user][asset] != computed[user][asset] {
+					keys = append(keys, balanceKey{user, asset})
+				}
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].user != keys[j].user {
+			return keys[i].user < keys[j].user
+		}
+		return keys[i].asset < keys[j].asset
+	})
+	diffs := []BalanceDiff{}
+	for i, key := range keys {
+		if i > 0 && keys[i-1] == key {
+			continue
+		}
+		diff := BalanceDiff{
+			User:         key.user,
+			Asset:        key.asset,
+			Expected:     expected[key.user][key.asset],
+			Computed:     computed[key.user][key.asset],
+			Transactions: touched_by[key],
+		}
+		if diff.Transactions == nil {
+			diff.Transactions = []TransactionRef{}
+		}
+		if len(key.asset) <= 42 {
+			diff.Delta = balanceDelta(diff.Expected, diff.Computed)
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs
+}
+
+func balanceDelta(expected string, computed string) string {
+	amounts := []*big.Int{big.NewInt(0), big.NewInt(0)}
+	for i, value := range []string{expected, computed} {
+		if value == "" {
+			continue
+		}
+		if _, ok := amounts[i].SetString(value, 10); !ok {
+			return ""
+		}
+	}
+	return fmt.Sprint(new(big.Int).Sub(amounts[1], amounts[0]))
+}
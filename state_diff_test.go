@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDiffBalances(t *testing.T) {
+	input_data, _, err := GetData("./test_data")
+	if err != nil {
+		t.Errorf("Error reading test data " + err.Error())
+		return
+	}
+	result, err := Simulate(input_data, nil)
+	if err != nil {
+		t.Errorf("Error in simulate " + err.Error())
+		return
+	}
+	if diff := DiffBalances(result.Balances, result.Balances, input_data.Transactions, input_data.MetaData, input_data.NewNftCollections); len(diff) != 0 {
+		t.Errorf("Expected no diff got %v", diff)
+	}
+
+	sender := "0xccff350ef46b85228d6650a802107e58bf6a32ab"
+	expected := CopyMap(result.Balances)
+	expected[sender][testFeeCurrency] = "0"
+	expected[sender][testNftContract+"-99"] = "yes"
+	diff := DiffBalances(expected, result.Balances, input_data.Transactions, input_data.MetaData, input_data.NewNftCollections)
+	if len(diff) != 2 {
+		t.Errorf("Expected 2 mismatches got %v", diff)
+		return
+	}
+	if diff[0].Asset != testFeeCurrency || diff[0].Delta != result.Balances[sender][testFeeCurrency] || diff[0].Expected != "0" {
+		t.Errorf("Unexpected token diff %v", diff[0])
+	}
+	types := map[string]bool{}
+	for _, ref := range diff[0].Transactions {
+		types[ref.Type] = true
+	}
+	if !types["deposit"] || !types["transfer"] || !types["withdrawal"] || types["nft_mint"] {
+		t.Errorf("Unexpected transactions named for the token diff %v", diff[0].Transactions)
+	}
+	if diff[1].Asset != testNftContract+"-99" || diff[1].Computed != "" || diff[1].Delta != "" || len(diff[1].Transactions) != 0 {
+		t.Errorf("Unexpected nft diff %v", diff[1])
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/big"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -11,27 +12,97 @@ func CheckNonce(last_nonce, current_nonce uint64) bool {
 	return last_nonce < current_nonce
 }
 
-func CheckCWValidity(cw_should_be_invalid map[string]map[string]bool, transaction Transaction, fee_currency_token string) bool {
-	return true
+// CheckCWValidity derives from the state whether a contract withdrawal forced from L1 can be honoured: the user
+// must hold the amount or own the NFT and must not have spent the asset earlier in the batch.
+func CheckCWValidity(cw_should_be_invalid map[string]map[string]bool, state_balances map[string]map[string]string, nft_owners NftOwnerIndex, transaction Transaction) bool {
+	if transaction.Type == "nft_contract_withdrawal" {
+		nft := transaction.CurrencyOrNftContractAddress + "-" + transaction.AmountOrNftTokenId
+		if cw_should_be_invalid[transaction.From][nft] {
+			return false
+		}
+		_, ok := state_balances[transaction.From][nft]
+		return ok && strings.EqualFold(nft_owners[NftKey(transaction.CurrencyOrNftContractAddress, transaction.AmountOrNftTokenId)], transaction.From)
+	}
+	if cw_should_be_invalid[transaction.From][transaction.CurrencyOrNftContractAddress] {
+		return false
+	}
+	amount, ok := new(big.Int).SetString(transaction.AmountOrNftTokenId, 10)
+	if !ok || amount.Sign() < 0 {
+		return false
+	}
+	balance, ok := new(big.Int).SetString(state_balances[transaction.From][transaction.CurrencyOrNftContractAddress], 10)
+	return ok && balance.Cmp(amount) >= 0
+}
+
+func TransitionState(state_balances map[string]map[string]string, transactions []interface{}, currencies []string, nft_collections []map[string]interface{}, used_lister_nonce map[string]*NonceSet, meta_data map[string]interface{}, user_nonce_tracker map[string]uint64) (map[string]map[string]string, HasProcess, map[string]bool, map[string]string, error) {
+	return TransitionStateWithOptions(state_balances, transactions, currencies, nft_collections, used_lister_nonce, meta_data, user_nonce_tracker, nil)
+}
+
+// TransitionOptions configures TransitionStateWithOptions and collects its optional outputs. A nil
+// *TransitionOptions is valid. With SkipInvalid a failing user transaction leaves the state untouched and is
+// appended to Rejected instead of failing the batch; deposits and contract withdrawals still fail it.
+type TransitionOptions struct {
+	Trace       *ExecutionTrace
+	SkipInvalid bool
+	Rejected    []RejectedTransaction
+}
+
+// NewTransitionOptions reads the execution_trace and skip_invalid_transactions flags of meta_data.
+func NewTransitionOptions(meta_data map[string]interface{}) *TransitionOptions {
+	options := &TransitionOptions{}
+	if enabled, _ := meta_data["execution_trace"].(bool); enabled {
+		options.Trace = &ExecutionTrace{}
+	}
+	options.SkipInvalid, _ = meta_data["skip_invalid_transactions"].(bool)
+	return options
+}
+
+func (options *TransitionOptions) GetTrace() *ExecutionTrace {
+	if options == nil {
+		return nil
+	}
+	return options.Trace
+}
+
+func (options *TransitionOptions) GetSkipInvalid() bool {
+	return options != nil && options.SkipInvalid
 }
 
-func TransitionState(state_balances map[string]map[string]string, transactions []interface{}, currencies []string, nft_collections []map[string]interface{}, used_lister_nonce map[string][]uint, meta_data map[string]interface{}, user_nonce_tracker map[string]uint64) (map[string]map[string]string, HasProcess, map[string]bool, error) {
+func (options *TransitionOptions) GetRejected() []RejectedTransaction {
+	if options == nil {
+		return nil
+	}
+	return options.Rejected
+}
+
+// TransitionStateWithOptions applies transactions to state_balances. Collections are never modified: mints
+// and collection changes work on copies, and the post-state collections replace the entries of
+// nft_collections on success.
+func TransitionStateWithOptions(state_balances map[string]map[string]string, transactions []interface{}, currencies []string, nft_collections []map[string]interface{}, used_lister_nonce map[string]*NonceSet, meta_data map[string]interface{}, user_nonce_tracker map[string]uint64, options *TransitionOptions) (map[string]map[string]string, HasProcess, map[string]bool, map[string]string, error) {
+	trace := options.GetTrace()
 	users_updated_map := make(map[string]bool)
+	nume_fees_collected := make(map[string]string)
 	nft_collections_map := make(map[string]map[string]interface{})
 	defer TimeTrack(time.Now(), "TransitionState")
 	for _, nft_collection := range nft_collections {
 		nft_collections_map[nft_collection["ContractAddress"].(string)] = nft_collection
 	}
+	nft_owners, err := BuildNftOwnerIndex(state_balances)
+	if err != nil {
+		return state_balances, HasProcess{}, users_updated_map, nume_fees_collected, err
+	}
 	cw_should_be_invalid := make(map[string]map[string]bool)
 	nume_address := meta_data["nume_user"].(string)
 	users_updated_map[nume_address] = true
 	fee_currency_token := meta_data["fee_currency_token"].(string)
 	has_process := HasProcess{}
-	for i, tx := range transactions {
+	// apply_transaction applies one transaction of the batch, returning the error that rejects it
+	apply_transaction := func(i int, tx interface{}) error {
+		var err error
 		var transaction Transaction
 		var trade Trade
 		if t, ok := tx.(map[string]interface{}); ok {
-			if t["Type"] == "nft_trade" {
+			if t["Type"] == "nft_trade" || t["Type"] == "collection_offer" {
 				trade = Trade{
 					Id:                 uint(t["Id"].(float64)),
 					From:               t["From"].(string),
@@ -39,8 +110,6 @@ func TransitionState(state_balances map[string]map[string]string, transactions [
 					ListAmount:         t["ListAmount"].(string),
 					BuyAmount:          t["BuyAmount"].(string),
 					Currency:           t["Currency"].(string),
-					ListerNonce:        uint(t["ListerNonce"].(float64)),
-					BuyerNonce:         uint(t["BuyerNonce"].(float64)),
 					NftTokenId:         t["NftTokenId"].(string),
 					NftContractAddress: t["NftContractAddress"].(string),
 					Type:               t["Type"].(string),
@@ -50,6 +119,26 @@ func TransitionState(state_balances map[string]map[string]string, transactions [
 					RoyaltyAmount:      t["RoyaltyAmount"].(string),
 					NumeFees:           t["NumeFees"].(string),
 				}
+				if created_at, ok := t["CreatedAt"].(string); ok {
+					trade.CreatedAt, err = time.Parse(time.RFC3339Nano, created_at)
+					if err != nil {
+						return fmt.Errorf("invalid created at for transaction number %v", i+1)
+					}
+				}
+				if expiry, ok := t["ListExpiry"].(float64); ok {
+					trade.ListExpiry = uint64(expiry)
+				}
+				if expiry, ok := t["BuyExpiry"].(float64); ok {
+					trade.BuyExpiry = uint64(expiry)
+				}
+				if trade.Type == "collection_offer" {
+					trade.OfferNonce = uint(t["OfferNonce"].(float64))
+					trade.OfferQuantity = uint(t["OfferQuantity"].(float64))
+					trade.SellerNonce = uint(t["SellerNonce"].(float64))
+				} else {
+					trade.ListerNonce = uint(t["ListerNonce"].(float64))
+					trade.BuyerNonce = uint(t["BuyerNonce"].(float64))
+				}
 			} else {
 				transaction = Transaction{
 					Id:                           uint(t["Id"].(float64)),
@@ -67,29 +156,66 @@ func TransitionState(state_balances map[string]map[string]string, transactions [
 					MintFees:                     t["MintFees"].(string),
 					MintFeesToken:                t["MintFeesToken"].(string),
 				}
+				if transaction.Type == "cancel_listing" {
+					if nonces, ok := t["ListerNonces"].([]interface{}); ok {
+						for _, n := range nonces {
+							transaction.ListerNonces = append(transaction.ListerNonces, uint(n.(float64)))
+						}
+					}
+					if below, ok := t["CancelBelowNonce"].(float64); ok {
+						transaction.CancelBelowNonce = uint(below)
+					}
+				}
+				if created_at, ok := t["CreatedAt"].(string); ok {
+					transaction.CreatedAt, err = time.Parse(time.RFC3339Nano, created_at)
+					if err != nil {
+						return fmt.Errorf("invalid created at for transaction number %v", i+1)
+					}
+				}
+				if transaction.Type == "collection_update" {
+					transaction.BaseUri, _ = t["BaseUri"].(string)
+					transaction.RoyaltyFeesPercetage, _ = t["RoyaltyFeesPercetage"].(string)
+				}
+				if transaction.Type == "nft_mint" {
+					if proof, ok := t["MintProof"].([]interface{}); ok {
+						for _, p := range proof {
+							transaction.MintProof = append(transaction.MintProof, p.(string))
+						}
+					}
+					if index, ok := t["MintProofIndex"].(float64); ok {
+						transaction.MintProofIndex = uint(index)
+					}
+					if phase, ok := t["MintPhase"].(float64); ok {
+						transaction.MintPhase = uint(phase)
+					}
+				}
 			}
 		} else {
-			return state_balances, has_process, users_updated_map, fmt.Errorf("invalid transaction type")
+			return fmt.Errorf("invalid transaction type")
 		}
-		if transaction.IsInvalid {
-			if transaction.Type == "contract_withdrawal" {
-				has_process.HasContractWithdrawal = true
-			}
-			if transaction.Type == "nft_contract_withdrawal" {
-				has_process.HasNFTContractWithdrawal = true
-			}
-			continue
+		is_trade := trade.Type != ""
+		if is_trade {
+			trace.Begin(i+1, trade.Id, trade.Type)
+		} else {
+			trace.Begin(i+1, transaction.Id, transaction.Type)
 		}
 		if transaction.Type == "contract_withdrawal" || transaction.Type == "nft_contract_withdrawal" {
-			key := transaction.CurrencyOrNftContractAddress
-			if transaction.Type == "nft_contract_withdrawal" {
-				key = transaction.CurrencyOrNftContractAddress + "-" + transaction.AmountOrNftTokenId
-			}
-			if cw_should_be_invalid[transaction.From][key] {
-				PrettyPrint("cw_should_be_invalid", cw_should_be_invalid)
-				fmt.Println(transaction.From, key)
-				return state_balances, has_process, users_updated_map, fmt.Errorf("contract withdrawal is invalid for transaction number %v", i+1)
+			// a withdrawal the state cannot honour must be marked invalid, one marked invalid is skipped
+			if !transaction.IsInvalid && !CheckCWValidity(cw_should_be_invalid, state_balances, nft_owners, transaction) {
+				return fmt.Errorf("contract withdrawal is invalid for transaction number %v", i+1)
+			}
+			if transaction.IsInvalid {
+				trace.Skip()
+				if transaction.Type == "contract_withdrawal" {
+					has_process.HasContractWithdrawal = true
+				}
+				if transaction.Type == "nft_contract_withdrawal" {
+					has_process.HasNFTContractWithdrawal = true
+				}
+				return nil
 			}
+		} else if transaction.IsInvalid {
+			return fmt.Errorf("only contract withdrawals can be marked invalid, transaction number %v", i+1)
 		}
 		if _, ok := cw_should_be_invalid[transaction.From]; !ok {
 			cw_should_be_invalid[transaction.From] = make(map[string]bool)
@@ -111,88 +237,189 @@ func TransitionState(state_balances map[string]map[string]string, transactions [
 		} else if transaction.Type == "nft_withdrawal" {
 			cw_should_be_invalid[transaction.From][transaction.CurrencyOrNftContractAddress+"-"+transaction.AmountOrNftTokenId] = true
 		}
-		if trade.Type == "nft_trade" {
-			cw_should_be_invalid[transaction.From][transaction.CurrencyOrNftContractAddress+"-"+transaction.AmountOrNftTokenId] = true
-			cw_should_be_invalid[transaction.To][fee_currency_token] = true
-			cw_should_be_invalid[transaction.To][transaction.CurrencyOrNftContractAddress] = true
+		if is_trade {
+			if _, ok := cw_should_be_invalid[trade.From]; !ok {
+				cw_should_be_invalid[trade.From] = make(map[string]bool)
+			}
+			if _, ok := cw_should_be_invalid[trade.To]; !ok {
+				cw_should_be_invalid[trade.To] = make(map[string]bool)
+			}
+			cw_should_be_invalid[trade.From][trade.NftContractAddress+"-"+trade.NftTokenId] = true
+			cw_should_be_invalid[trade.To][fee_currency_token] = true
+			cw_should_be_invalid[trade.To][trade.Currency] = true
 		}
 
-		if transaction.Type != "" && transaction.Type != "nft_deposit" && transaction.Type != "nft_mint" && transaction.Type != "deposit" && transaction.Type != "contract_withdrawal" && transaction.Type != "nft_contract_withdrawal" {
+		if transaction.Type != "" && transaction.Type != "nft_deposit" && transaction.Type != "nft_mint" && transaction.Type != "deposit" && transaction.Type != "contract_withdrawal" && transaction.Type != "nft_contract_withdrawal" && transaction.Type != "cancel_listing" && transaction.Type != "collection_update" && transaction.Type != "collection_transfer" {
 			verified, err := VerifyData(transaction, currencies)
 			if !verified || err != nil {
-				return state_balances, has_process, users_updated_map, fmt.Errorf("digital signature verification failed for transaction number %v %s %s", i+1, transaction.From, err)
+				return withReason(RejectSignature, fmt.Errorf("digital signature verification failed for transaction number %v %s %s", i+1, transaction.From, err))
 			}
 		}
 		if !CheckNonce(user_nonce_tracker[transaction.From], uint64(transaction.Nonce)) && transaction.Type != "nft_deposit" && transaction.Type != "deposit" && transaction.Type != "contract_withdrawal" && transaction.Type != "nft_contract_withdrawal" && transaction.Type != "" {
-			return state_balances, has_process, users_updated_map, fmt.Errorf("nonce check failed for transaction number %v", i+1)
+			return withReason(RejectNonce, fmt.Errorf("nonce check failed for transaction number %v", i+1))
 		}
 		if trade.Type == "nft_trade" {
 			if !CheckNonce(user_nonce_tracker[trade.To], uint64(trade.BuyerNonce)) {
-				return state_balances, has_process, users_updated_map, fmt.Errorf("nonce check failed for transaction number %v", i+1)
+				return withReason(RejectNonce, fmt.Errorf("nonce check failed for transaction number %v", i+1))
+			}
+		}
+		if trade.Type == "collection_offer" {
+			if !CheckNonce(user_nonce_tracker[trade.From], uint64(trade.SellerNonce)) {
+				return withReason(RejectNonce, fmt.Errorf("nonce check failed for transaction number %v", i+1))
 			}
 		}
 		updateHasProcess(&has_process, transaction)
 		if transaction.Type == "nft_mint" {
 			user_nonce_tracker[transaction.To] = uint64(transaction.Nonce)
+			trace.End(transaction.To, user_nonce_tracker[transaction.To])
 		} else if trade.Type == "nft_trade" {
 			user_nonce_tracker[trade.To] = uint64(trade.BuyerNonce)
+			trace.End(trade.To, user_nonce_tracker[trade.To])
+		} else if trade.Type == "collection_offer" {
+			user_nonce_tracker[trade.From] = uint64(trade.SellerNonce)
+			trace.End(trade.From, user_nonce_tracker[trade.From])
 		} else if transaction.Type != "nft_deposit" && transaction.Type != "deposit" && transaction.Type != "contract_withdrawal" && transaction.Type != "nft_contract_withdrawal" && transaction.Type != "" {
 			user_nonce_tracker[transaction.From] = uint64(transaction.Nonce)
+			trace.End(transaction.From, user_nonce_tracker[transaction.From])
+		}
+
+		if transaction.Type == "cancel_listing" {
+			cancel_message := CancelListingMessage(transaction.From, transaction.Nonce, transaction.ListerNonces, transaction.CancelBelowNonce)
+			if !EthVerify(cancel_message, transaction.Signature, transaction.From) {
+				return withReason(RejectSignature, fmt.Errorf("invalid cancel listing signature for transaction number %v", i+1))
+			}
+			if len(transaction.ListerNonces) == 0 && transaction.CancelBelowNonce == 0 {
+				return withReason(RejectCancel, fmt.Errorf("no lister nonce to cancel for transaction number %v", i+1))
+			}
+			lister_nonces := GetOrCreateNonceSet(used_lister_nonce, transaction.From)
+			for _, nonce := range transaction.ListerNonces {
+				if lister_nonces.Add(nonce) {
+					trace.ConsumeListerNonces(transaction.From, nonce, nonce)
+				}
+			}
+			if transaction.CancelBelowNonce > 1 {
+				lister_nonces.AddRange(1, transaction.CancelBelowNonce-1)
+				trace.ConsumeListerNonces(transaction.From, 1, transaction.CancelBelowNonce-1)
+			}
+			users_updated_map[transaction.From] = true
+		}
+		if transaction.Type == "collection_update" || transaction.Type == "collection_transfer" {
+			err := ApplyCollectionChange(transaction, nft_collections_map)
+			if err != nil {
+				return withReason(RejectCollection, fmt.Errorf("%s for transaction number %v", err.Error(), i+1))
+			}
+			users_updated_map[transaction.From] = true
 		}
 
 		// Handle Nume Fees wherever applicable
 		var nume_fees *big.Int
 		var ok bool
 		var error_in_fee error
-		if trade.Type == "nft_trade" {
+		if is_trade {
 			nume_fees, ok = new(big.Int).SetString(trade.NumeFees, 10)
 			if !ok {
-				return state_balances, has_process, users_updated_map, fmt.Errorf("error converting amount to big int")
+				return fmt.Errorf("error converting amount to big int")
+			}
+			required_fees, err := GetNumeFees(meta_data, trade.Type, trade.Currency)
+			if err != nil {
+				return withReason(RejectFees, err)
+			}
+			if nume_fees.Cmp(required_fees) != 0 {
+				return withReason(RejectFees, fmt.Errorf("nume fees mismatch for transaction number %v expected %s got %s", i+1, required_fees.String(), nume_fees.String()))
 			}
 			state_balances, error_in_fee = DeductFees(state_balances, trade.To, fee_currency_token, nume_fees, nume_address)
 			if error_in_fee != nil {
-				return state_balances, has_process, users_updated_map, error_in_fee
+				return withReason(RejectFees, error_in_fee)
 			}
+			trace.Transfer(trade.To, nume_address, fee_currency_token, nume_fees, "nume_fee")
 		} else if transaction.Type == "transfer" || transaction.Type == "nft_transfer" || transaction.Type == "nft_mint" {
 			nume_fees, ok = new(big.Int).SetString(transaction.NumeFees, 10)
 			if !ok {
-				return state_balances, has_process, users_updated_map, fmt.Errorf("error converting amount to big int")
+				return fmt.Errorf("error converting amount to big int")
+			}
+			required_fees, err := GetNumeFees(meta_data, transaction.Type, transaction.CurrencyOrNftContractAddress)
+			if err != nil {
+				return withReason(RejectFees, err)
+			}
+			if nume_fees.Cmp(required_fees) != 0 {
+				return withReason(RejectFees, fmt.Errorf("nume fees mismatch for transaction number %v expected %s got %s", i+1, required_fees.String(), nume_fees.String()))
 			}
 			sender := transaction.From
 			if transaction.Type == "nft_mint" {
 				mint_fee_amount_bi, ok := new(big.Int).SetString(transaction.MintFees, 10)
 				if !ok {
-					return state_balances, has_process, users_updated_map, fmt.Errorf("error converting amount to big int")
+					return fmt.Errorf("error converting amount to big int")
 				}
-				state_balances, error_in_fee = DeductFees(state_balances, transaction.To, transaction.MintFeesToken, mint_fee_amount_bi, nft_collections_map[transaction.CurrencyOrNftContractAddress]["Owner"].(string))
+				state_balances, error_in_fee = PayCollectionRevenue(state_balances, transaction.To, transaction.MintFeesToken, mint_fee_amount_bi, nft_collections_map[transaction.CurrencyOrNftContractAddress], users_updated_map, trace, "mint_fee")
 				if error_in_fee != nil {
-					return state_balances, has_process, users_updated_map, error_in_fee
+					return withReason(RejectFees, error_in_fee)
 				}
 				sender = transaction.To
 			}
 			state_balances, error_in_fee = DeductFees(state_balances, sender, fee_currency_token, nume_fees, nume_address)
 			if error_in_fee != nil {
-				return state_balances, has_process, users_updated_map, error_in_fee
+				return withReason(RejectFees, error_in_fee)
 			}
+			trace.Transfer(sender, nume_address, fee_currency_token, nume_fees, "nume_fee")
+		}
+		// fees are only ever paid in the fee currency, which is what the totals are keyed by
+		if nume_fees != nil {
+			AddToAmount(nume_fees_collected, fee_currency_token, nume_fees)
 		}
 
-		if transaction.Type == "nft_deposit" || transaction.Type == "nft_transfer" || transaction.Type == "nft_mint" || trade.Type == "nft_trade" {
+		// NFTs leave the sender before reaching the receiver so a transfer to oneself keeps the token
+		if transaction.Type == "nft_contract_withdrawal" || transaction.Type == "nft_withdrawal" || transaction.Type == "nft_transfer" || is_trade {
+			tx_sender := transaction.From
+			tx_nft_contract := transaction.CurrencyOrNftContractAddress
+			tx_nft_token_id := transaction.AmountOrNftTokenId
+			if is_trade {
+				tx_sender = trade.From
+				tx_nft_contract = trade.NftContractAddress
+				tx_nft_token_id = trade.NftTokenId
+			}
+			users_updated_map[tx_sender] = true
+			if _, ok := state_balances[tx_sender][tx_nft_contract+"-"+tx_nft_token_id]; !ok || !strings.EqualFold(nft_owners[NftKey(tx_nft_contract, tx_nft_token_id)], tx_sender) {
+				return withReason(RejectNftOwnership, fmt.Errorf("user does not own nft %s-%s for transaction number %v", tx_nft_contract, tx_nft_token_id, i+1))
+			}
+			delete(state_balances[tx_sender], tx_nft_contract+"-"+tx_nft_token_id)
+			delete(nft_owners, NftKey(tx_nft_contract, tx_nft_token_id))
+			trace.MoveNft(tx_nft_contract+"-"+tx_nft_token_id, tx_sender, "")
+		}
+
+		if transaction.Type == "nft_deposit" || transaction.Type == "nft_transfer" || transaction.Type == "nft_mint" || is_trade {
 			if transaction.Type == "nft_mint" {
-				err := verifyMintData(transaction, nft_collections_map)
+				err := verifyMintData(transaction, nft_collections_map, meta_data)
 				if err != nil {
-					return state_balances, has_process, users_updated_map, err
+					return withReason(RejectMint, err)
 				}
 			}
 			tx_receiver := transaction.To
 			tx_nft_contract := transaction.CurrencyOrNftContractAddress
 			tx_nft_token_id := transaction.AmountOrNftTokenId
 			l2_minted := transaction.L2Minted
-			if trade.Type == "nft_trade" {
+			if is_trade {
 				tx_receiver = trade.To
 				tx_nft_contract = trade.NftContractAddress
 				tx_nft_token_id = trade.NftTokenId
 				l2_minted = trade.L2Minted
 			}
+			if owner, ok := nft_owners[NftKey(tx_nft_contract, tx_nft_token_id)]; ok {
+				return withReason(RejectNftOwnership, fmt.Errorf("nft %s-%s already owned by %s for transaction number %v", tx_nft_contract, tx_nft_token_id, owner, i+1))
+			}
+			nft_owners[NftKey(tx_nft_contract, tx_nft_token_id)] = tx_receiver
+			trace.MoveNft(tx_nft_contract+"-"+tx_nft_token_id, "", tx_receiver)
+			if transaction.Type == "nft_mint" {
+				mint_rules, err := GetMintRules(nft_collections_map[tx_nft_contract])
+				if err != nil {
+					return withReason(RejectMint, err)
+				}
+				if mint_rules != nil {
+					nft_collections_map[tx_nft_contract], err = RecordMint(nft_collections_map[tx_nft_contract], tx_receiver)
+					if err != nil {
+						return withReason(RejectMint, err)
+					}
+				}
+			}
 			users_updated_map[tx_receiver] = true
 			if _, ok := state_balances[tx_receiver]; ok {
 				state_balances[tx_receiver][tx_nft_contract+"-"+tx_nft_token_id] = "yes"
@@ -207,48 +434,38 @@ func TransitionState(state_balances map[string]map[string]string, transactions [
 				}
 			}
 		}
-		if transaction.Type == "nft_contract_withdrawal" || transaction.Type == "nft_withdrawal" || transaction.Type == "nft_transfer" || trade.Type == "nft_trade" {
-			tx_sender := transaction.From
-			tx_nft_contract := transaction.CurrencyOrNftContractAddress
-			tx_nft_token_id := transaction.AmountOrNftTokenId
-			if trade.Type == "nft_trade" {
-				tx_sender = trade.From
-				tx_nft_contract = trade.NftContractAddress
-				tx_nft_token_id = trade.NftTokenId
-			}
-			users_updated_map[tx_sender] = true
-			if _, ok := state_balances[tx_sender]; ok {
-				delete(state_balances[tx_sender], tx_nft_contract+"-"+tx_nft_token_id)
-			}
-		}
-
-		if transaction.Type == "deposit" || transaction.Type == "transfer" || trade.Type == "nft_trade" {
+		if transaction.Type == "deposit" || transaction.Type == "transfer" || is_trade {
 			tx_receiver := transaction.To
 			tx_currency := transaction.CurrencyOrNftContractAddress
 			tx_amt := transaction.AmountOrNftTokenId
-			if trade.Type == "nft_trade" {
+			tx_kind := transaction.Type
+			if is_trade {
 				tx_receiver = trade.From
 				tx_currency = trade.Currency
+				tx_kind = trade.Type
 				trade_buy_amt_bi, ok := new(big.Int).SetString(trade.BuyAmount, 10)
 				if !ok {
-					return state_balances, has_process, users_updated_map, fmt.Errorf("error converting amount to big int")
+					return fmt.Errorf("error converting amount to big int")
 				}
 				trade_royalty_bi, ok := new(big.Int).SetString(trade.RoyaltyAmount, 10)
 				if !ok {
-					return state_balances, has_process, users_updated_map, fmt.Errorf("error converting amount to big int")
+					return fmt.Errorf("error converting amount to big int")
 				}
 				tx_amt = new(big.Int).Sub(trade_buy_amt_bi, trade_royalty_bi).String()
 			}
 			users_updated_map[tx_receiver] = true
+			if credit, ok := new(big.Int).SetString(tx_amt, 10); ok {
+				trace.Credit(tx_receiver, tx_currency, credit, tx_kind)
+			}
 			if _, ok := state_balances[tx_receiver]; ok {
 				if _, ok := state_balances[tx_receiver][tx_currency]; ok {
 					amount, ok := new(big.Int).SetString(tx_amt, 10)
 					if !ok {
-						return state_balances, has_process, users_updated_map, fmt.Errorf("error converting amount to big int")
+						return fmt.Errorf("error converting amount to big int")
 					}
 					current_balance, ok := new(big.Int).SetString(state_balances[tx_receiver][tx_currency], 10)
 					if !ok {
-						return state_balances, has_process, users_updated_map, fmt.Errorf("error converting current_balance to big int")
+						return fmt.Errorf("error converting current_balance to big int")
 					}
 					new_amt := new(big.Int)
 					new_amt.Add(amount, current_balance)
@@ -261,21 +478,23 @@ func TransitionState(state_balances map[string]map[string]string, transactions [
 				state_balances[tx_receiver][tx_currency] = tx_amt
 			}
 		}
-		if transaction.Type == "contract_withdrawal" || transaction.Type == "withdrawal" || transaction.Type == "transfer" || trade.Type == "nft_trade" {
+		if transaction.Type == "contract_withdrawal" || transaction.Type == "withdrawal" || transaction.Type == "transfer" || is_trade {
 			tx_sender := transaction.From
 			tx_currency := transaction.CurrencyOrNftContractAddress
 			tx_amt := transaction.AmountOrNftTokenId
+			tx_kind := transaction.Type
 			users_updated_map[tx_sender] = true
-			if trade.Type == "nft_trade" {
+			if is_trade {
 				tx_sender = trade.To
 				tx_currency = trade.Currency
+				tx_kind = trade.Type
 				trade_buy_amt_bi, ok := new(big.Int).SetString(trade.BuyAmount, 10)
 				if !ok {
-					return state_balances, has_process, users_updated_map, fmt.Errorf("error converting amount to big int")
+					return fmt.Errorf("error converting amount to big int")
 				}
 				trade_royalty_bi, ok := new(big.Int).SetString(trade.RoyaltyAmount, 10)
 				if !ok {
-					return state_balances, has_process, users_updated_map, fmt.Errorf("error converting amount to big int")
+					return fmt.Errorf("error converting amount to big int")
 				}
 				tx_amt = new(big.Int).Sub(trade_buy_amt_bi, trade_royalty_bi).String()
 			}
@@ -284,67 +503,285 @@ func TransitionState(state_balances map[string]map[string]string, transactions [
 				if _, ok := state_balances[tx_sender][tx_currency]; ok {
 					amount, ok := new(big.Int).SetString(tx_amt, 10)
 					if !ok {
-						return state_balances, has_process, users_updated_map, fmt.Errorf("error converting amount to big int")
+						return fmt.Errorf("error converting amount to big int")
 					}
 					current_balance, ok := new(big.Int).SetString(state_balances[tx_sender][tx_currency], 10)
 					if !ok {
-						return state_balances, has_process, users_updated_map, fmt.Errorf("error converting current_balance to big int")
+						return fmt.Errorf("error converting current_balance to big int")
 					}
 					new_amt := new(big.Int)
 					new_amt.Sub(current_balance, amount)
 					state_balances[tx_sender][tx_currency] = new_amt.String()
+					trace.Debit(tx_sender, tx_currency, amount, tx_kind)
 					if new_amt.Cmp(big.NewInt(0)) == -1 {
-						return state_balances, has_process, users_updated_map, fmt.Errorf("error: user balance negative")
+						return withReason(RejectBalance, fmt.Errorf("error: user balance negative"))
 					}
 				} else {
-					return state_balances, has_process, users_updated_map, fmt.Errorf("error: user does not have currency to transfer")
+					return withReason(RejectBalance, fmt.Errorf("error: user does not have currency to transfer"))
 				}
 			} else {
-				return state_balances, has_process, users_updated_map, fmt.Errorf("error: user does not have balance")
+				return withReason(RejectBalance, fmt.Errorf("error: user does not have balance"))
 			}
 		}
 
 		if trade.Type == "nft_trade" {
-			invalid_nonce := binarySearch(used_lister_nonce[trade.From], trade.ListerNonce)
-			if invalid_nonce {
-				return state_balances, has_process, users_updated_map, fmt.Errorf("invalid lister nonce for transaction number %v", i+1)
+			if !GetOrCreateNonceSet(used_lister_nonce, trade.From).Add(trade.ListerNonce) {
+				return withReason(RejectNonce, fmt.Errorf("invalid lister nonce for transaction number %v", i+1))
 			}
-			used_lister_nonce[trade.From] = append(used_lister_nonce[trade.From], trade.ListerNonce)
+			trace.ConsumeListerNonces(trade.From, trade.ListerNonce, trade.ListerNonce)
 			// VERIFY LIST SIGNATURE AND BUY SIGNATURE
+			// orders signed before expiry was introduced carry no expiry and use the original schema
 			list_message := NftTradeMessage(trade.From, trade.NftContractAddress, trade.NftTokenId, trade.Currency, trade.ListAmount, strconv.Itoa(int(trade.ListerNonce)), 0)
+			if trade.ListExpiry != 0 {
+				list_message = NftTradeMessageWithExpiry(trade.From, trade.NftContractAddress, trade.NftTokenId, trade.Currency, trade.ListAmount, strconv.Itoa(int(trade.ListerNonce)), 0, trade.ListExpiry)
+			}
 			if !EthVerify(list_message, trade.ListSignature, trade.From) {
-				return state_balances, has_process, users_updated_map, fmt.Errorf("invalid list signature")
+				return withReason(RejectSignature, fmt.Errorf("invalid list signature"))
 			}
 			buy_message := NftTradeMessage(trade.To, trade.NftContractAddress, trade.NftTokenId, trade.Currency, trade.BuyAmount, strconv.Itoa(int(trade.BuyerNonce)), 1)
+			if trade.BuyExpiry != 0 {
+				buy_message = NftTradeMessageWithExpiry(trade.To, trade.NftContractAddress, trade.NftTokenId, trade.Currency, trade.BuyAmount, strconv.Itoa(int(trade.BuyerNonce)), 1, trade.BuyExpiry)
+			}
 			if !EthVerify(buy_message, trade.BuySignature, trade.To) {
-				return state_balances, has_process, users_updated_map, fmt.Errorf("invalid buy signature")
+				return withReason(RejectSignature, fmt.Errorf("invalid buy signature"))
+			}
+		}
+		if trade.Type == "collection_offer" {
+			// an offer may be filled up to OfferQuantity times across batches, its fills are kept in the buyer's
+			// offer namespace and never consume a lister nonce
+			if trade.OfferNonce == 0 {
+				return withReason(RejectCollectionOffer, fmt.Errorf("invalid offer nonce for transaction number %v", i+1))
+			}
+			offer_nonces := GetOrCreateNonceSet(used_lister_nonce, trade.To)
+			if offer_nonces.OfferFills(trade.OfferNonce) >= trade.OfferQuantity {
+				return withReason(RejectCollectionOffer, fmt.Errorf("collection offer already filled for transaction number %v", i+1))
+			}
+			offer_nonces.FillOffer(trade.OfferNonce)
+			// VERIFY OFFER SIGNATURE AND ACCEPT SIGNATURE
+			if trade.ListExpiry == 0 || trade.BuyExpiry == 0 {
+				return withReason(RejectCollectionOffer, fmt.Errorf("collection offer without expiry for transaction number %v", i+1))
+			}
+			offer_message := CollectionOfferMessage(trade.To, trade.NftContractAddress, trade.Currency, trade.BuyAmount, strconv.Itoa(int(trade.OfferQuantity)), strconv.Itoa(int(trade.OfferNonce)), trade.BuyExpiry)
+			if !EthVerify(offer_message, trade.BuySignature, trade.To) {
+				return withReason(RejectSignature, fmt.Errorf("invalid offer signature"))
+			}
+			accept_message := NftTradeMessageWithExpiry(trade.From, trade.NftContractAddress, trade.NftTokenId, trade.Currency, trade.ListAmount, strconv.Itoa(int(trade.SellerNonce)), 2, trade.ListExpiry)
+			if !EthVerify(accept_message, trade.ListSignature, trade.From) {
+				return withReason(RejectSignature, fmt.Errorf("invalid accept signature"))
+			}
+		}
+		if is_trade {
+			err = CheckOrderExpiry(trade.CreatedAt, trade.ListExpiry, meta_data)
+			if err == nil {
+				err = CheckOrderExpiry(trade.CreatedAt, trade.BuyExpiry, meta_data)
+			}
+			if err != nil {
+				return withReason(RejectOrderExpiry, fmt.Errorf("%s for transaction number %v", err, i+1))
 			}
-
 			amount_bi, ok := new(big.Int).SetString(trade.BuyAmount, 10)
 			if !ok {
-				return state_balances, has_process, users_updated_map, fmt.Errorf("error converting amount to big int")
+				return fmt.Errorf("error converting amount to big int")
 			}
 			listed_amt_bi, ok := new(big.Int).SetString(trade.ListAmount, 10)
 			if !ok {
-				return state_balances, has_process, users_updated_map, fmt.Errorf("error converting amount to big int")
+				return fmt.Errorf("error converting amount to big int")
 			}
 			if amount_bi.Cmp(listed_amt_bi) < 0 {
-				return state_balances, has_process, users_updated_map, fmt.Errorf("list amount must be less than or equal to buy amount")
+				return fmt.Errorf("list amount must be less than or equal to buy amount")
 			}
 
 			// Handle ROYALTY fee
 			royalty_amount_bi, ok := new(big.Int).SetString(trade.RoyaltyAmount, 10)
 			if !ok {
-				return state_balances, has_process, users_updated_map, fmt.Errorf("error converting amount to big int")
+				return fmt.Errorf("error converting amount to big int")
+			}
+			if _, ok := nft_collections_map[trade.NftContractAddress]; !ok {
+				return withReason(RejectCollection, fmt.Errorf("nft collection not found for transaction number %v", i+1))
+			}
+			required_royalty_bi, err := GetRoyaltyAmount(amount_bi, nft_collections_map[trade.NftContractAddress]["RoyaltyFeesPercetage"])
+			if err != nil {
+				return withReason(RejectFees, err)
+			}
+			// a seller who is the collection's only revenue recipient would pay the royalty to itself, so it may
+			// leave it at zero
+			recipients := GetRevenueRecipients(nft_collections_map[trade.NftContractAddress])
+			self_royalty := len(recipients) == 1 && strings.EqualFold(recipients[0], trade.From) && royalty_amount_bi.Sign() == 0
+			if royalty_amount_bi.Cmp(required_royalty_bi) != 0 && !self_royalty {
+				return withReason(RejectFees, fmt.Errorf("royalty mismatch for transaction number %v expected %s got %s", i+1, required_royalty_bi.String(), royalty_amount_bi.String()))
 			}
-			state_balances, error_in_fee = DeductFees(state_balances, trade.To, trade.Currency, royalty_amount_bi, nft_collections_map[trade.NftContractAddress]["Owner"].(string))
+			state_balances, error_in_fee = PayCollectionRevenue(state_balances, trade.To, trade.Currency, royalty_amount_bi, nft_collections_map[trade.NftContractAddress], users_updated_map, trace, "royalty")
 			if error_in_fee != nil {
-				return state_balances, has_process, users_updated_map, error_in_fee
+				return withReason(RejectFees, error_in_fee)
 			}
 		}
+		return nil
 	}
+	for i, tx := range transactions {
+		var checkpoint *transactionCheckpoint
+		if options.GetSkipInvalid() && IsRejectable(tx) {
+			checkpoint = newTransactionCheckpoint(tx.(map[string]interface{}), state_balances, &has_process, users_updated_map, nume_fees_collected, nft_collections_map, nft_owners, cw_should_be_invalid, used_lister_nonce, user_nonce_tracker, nume_address)
+		}
+		err = apply_transaction(i, tx)
+		if err != nil && checkpoint == nil {
+			return state_balances, has_process, users_updated_map, nume_fees_collected, err
+		}
+		if err != nil {
+			checkpoint.restore()
+			rejected := checkpoint.rejected(i+1, err)
+			trace.Reject(rejected)
+			options.Rejected = append(options.Rejected, rejected)
+		}
+	}
+	for i, nft_collection := range nft_collections {
+		nft_collections[i] = nft_collections_map[nft_collection["ContractAddress"].(string)]
+	}
+
+	return state_balances, has_process, users_updated_map, nume_fees_collected, nil
+}
 
-	return state_balances, has_process, users_updated_map, nil
+// NftOwnerIndex maps an NFT, keyed by NftKey, to the user holding it.
+type NftOwnerIndex map[string]string
+
+func NftKey(nft_contract string, nft_token_id string) string {
+	return strings.ToLower(nft_contract) + "-" + nft_token_id
+}
+
+// BuildNftOwnerIndex indexes every NFT held in state_balances and fails if two users hold the same token.
+func BuildNftOwnerIndex(state_balances map[string]map[string]string) (NftOwnerIndex, error) {
+	nft_owners := NftOwnerIndex{}
+	for user, balances := range state_balances {
+		for asset := range balances {
+			if len(asset) <= 42 {
+				continue
+			}
+			key := strings.ToLower(asset)
+			if owner, ok := nft_owners[key]; ok {
+				return nft_owners, fmt.Errorf("nft %s held by both %s and %s", asset, owner, user)
+			}
+			nft_owners[key] = user
+		}
+	}
+	return nft_owners, nil
+}
+
+// CheckOrderExpiry rejects an order that had expired when the trade was made, and trades timestamped
+// outside the settlement window given by meta_data's settlement_start_time/settlement_end_time (unix seconds).
+// Orders without expiry are only accepted while meta_data's require_order_expiry is unset.
+func CheckOrderExpiry(created_at time.Time, expiry uint64, meta_data map[string]interface{}) error {
+	start, has_start := meta_data["settlement_start_time"].(float64)
+	end, has_end := meta_data["settlement_end_time"].(float64)
+	if created_at.IsZero() {
+		if expiry != 0 || has_start || has_end {
+			return fmt.Errorf("trade timestamp missing")
+		}
+	} else {
+		if has_start && created_at.Unix() < int64(start) {
+			return fmt.Errorf("trade timestamp before settlement window")
+		}
+		if has_end && created_at.Unix() > int64(end) {
+			return fmt.Errorf("trade timestamp after settlement window")
+		}
+	}
+	if expiry == 0 {
+		if require, _ := meta_data["require_order_expiry"].(bool); require {
+			return fmt.Errorf("order expiry missing")
+		}
+		return nil
+	}
+	if created_at.Unix() > int64(expiry) {
+		return fmt.Errorf("order expired")
+	}
+	return nil
+}
+
+// GetRoyaltyAmount applies the collection's whole-number royalty percentage to the buy amount,
+// rounding down so the buyer never pays more than the signed percentage.
+func GetRoyaltyAmount(buy_amount *big.Int, royalty_percentage interface{}) (*big.Int, error) {
+	percentage, ok := new(big.Int).SetString(fmt.Sprint(royalty_percentage), 10)
+	if !ok || percentage.Sign() < 0 || percentage.Cmp(big.NewInt(100)) > 0 {
+		return nil, fmt.Errorf("invalid royalty percentage %v", royalty_percentage)
+	}
+	royalty := new(big.Int).Mul(buy_amount, percentage)
+	return royalty.Quo(royalty, big.NewInt(100)), nil
+}
+
+// GetNumeFees returns the fee the schedule in meta_data requires for a transaction type. Every fee is paid in
+// fee_currency_token, so every schedule value is an amount of that token: nume_token_fee_map is keyed by the
+// transferred currency and nume_nft_fee_map by type, but both give the fee in fee_currency_token and are scaled
+// to its decimals. When meta_data names the currency of the schedule in nume_fee_currency it must be the fee
+// currency. Types without a schedule entry are free.
+func GetNumeFees(meta_data map[string]interface{}, tx_type string, currency string) (*big.Int, error) {
+	fee_currency := meta_data["fee_currency_token"].(string)
+	if schedule_currency, ok := meta_data["nume_fee_currency"].(string); ok && !strings.EqualFold(schedule_currency, fee_currency) {
+		return nil, fmt.Errorf("nume fee schedule is in %s but fees are paid in %s", schedule_currency, fee_currency)
+	}
+	fee := ""
+	switch tx_type {
+	case "transfer":
+		fee_map, _ := meta_data["nume_token_fee_map"].(map[string]interface{})
+		for k, v := range fee_map {
+			if strings.EqualFold(k, currency) {
+				fee, _ = v.(string)
+				break
+			}
+		}
+		if fee == "" {
+			return nil, fmt.Errorf("no nume fee configured for currency %s", currency)
+		}
+	case "nft_transfer", "nft_mint", "nft_trade", "collection_offer":
+		fee_map, _ := meta_data["nume_nft_fee_map"].(map[string]interface{})
+		fee, _ = fee_map[tx_type].(string)
+		if fee == "" && tx_type == "collection_offer" {
+			fee, _ = fee_map["nft_trade"].(string)
+		}
+		if fee == "" {
+			return nil, fmt.Errorf("no nume fee configured for %s", tx_type)
+		}
+	default:
+		return big.NewInt(0), nil
+	}
+	return ParseDecimalAmount(fee, GetCurrencyDecimals(meta_data, fee_currency))
+}
+
+// GetCurrencyDecimals reads the token decimals from meta_data["currency_decimals"], defaulting to 18.
+func GetCurrencyDecimals(meta_data map[string]interface{}, currency string) int {
+	decimals_map, _ := meta_data["currency_decimals"].(map[string]interface{})
+	for k, v := range decimals_map {
+		if strings.EqualFold(k, currency) {
+			if d, ok := v.(float64); ok {
+				return int(d)
+			}
+		}
+	}
+	return 18
+}
+
+// ParseDecimalAmount converts a decimal string such as "0.05" to base units of a token with the given decimals.
+func ParseDecimalAmount(amount string, decimals int) (*big.Int, error) {
+	parts := strings.Split(amount, ".")
+	if len(parts) > 2 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid decimal amount %s", amount)
+	}
+	fraction := ""
+	if len(parts) == 2 {
+		fraction = strings.TrimRight(parts[1], "0")
+	}
+	if len(fraction) > decimals {
+		return nil, fmt.Errorf("amount %s has more than %d decimals", amount, decimals)
+	}
+	value, ok := new(big.Int).SetString(parts[0]+fraction+strings.Repeat("0", decimals-len(fraction)), 10)
+	if !ok || value.Sign() < 0 {
+		return nil, fmt.Errorf("invalid decimal amount %s", amount)
+	}
+	return value, nil
+}
+
+func AddToAmount(amounts map[string]string, key string, amount *big.Int) {
+	current, ok := new(big.Int).SetString(amounts[key], 10)
+	if !ok {
+		current = big.NewInt(0)
+	}
+	amounts[key] = new(big.Int).Add(current, amount).String()
 }
 
 func DeductFees(state_balances map[string]map[string]string, sender string, fee_currency_token string, fees *big.Int, receiver string) (map[string]map[string]string, error) {
@@ -1,7 +1,16 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 type CheckNonceData struct {
@@ -40,11 +49,14 @@ func TestTransitionState(t *testing.T) {
 	for k, v := range input_data.MetaData["old_users_nonce"].(map[string]interface{}) {
 		user_nonce_tracker[k] = uint64(v.(float64))
 	}
-	new_balances, _, _, err := TransitionState(input_data.OldUserBalances, input_data.Transactions, currencies, append(input_data.OldNftCollections, input_data.NewNftCollections...), input_data.UserListerNonce, input_data.MetaData, user_nonce_tracker)
+	new_balances, _, _, nume_fees_collected, err := TransitionState(input_data.OldUserBalances, input_data.Transactions, currencies, append(input_data.OldNftCollections, input_data.NewNftCollections...), input_data.UserListerNonce, input_data.MetaData, user_nonce_tracker)
 	if err != nil {
 		t.Errorf("Error in TransitionState " + err.Error())
 		return
 	}
+	if nume_fees_collected["0xEe146Fac7b2fce5FdBE31C36d89cF92f6b006F80"] != "1100000000000000000" {
+		t.Errorf("Expected 1100000000000000000 nume fees collected, got %s", nume_fees_collected["0xEe146Fac7b2fce5FdBE31C36d89cF92f6b006F80"])
+	}
 	for _, v := range input_data.MetaData["users_ordered"].([]interface{}) {
 		if _, ok := new_balances[v.(string)]; !ok {
 			new_balances[v.(string)] = make(map[string]string)
@@ -64,3 +76,764 @@ func TestTransitionState(t *testing.T) {
 	}
 
 }
+
+func TestParseDecimalAmount(t *testing.T) {
+	tests := []struct {
+		amount   string
+		decimals int
+		expected string
+		valid    bool
+	}{
+		{"0.05", 18, "50000000000000000", true},
+		{"0.30", 6, "300000", true},
+		{"12", 6, "12000000", true},
+		{"0.0000001", 6, "", false},
+		{"1.2.3", 18, "", false},
+		{"-1", 18, "", false},
+	}
+	for _, test := range tests {
+		value, err := ParseDecimalAmount(test.amount, test.decimals)
+		if (err == nil) != test.valid {
+			t.Errorf("ParseDecimalAmount(%s, %d) error = %v, want valid %t", test.amount, test.decimals, err, test.valid)
+			continue
+		}
+		if test.valid && value.String() != test.expected {
+			t.Errorf("ParseDecimalAmount(%s, %d) = %s, want %s", test.amount, test.decimals, value.String(), test.expected)
+		}
+	}
+}
+
+func TestGetNumeFees(t *testing.T) {
+	input_data, _, err := GetData("./test_data")
+	if err != nil {
+		t.Errorf("Error in GetData " + err.Error())
+		return
+	}
+	fees, err := GetNumeFees(input_data.MetaData, "transfer", "0xe9573b8a0af951431bcbd194e8cc3aee654cd723")
+	if err != nil || fees.String() != "50000000000000000" {
+		t.Errorf("Expected 50000000000000000 transfer fee, got %v %v", fees, err)
+	}
+	fees, err = GetNumeFees(input_data.MetaData, "nft_trade", "")
+	if err != nil || fees.String() != "300000000000000000" {
+		t.Errorf("Expected 300000000000000000 trade fee, got %v %v", fees, err)
+	}
+	fees, err = GetNumeFees(input_data.MetaData, "withdrawal", "")
+	if err != nil || fees.Sign() != 0 {
+		t.Errorf("Expected no withdrawal fee, got %v %v", fees, err)
+	}
+	_, err = GetNumeFees(input_data.MetaData, "transfer", "0x0000000000000000000000000000000000000001")
+	if err == nil {
+		t.Errorf("Expected error for currency without fee")
+	}
+	input_data.MetaData["nume_fee_currency"] = "0xe9573b8a0af951431bcbd194e8cc3aee654cd723"
+	if _, err = GetNumeFees(input_data.MetaData, "nft_trade", ""); err == nil {
+		t.Errorf("Expected error for a schedule in another currency than the fee currency")
+	}
+	input_data.MetaData["nume_fee_currency"] = "0xee146fac7b2fce5fdbe31c36d89cf92f6b006f80"
+	if _, err = GetNumeFees(input_data.MetaData, "nft_trade", ""); err != nil {
+		t.Errorf("Expected the schedule in the fee currency to be accepted got %v", err)
+	}
+}
+
+func TestTransitionStateRejectsNumeFeesMismatch(t *testing.T) {
+	// transaction numbers in test_data of a transfer, an nft_transfer, an nft_mint and an nft_trade
+	for _, number := range []int{13, 18, 9, 29} {
+		input_data, _, err := GetData("./test_data")
+		if err != nil {
+			t.Errorf("Error reading test data " + err.Error())
+			return
+		}
+		tx := input_data.Transactions[number-1].(map[string]interface{})
+		fees, _ := new(big.Int).SetString(tx["NumeFees"].(string), 10)
+		tx["NumeFees"] = new(big.Int).Add(fees, big.NewInt(1)).String()
+		_, _, _, err = transitionTestData(input_data, nil)
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("nume fees mismatch for transaction number %d", number)) {
+			t.Errorf("Expected a nume fees mismatch for %s transaction number %d got %v", tx["Type"], number, err)
+		}
+	}
+
+	buyer, buyer_address := newTestAccount()
+	seller, seller_address := newTestAccount()
+	state_balances := map[string]map[string]string{
+		buyer_address:  {testFeeCurrency: "1000000000000000000", testTradeCurrency: "1000"},
+		seller_address: {testNftContract + "-1": "yes"},
+	}
+	nft_collections := []map[string]interface{}{
+		{"ContractAddress": testNftContract, "Owner": seller_address, "RoyaltyFeesPercetage": "10"},
+	}
+	offer := newCollectionOfferFill(seller, seller_address, buyer, buyer_address, "1", 1)
+	offer["NumeFees"] = "200000000000000000"
+	_, _, _, _, err := TransitionState(state_balances, []interface{}{offer}, []string{}, nft_collections, map[string]*NonceSet{}, newTestMetaData(), map[string]uint64{})
+	if err == nil || !strings.Contains(err.Error(), "nume fees mismatch") {
+		t.Errorf("Expected a nume fees mismatch for a collection offer got %v", err)
+	}
+}
+
+func TestGetRoyaltyAmount(t *testing.T) {
+	tests := []struct {
+		buy_amount string
+		percentage interface{}
+		expected   string
+		valid      bool
+	}{
+		{"222", "10", "22", true},
+		{"1000", "0", "0", true},
+		{"999", "5", "49", true},
+		{"1000", "101", "", false},
+		{"1000", "abc", "", false},
+	}
+	for _, test := range tests {
+		buy_amount, _ := new(big.Int).SetString(test.buy_amount, 10)
+		royalty, err := GetRoyaltyAmount(buy_amount, test.percentage)
+		if (err == nil) != test.valid {
+			t.Errorf("GetRoyaltyAmount(%s, %v) error = %v, want valid %t", test.buy_amount, test.percentage, err, test.valid)
+			continue
+		}
+		if test.valid && royalty.String() != test.expected {
+			t.Errorf("GetRoyaltyAmount(%s, %v) = %s, want %s", test.buy_amount, test.percentage, royalty.String(), test.expected)
+		}
+	}
+}
+
+func signTestMessage(key *ecdsa.PrivateKey, message string) string {
+	hash := crypto.Keccak256Hash([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(message), message)))
+	sig, _ := crypto.Sign(hash.Bytes(), key)
+	sig[crypto.RecoveryIDOffset] += 27
+	return "0x" + hex.EncodeToString(sig)
+}
+
+func newTestAccount() (*ecdsa.PrivateKey, string) {
+	key, _ := crypto.GenerateKey()
+	return key, strings.ToLower(crypto.PubkeyToAddress(key.PublicKey).Hex())
+}
+
+const (
+	testFeeCurrency   = "0xEe146Fac7b2fce5FdBE31C36d89cF92f6b006F80"
+	testTradeCurrency = "0xE9573B8A0AF951431bcBD194E8cc3AeE654Cd723"
+	testNftContract   = "0xedb6375347e060b055d6af9842ba8c55e3d93e3a"
+	testNumeUser      = "0x25c51feecefe36a630c3152712f269affc93b66b"
+)
+
+func newTestMetaData() map[string]interface{} {
+	return map[string]interface{}{
+		"nume_user":          testNumeUser,
+		"fee_currency_token": testFeeCurrency,
+		"nume_nft_fee_map": map[string]interface{}{
+			"nft_mint":     "0.10",
+			"nft_trade":    "0.30",
+			"nft_transfer": "0.05",
+		},
+		"nume_token_fee_map": map[string]interface{}{
+			testFeeCurrency:   "0.05",
+			testTradeCurrency: "0.05",
+		},
+	}
+}
+
+func newCollectionOfferFill(seller *ecdsa.PrivateKey, seller_address string, buyer *ecdsa.PrivateKey, buyer_address string, token_id string, seller_nonce uint) map[string]interface{} {
+	offer_message := CollectionOfferMessage(buyer_address, testNftContract, testTradeCurrency, "100", "2", "7", 1700000000)
+	accept_message := NftTradeMessageWithExpiry(seller_address, testNftContract, token_id, testTradeCurrency, "90", fmt.Sprint(seller_nonce), 2, 1690000000)
+	return map[string]interface{}{
+		"Id":                 float64(1),
+		"Type":               "collection_offer",
+		"From":               seller_address,
+		"To":                 buyer_address,
+		"ListAmount":         "90",
+		"BuyAmount":          "100",
+		"Currency":           testTradeCurrency,
+		"NftTokenId":         token_id,
+		"NftContractAddress": testNftContract,
+		"ListSignature":      signTestMessage(seller, accept_message),
+		"BuySignature":       signTestMessage(buyer, offer_message),
+		"RoyaltyAmount":      "10",
+		"NumeFees":           "300000000000000000",
+		"L2Minted":           false,
+		"OfferNonce":         float64(7),
+		"OfferQuantity":      float64(2),
+		"SellerNonce":        float64(seller_nonce),
+		"ListExpiry":         float64(1690000000),
+		"BuyExpiry":          float64(1700000000),
+		"CreatedAt":          "2023-06-21T11:31:45.875228+05:30",
+	}
+}
+
+func TestTransitionStateCollectionOffer(t *testing.T) {
+	buyer, buyer_address := newTestAccount()
+	seller, seller_address := newTestAccount()
+	_, owner_address := newTestAccount()
+	state_balances := map[string]map[string]string{
+		buyer_address: {
+			testFeeCurrency:   "1000000000000000000",
+			testTradeCurrency: "1000",
+		},
+		seller_address: {
+			testNftContract + "-1": "yes",
+			testNftContract + "-2": "yes",
+			testNftContract + "-3": "yes",
+		},
+	}
+	nft_collections := []map[string]interface{}{
+		{"ContractAddress": testNftContract, "Owner": owner_address, "RoyaltyFeesPercetage": "10"},
+	}
+	transactions := []interface{}{
+		newCollectionOfferFill(seller, seller_address, buyer, buyer_address, "1", 1),
+		newCollectionOfferFill(seller, seller_address, buyer, buyer_address, "2", 2),
+	}
+	used_lister_nonce := map[string]*NonceSet{}
+	user_nonce_tracker := map[string]uint64{}
+	new_balances, _, _, _, err := TransitionState(CopyMap(state_balances), transactions[:1], []string{}, nft_collections, used_lister_nonce, newTestMetaData(), user_nonce_tracker)
+	if err != nil {
+		t.Errorf("Error in TransitionState " + err.Error())
+		return
+	}
+	// the second fill lands in a later batch and must see the first one
+	new_balances, _, _, _, err = TransitionState(new_balances, transactions[1:], []string{}, nft_collections, used_lister_nonce, newTestMetaData(), user_nonce_tracker)
+	if err != nil {
+		t.Errorf("Error in TransitionState " + err.Error())
+		return
+	}
+	if new_balances[buyer_address][testTradeCurrency] != "800" {
+		t.Errorf("Expected buyer balance 800, got %s", new_balances[buyer_address][testTradeCurrency])
+	}
+	if new_balances[seller_address][testTradeCurrency] != "180" {
+		t.Errorf("Expected seller balance 180, got %s", new_balances[seller_address][testTradeCurrency])
+	}
+	if new_balances[owner_address][testTradeCurrency] != "20" {
+		t.Errorf("Expected royalty 20, got %s", new_balances[owner_address][testTradeCurrency])
+	}
+	if new_balances[buyer_address][testNftContract+"-2"] != "yes" {
+		t.Errorf("Expected buyer to own token 2")
+	}
+	if used_lister_nonce[buyer_address].Len() != 0 {
+		t.Errorf("Expected no lister nonce to be used by the offer, got %v", used_lister_nonce[buyer_address].Nonces())
+	}
+	if used_lister_nonce[buyer_address].OfferFills(7) != 2 {
+		t.Errorf("Expected offer 7 to be filled twice, got %d", used_lister_nonce[buyer_address].OfferFills(7))
+	}
+
+	third_fill := []interface{}{newCollectionOfferFill(seller, seller_address, buyer, buyer_address, "3", 3)}
+	_, _, _, _, err = TransitionState(new_balances, third_fill, []string{}, nft_collections, used_lister_nonce, newTestMetaData(), user_nonce_tracker)
+	if err == nil {
+		t.Errorf("Expected error when filling an offer beyond its quantity in a later batch")
+	}
+	transactions = append(transactions, third_fill...)
+	_, _, _, _, err = TransitionState(CopyMap(state_balances), transactions, []string{}, nft_collections, map[string]*NonceSet{}, newTestMetaData(), map[string]uint64{})
+	if err == nil {
+		t.Errorf("Expected error when filling an offer beyond its quantity")
+	}
+}
+
+func newNftTrade(seller *ecdsa.PrivateKey, seller_address string, buyer *ecdsa.PrivateKey, buyer_address string, currency string, buy_amount string, royalty_amount string) map[string]interface{} {
+	list_message := NftTradeMessage(seller_address, testNftContract, "1", currency, buy_amount, "1", 0)
+	buy_message := NftTradeMessage(buyer_address, testNftContract, "1", currency, buy_amount, "1", 1)
+	return map[string]interface{}{
+		"Id":                 float64(1),
+		"Type":               "nft_trade",
+		"From":               seller_address,
+		"To":                 buyer_address,
+		"ListAmount":         buy_amount,
+		"BuyAmount":          buy_amount,
+		"Currency":           currency,
+		"NftTokenId":         "1",
+		"NftContractAddress": testNftContract,
+		"ListSignature":      signTestMessage(seller, list_message),
+		"BuySignature":       signTestMessage(buyer, buy_message),
+		"RoyaltyAmount":      royalty_amount,
+		"NumeFees":           "300000000000000000",
+		"L2Minted":           false,
+		"ListerNonce":        float64(1),
+		"BuyerNonce":         float64(1),
+		"CreatedAt":          "2023-06-21T11:31:45.875228+05:30",
+	}
+}
+
+func TestTransitionStateRoyalty(t *testing.T) {
+	buyer, buyer_address := newTestAccount()
+	seller, seller_address := newTestAccount()
+	_, owner_address := newTestAccount()
+	state_balances := map[string]map[string]string{
+		buyer_address: {
+			testFeeCurrency:   "1000000000000000000",
+			testTradeCurrency: "1000",
+		},
+		seller_address: {
+			testNftContract + "-1": "yes",
+		},
+	}
+	nft_collections := []map[string]interface{}{
+		{"ContractAddress": testNftContract, "Owner": owner_address, "RoyaltyFeesPercetage": "5"},
+	}
+	// floor(999 * 5 / 100) = 49 goes to the owner, the seller gets the remaining 950
+	transactions := []interface{}{newNftTrade(seller, seller_address, buyer, buyer_address, testTradeCurrency, "999", "49")}
+	new_balances, _, _, _, err := TransitionState(CopyMap(state_balances), transactions, []string{}, nft_collections, map[string]*NonceSet{}, newTestMetaData(), map[string]uint64{})
+	if err != nil {
+		t.Errorf("Error in TransitionState " + err.Error())
+		return
+	}
+	if new_balances[owner_address][testTradeCurrency] != "49" {
+		t.Errorf("Expected royalty 49, got %s", new_balances[owner_address][testTradeCurrency])
+	}
+	if new_balances[seller_address][testTradeCurrency] != "950" {
+		t.Errorf("Expected seller balance 950, got %s", new_balances[seller_address][testTradeCurrency])
+	}
+	if new_balances[buyer_address][testTradeCurrency] != "1" {
+		t.Errorf("Expected buyer balance 1, got %s", new_balances[buyer_address][testTradeCurrency])
+	}
+
+	for _, royalty := range []string{"50", "48", "0"} {
+		transactions := []interface{}{newNftTrade(seller, seller_address, buyer, buyer_address, testTradeCurrency, "999", royalty)}
+		_, _, _, _, err := TransitionState(CopyMap(state_balances), transactions, []string{}, nft_collections, map[string]*NonceSet{}, newTestMetaData(), map[string]uint64{})
+		if err == nil || !strings.Contains(err.Error(), "royalty mismatch") {
+			t.Errorf("Expected a royalty mismatch for royalty %s got %v", royalty, err)
+		}
+	}
+}
+
+func TestTransitionStateNativeCurrency(t *testing.T) {
+	buyer, buyer_address := newTestAccount()
+	seller, seller_address := newTestAccount()
+	_, owner_address := newTestAccount()
+	meta_data := newTestMetaData()
+	meta_data["fee_currency_token"] = NativeCurrency
+	state_balances := map[string]map[string]string{
+		seller_address: {
+			testNftContract + "-1": "yes",
+		},
+	}
+	nft_collections := []map[string]interface{}{
+		{"ContractAddress": testNftContract, "Owner": owner_address, "RoyaltyFeesPercetage": "10"},
+	}
+	deposit := map[string]interface{}{
+		"Id":                           float64(1),
+		"From":                         "deposit.From",
+		"To":                           buyer_address,
+		"AmountOrNftTokenId":           "1000000000000000000",
+		"Nonce":                        float64(0),
+		"CurrencyOrNftContractAddress": NativeCurrency,
+		"Type":                         "deposit",
+		"Data":                         "",
+		"Signature":                    "",
+		"IsInvalid":                    false,
+		"L2Minted":                     false,
+		"NumeFees":                     "0",
+		"MintFees":                     "",
+		"MintFeesToken":                "",
+	}
+	// the trade is settled and its nume fee paid in the native currency
+	transactions := []interface{}{deposit, newNftTrade(seller, seller_address, buyer, buyer_address, NativeCurrency, "500000000000000000", "50000000000000000")}
+	new_balances, _, _, nume_fees_collected, err := TransitionState(CopyMap(state_balances), transactions, []string{}, nft_collections, map[string]*NonceSet{}, meta_data, map[string]uint64{})
+	if err != nil {
+		t.Errorf("Error in TransitionState " + err.Error())
+		return
+	}
+	expected := map[string]string{
+		buyer_address:  "200000000000000000",
+		seller_address: "450000000000000000",
+		owner_address:  "50000000000000000",
+		testNumeUser:   "300000000000000000",
+	}
+	for user, balance := range expected {
+		if new_balances[user][NativeCurrency] != balance {
+			t.Errorf("Expected native balance %s for %s got %s", balance, user, new_balances[user][NativeCurrency])
+		}
+	}
+	if nume_fees_collected[NativeCurrency] != "300000000000000000" {
+		t.Errorf("Expected the nume fee collected in the native currency got %v", nume_fees_collected)
+	}
+	if new_balances[buyer_address][testNftContract+"-1"] != "yes" {
+		t.Errorf("Expected the buyer to own token 1")
+	}
+	_, _, ctype, _ := GetBalanceLeafFields(NativeCurrency, new_balances[buyer_address][NativeCurrency])
+	if ctype != "2" {
+		t.Errorf("Expected the native balance leaf type 2 got %s", ctype)
+	}
+}
+
+func TestCheckOrderExpiry(t *testing.T) {
+	created_at, _ := time.Parse(time.RFC3339Nano, "2023-06-21T11:31:45.875228+05:30")
+	window := map[string]interface{}{
+		"settlement_start_time": float64(created_at.Unix() - 60),
+		"settlement_end_time":   float64(created_at.Unix() + 60),
+	}
+	tests := []struct {
+		created_at time.Time
+		expiry     uint64
+		meta_data  map[string]interface{}
+		valid      bool
+	}{
+		{created_at, 0, map[string]interface{}{}, true},
+		{created_at, 0, map[string]interface{}{"require_order_expiry": true}, false},
+		{created_at, uint64(created_at.Unix()), map[string]interface{}{}, true},
+		{created_at, uint64(created_at.Unix() - 1), map[string]interface{}{}, false},
+		{time.Time{}, uint64(created_at.Unix()), map[string]interface{}{}, false},
+		{created_at, 0, window, true},
+		{created_at.Add(-2 * time.Minute), 0, window, false},
+		{created_at.Add(2 * time.Minute), 0, window, false},
+	}
+	for i, test := range tests {
+		err := CheckOrderExpiry(test.created_at, test.expiry, test.meta_data)
+		if (err == nil) != test.valid {
+			t.Errorf("CheckOrderExpiry case %d error = %v, want valid %t", i, err, test.valid)
+		}
+	}
+}
+
+func newCancelListing(key *ecdsa.PrivateKey, address string, nonce uint, lister_nonces []uint, below_nonce uint) map[string]interface{} {
+	nonces := []interface{}{}
+	for _, n := range lister_nonces {
+		nonces = append(nonces, float64(n))
+	}
+	return map[string]interface{}{
+		"Id":                           float64(1),
+		"Type":                         "cancel_listing",
+		"From":                         address,
+		"To":                           address,
+		"AmountOrNftTokenId":           "0",
+		"Nonce":                        float64(nonce),
+		"CurrencyOrNftContractAddress": "",
+		"Signature":                    signTestMessage(key, CancelListingMessage(address, nonce, lister_nonces, below_nonce)),
+		"IsInvalid":                    false,
+		"L2Minted":                     false,
+		"Data":                         "",
+		"NumeFees":                     "0",
+		"MintFees":                     "",
+		"MintFeesToken":                "",
+		"ListerNonces":                 nonces,
+		"CancelBelowNonce":             float64(below_nonce),
+	}
+}
+
+func TestTransitionStateCancelListing(t *testing.T) {
+	lister, lister_address := newTestAccount()
+	used_lister_nonce := map[string]*NonceSet{lister_address: {}}
+	used_lister_nonce[lister_address].Add(4)
+	transactions := []interface{}{
+		newCancelListing(lister, lister_address, 1, []uint{9, 6}, 0),
+		newCancelListing(lister, lister_address, 2, []uint{}, 4),
+	}
+	_, _, users_updated_map, _, err := TransitionState(map[string]map[string]string{}, transactions, []string{}, []map[string]interface{}{}, used_lister_nonce, newTestMetaData(), map[string]uint64{})
+	if err != nil {
+		t.Errorf("Error in TransitionState " + err.Error())
+		return
+	}
+	expected := []uint{1, 2, 3, 4, 6, 9}
+	if !reflect.DeepEqual(used_lister_nonce[lister_address].Nonces(), expected) {
+		t.Errorf("Expected used lister nonces %v, got %v", expected, used_lister_nonce[lister_address].Nonces())
+	}
+	if !users_updated_map[lister_address] {
+		t.Errorf("Expected lister to be marked as updated")
+	}
+	if !reflect.DeepEqual(used_lister_nonce[lister_address].Optimized(), []uint{0, 4, 6, 9}) {
+		t.Errorf("Expected optimized nonce [0 4 6 9], got %v", used_lister_nonce[lister_address].Optimized())
+	}
+
+	_, other_address := newTestAccount()
+	forged := newCancelListing(lister, other_address, 1, []uint{1}, 0)
+	_, _, _, _, err = TransitionState(map[string]map[string]string{}, []interface{}{forged}, []string{}, []map[string]interface{}{}, map[string]*NonceSet{}, newTestMetaData(), map[string]uint64{})
+	if err == nil {
+		t.Errorf("Expected error for cancel listing not signed by the lister")
+	}
+}
+
+func newNftDeposit(to string, token_id string) map[string]interface{} {
+	return map[string]interface{}{
+		"Id":                           float64(1),
+		"Type":                         "nft_deposit",
+		"From":                         "nft_deposit.From",
+		"To":                           to,
+		"AmountOrNftTokenId":           token_id,
+		"Nonce":                        float64(0),
+		"CurrencyOrNftContractAddress": testNftContract,
+		"Signature":                    "nft_deposit.Signature",
+		"IsInvalid":                    false,
+		"L2Minted":                     false,
+		"Data":                         "nft_deposit.Message",
+		"NumeFees":                     "0",
+		"MintFees":                     "",
+		"MintFeesToken":                "",
+	}
+}
+
+func TestBuildNftOwnerIndex(t *testing.T) {
+	nft_owners, err := BuildNftOwnerIndex(map[string]map[string]string{
+		"0xa": {testFeeCurrency: "1", testNftContract + "-1": "yes"},
+		"0xb": {"0x" + strings.ToUpper(testNftContract[2:]) + "-2": "l2_minted"},
+	})
+	if err != nil {
+		t.Errorf("Error building index " + err.Error())
+		return
+	}
+	if nft_owners[NftKey(testNftContract, "1")] != "0xa" || len(nft_owners) != 2 {
+		t.Errorf("Unexpected index %v", nft_owners)
+	}
+	_, err = BuildNftOwnerIndex(map[string]map[string]string{
+		"0xa": {testNftContract + "-1": "yes"},
+		"0xb": {testNftContract + "-1": "yes"},
+	})
+	if err == nil {
+		t.Errorf("Expected error for an nft held by two users")
+	}
+}
+
+func TestTransitionStateNftOwnership(t *testing.T) {
+	_, first_address := newTestAccount()
+	_, second_address := newTestAccount()
+	transactions := []interface{}{newNftDeposit(first_address, "1"), newNftDeposit(second_address, "1")}
+	_, _, _, _, err := TransitionState(map[string]map[string]string{}, transactions, []string{}, []map[string]interface{}{}, map[string]*NonceSet{}, newTestMetaData(), map[string]uint64{})
+	if err == nil {
+		t.Errorf("Expected error when depositing an nft that is already held")
+	}
+
+	buyer, buyer_address := newTestAccount()
+	seller, seller_address := newTestAccount()
+	_, owner_address := newTestAccount()
+	state_balances := map[string]map[string]string{
+		buyer_address:  {testFeeCurrency: "1000000000000000000", testTradeCurrency: "1000"},
+		seller_address: {testNftContract + "-2": "yes"},
+	}
+	nft_collections := []map[string]interface{}{
+		{"ContractAddress": testNftContract, "Owner": owner_address, "RoyaltyFeesPercetage": "10"},
+	}
+	transactions = []interface{}{newCollectionOfferFill(seller, seller_address, buyer, buyer_address, "1", 1)}
+	_, _, _, _, err = TransitionState(state_balances, transactions, []string{}, nft_collections, map[string]*NonceSet{}, newTestMetaData(), map[string]uint64{})
+	if err == nil {
+		t.Errorf("Expected error when selling an nft the seller does not own")
+	}
+}
+
+func TestIsMintAllowed(t *testing.T) {
+	users := []string{
+		"0x46714661eecb6f07065dcb4bf3d9b772dcefa63a",
+		"0xccff350ef46b85228d6650a802107e58bf6a32ab",
+		"0xe9e2d5240237955f5955c28cd9ee9d5f66800cf1",
+		"0x1111111111111111111111111111111111111111",
+	}
+	leaves := [][]byte{}
+	for _, user := range users {
+		leaves = append(leaves, MintAllowlistLeaf(user))
+	}
+	tree := NewMerkleTreeSync(leaves)
+	proof_bytes, _ := tree.Proof(2)
+	proof := []string{}
+	for _, p := range proof_bytes {
+		proof = append(proof, hex.EncodeToString(p))
+	}
+	root_collection := map[string]interface{}{"MintUsersRoot": "0x" + hex.EncodeToString(tree.Root)}
+	list_collection := map[string]interface{}{"MintUsers": []interface{}{users[0], users[1]}}
+	tests := []struct {
+		collection map[string]interface{}
+		user       string
+		proof      []string
+		index      uint
+		allowed    bool
+	}{
+		{root_collection, users[2], proof, 2, true},
+		{root_collection, strings.ToUpper(users[2][2:]), proof, 2, true},
+		{root_collection, users[2], proof, 3, false},
+		{root_collection, users[1], proof, 2, false},
+		{root_collection, users[2], []string{}, 0, false},
+		{list_collection, strings.ToUpper(users[1]), nil, 0, true},
+		{list_collection, users[2], nil, 0, false},
+		{map[string]interface{}{"MintUsers": []interface{}{}}, users[2], nil, 0, true},
+	}
+	for i, test := range tests {
+		allowed, err := IsMintAllowed(test.collection, test.user, test.proof, test.index)
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %s", i, err.Error())
+			continue
+		}
+		if allowed != test.allowed {
+			t.Errorf("Test %d: expected %v got %v", i, test.allowed, allowed)
+		}
+	}
+	if _, err := IsMintAllowed(map[string]interface{}{"MintUsersRoot": "0x1234"}, users[0], nil, 0); err == nil {
+		t.Errorf("Expected error for a malformed mint users root")
+	}
+}
+
+func TestTransitionStateCollectionChanges(t *testing.T) {
+	owner, owner_address := newTestAccount()
+	_, new_owner_address := newTestAccount()
+	collection := map[string]interface{}{
+		"Owner":                owner_address,
+		"ContractAddress":      testNftContract,
+		"BaseUri":              "ipfs://old",
+		"MintStart":            "10",
+		"MintEnd":              "100",
+		"MintUsers":            []interface{}{},
+		"MintFees":             "1000",
+		"MintFeesToken":        testFeeCurrency,
+		"RoyaltyFeesPercetage": "10",
+	}
+	_, creation_message, _ := getCollectionHashes(collection)
+	collection["Signature"] = signTestMessage(owner, hex.EncodeToString(creation_message))
+	old_hash, _ := GetCollectionLeafHash(collection)
+	update := map[string]interface{}{
+		"Id":                           float64(1),
+		"Type":                         "collection_update",
+		"From":                         owner_address,
+		"To":                           "",
+		"AmountOrNftTokenId":           "",
+		"Nonce":                        float64(1),
+		"CurrencyOrNftContractAddress": testNftContract,
+		"Signature":                    signTestMessage(owner, CollectionUpdateMessage(owner_address, testNftContract, "ipfs://new", "5", "2000", testTradeCurrency, 1)),
+		"IsInvalid":                    false,
+		"L2Minted":                     false,
+		"Data":                         "",
+		"NumeFees":                     "0",
+		"MintFees":                     "2000",
+		"MintFeesToken":                testTradeCurrency,
+		"BaseUri":                      "ipfs://new",
+		"RoyaltyFeesPercetage":         "5",
+	}
+	transfer := map[string]interface{}{
+		"Id":                           float64(2),
+		"Type":                         "collection_transfer",
+		"From":                         owner_address,
+		"To":                           new_owner_address,
+		"AmountOrNftTokenId":           "",
+		"Nonce":                        float64(2),
+		"CurrencyOrNftContractAddress": testNftContract,
+		"Signature":                    signTestMessage(owner, CollectionTransferMessage(owner_address, testNftContract, new_owner_address, 2)),
+		"IsInvalid":                    false,
+		"L2Minted":                     false,
+		"Data":                         "",
+		"NumeFees":                     "0",
+		"MintFees":                     "",
+		"MintFeesToken":                "",
+	}
+	nft_collections := []map[string]interface{}{collection}
+	_, _, users_updated_map, _, err := TransitionState(map[string]map[string]string{}, []interface{}{update, transfer}, []string{}, nft_collections, map[string]*NonceSet{}, newTestMetaData(), map[string]uint64{})
+	if err != nil {
+		t.Errorf("Error in transition state " + err.Error())
+		return
+	}
+	if collection["Owner"] != owner_address || collection["BaseUri"] != "ipfs://old" {
+		t.Errorf("Expected the caller's collection to stay untouched %v", collection)
+	}
+	collection = nft_collections[0]
+	if collection["Owner"] != new_owner_address || collection["BaseUri"] != "ipfs://new" || collection["RoyaltyFeesPercetage"] != "5" || collection["MintFees"] != "2000" {
+		t.Errorf("Collection not updated %v", collection)
+	}
+	if !users_updated_map[owner_address] {
+		t.Errorf("Expected owner nonce to be updated")
+	}
+	new_hash, _ := GetCollectionLeafHash(collection)
+	if hex.EncodeToString(new_hash) == hex.EncodeToString(old_hash) {
+		t.Errorf("Expected collection leaf hash to change")
+	}
+	// the next batch loads the changed collection and checks it against its recorded changes
+	verified_hash, err := VerifyCollectionData(collection)
+	if err != nil || hex.EncodeToString(verified_hash) != hex.EncodeToString(new_hash) {
+		t.Errorf("Expected the changed collection to verify got %v", err)
+	}
+	tampered := map[string]interface{}{}
+	for k, v := range collection {
+		tampered[k] = v
+	}
+	tampered["RoyaltyFeesPercetage"] = "50"
+	if _, err := VerifyCollectionData(tampered); err == nil {
+		t.Errorf("Expected error for a collection changed without a signed change")
+	}
+	changes := collection["Changes"].([]interface{})
+	tampered["RoyaltyFeesPercetage"] = collection["RoyaltyFeesPercetage"]
+	tampered["Changes"] = []interface{}{changes[0], changes[0], changes[1]}
+	if _, err := VerifyCollectionData(tampered); err == nil {
+		t.Errorf("Expected error for a replayed collection change")
+	}
+
+	// the previous owner can no longer change the collection
+	stale := map[string]interface{}{}
+	for k, v := range update {
+		stale[k] = v
+	}
+	stale["Nonce"] = float64(3)
+	stale["Signature"] = signTestMessage(owner, CollectionUpdateMessage(owner_address, testNftContract, "ipfs://new", "5", "2000", testTradeCurrency, 3))
+	_, _, _, _, err = TransitionState(map[string]map[string]string{}, []interface{}{stale}, []string{}, []map[string]interface{}{collection}, map[string]*NonceSet{}, newTestMetaData(), map[string]uint64{owner_address: 2})
+	if err == nil {
+		t.Errorf("Expected error when a previous owner updates the collection")
+	}
+	forged := map[string]interface{}{}
+	for k, v := range update {
+		forged[k] = v
+	}
+	forged["From"] = new_owner_address
+	forged["Signature"] = signTestMessage(owner, CollectionUpdateMessage(new_owner_address, testNftContract, "ipfs://new", "5", "2000", testTradeCurrency, 1))
+	_, _, _, _, err = TransitionState(map[string]map[string]string{}, []interface{}{forged}, []string{}, []map[string]interface{}{collection}, map[string]*NonceSet{}, newTestMetaData(), map[string]uint64{})
+	if err == nil {
+		t.Errorf("Expected error for an update not signed by the owner")
+	}
+}
+
+func TestCheckCWValidity(t *testing.T) {
+	user := "0x46714661eecb6f07065dcb4bf3d9b772dcefa63a"
+	state_balances := map[string]map[string]string{user: {testTradeCurrency: "100", testNftContract + "-1": "yes"}}
+	nft_owners, _ := BuildNftOwnerIndex(state_balances)
+	spent := map[string]map[string]bool{user: {testTradeCurrency: true, testNftContract + "-1": true}}
+	tests := []struct {
+		tx_type  string
+		asset    string
+		amount   string
+		spent    map[string]map[string]bool
+		expected bool
+	}{
+		{"contract_withdrawal", testTradeCurrency, "100", nil, true},
+		{"contract_withdrawal", testTradeCurrency, "101", nil, false},
+		{"contract_withdrawal", testFeeCurrency, "1", nil, false},
+		{"contract_withdrawal", testTradeCurrency, "1", spent, false},
+		{"nft_contract_withdrawal", testNftContract, "1", nil, true},
+		{"nft_contract_withdrawal", testNftContract, "2", nil, false},
+		{"nft_contract_withdrawal", testNftContract, "1", spent, false},
+	}
+	for i, test := range tests {
+		transaction := Transaction{Type: test.tx_type, From: user, To: user, CurrencyOrNftContractAddress: test.asset, AmountOrNftTokenId: test.amount}
+		if valid := CheckCWValidity(test.spent, state_balances, nft_owners, transaction); valid != test.expected {
+			t.Errorf("Test %d: expected %v got %v", i, test.expected, valid)
+		}
+	}
+
+	withdraw := func(tx_type string, asset string, amount string, is_invalid bool) map[string]interface{} {
+		return map[string]interface{}{
+			"Id":                           float64(1),
+			"From":                         user,
+			"To":                           user,
+			"AmountOrNftTokenId":           amount,
+			"Nonce":                        float64(0),
+			"CurrencyOrNftContractAddress": asset,
+			"Type":                         tx_type,
+			"Data":                         "",
+			"Signature":                    "",
+			"IsInvalid":                    is_invalid,
+			"L2Minted":                     false,
+			"NumeFees":                     "0",
+			"MintFees":                     "",
+			"MintFeesToken":                "",
+		}
+	}
+	batches := []struct {
+		transactions []interface{}
+		valid        bool
+	}{
+		// insufficient balance
+		{[]interface{}{withdraw("contract_withdrawal", testTradeCurrency, "101", false)}, false},
+		{[]interface{}{withdraw("contract_withdrawal", testTradeCurrency, "101", true)}, true},
+		// not owned
+		{[]interface{}{withdraw("nft_contract_withdrawal", testNftContract, "2", false)}, false},
+		{[]interface{}{withdraw("nft_contract_withdrawal", testNftContract, "2", true)}, true},
+		// spent earlier in the batch
+		{[]interface{}{withdraw("contract_withdrawal", testTradeCurrency, "60", false), withdraw("contract_withdrawal", testTradeCurrency, "60", false)}, false},
+		{[]interface{}{withdraw("contract_withdrawal", testTradeCurrency, "60", false), withdraw("contract_withdrawal", testTradeCurrency, "60", true)}, true},
+		{[]interface{}{withdraw("nft_contract_withdrawal", testNftContract, "1", false), withdraw("nft_contract_withdrawal", testNftContract, "1", false)}, false},
+		{[]interface{}{withdraw("nft_contract_withdrawal", testNftContract, "1", false), withdraw("nft_contract_withdrawal", testNftContract, "1", true)}, true},
+	}
+	for i, batch := range batches {
+		new_balances, _, _, _, err := TransitionState(CopyMap(state_balances), batch.transactions, []string{}, []map[string]interface{}{}, map[string]*NonceSet{}, newTestMetaData(), map[string]uint64{})
+		if (err == nil) != batch.valid {
+			t.Errorf("Batch %d: expected valid %v got %v", i, batch.valid, err)
+			continue
+		}
+		if err == nil && len(batch.transactions) == 1 && !NestedMapsEqual(new_balances, state_balances) {
+			t.Errorf("Batch %d: expected a withdrawal marked invalid to leave the balances untouched", i)
+		}
+	}
+}
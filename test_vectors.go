@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// TestVectorsVersion is bumped whenever a vector layout or one of the encodings it covers changes, so contract
+// tests importing an older suite fail loudly instead of silently passing.
+const TestVectorsVersion = 1
+
+type LeafHashVector struct {
+	Address             string    `json:"address"`
+	BalancesRoot        string    `json:"balancesRoot"`
+	Nonce               uint64    `json:"nonce"`
+	UsedListerNonce     *NonceSet `json:"usedListerNonce"`
+	UsedListerNonceHash string    `json:"usedListerNonceHash"`
+	Hash                string    `json:"hash"`
+}
+
+type BalanceLeafVector struct {
+	Asset                 string `json:"asset"`
+	Value                 string `json:"value"`
+	CurrencyOrNftContract string `json:"currencyOrNftContract"`
+	AmountOrNftTokenId    string `json:"amountOrNftTokenId"`
+	AssetType             string `json:"assetType"`
+	L2Minted              string `json:"l2Minted"`
+	Hash                  string `json:"hash"`
+}
+
+// QueueItemVector covers QueueItemHash and, when L2Minted is set, NftQueueItemHash.
+type QueueItemVector struct {
+	Address            string `json:"address"`
+	Currency           string `json:"currency"`
+	AmountOrNftTokenId string `json:"amountOrNftTokenId"`
+	L2Minted           *bool  `json:"l2Minted,omitempty"`
+	IsInvalid          bool   `json:"isInvalid,omitempty"`
+	Hash               string `json:"hash"`
+}
+
+// QueueVector is the hash of a whole queue. Contract withdrawals marked invalid enter it as a zero item.
+type QueueVector struct {
+	Type   string            `json:"type"`
+	Items  []QueueItemVector `json:"items"`
+	Length int               `json:"length"`
+	Hash   string            `json:"hash"`
+}
+
+type WithdrawalVector struct {
+	Withdrawals []QueueItemVector `json:"withdrawals"`
+	Hash        string            `json:"hash"`
+}
+
+type CollectionVector struct {
+	Collection json.RawMessage `json:"collection"`
+	Valid      bool            `json:"valid"`
+	Hash       string          `json:"hash"`
+}
+
+type MerkleNodeVector struct {
+	Left  string `json:"left"`
+	Right string `json:"right"`
+	Hash  string `json:"hash"`
+}
+
+type MerkleTreeVector struct {
+	Leaves []string `json:"leaves"`
+	Root   string   `json:"root"`
+}
+
+// SettlementVector is the full settlement of one data directory, up to the message the validators sign.
+type SettlementVector struct {
+	Name               string                `json:"name"`
+	PrevRoot           string                `json:"prevRoot"`
+	NewRoot            string                `json:"newRoot"`
+	PrevCollectionRoot string                `json:"prevCollectionRoot"`
+	NewCollectionRoot  string                `json:"newCollectionRoot"`
+	LeafSetHash        string                `json:"leafSetHash"`
+	PublicData         string                `json:"publicData"`
+	PublicDataHash     string                `json:"publicDataHash"`
+	Rejected           []RejectedTransaction `json:"rejectedTransactions,omitempty"`
+	Message            SettlementMessage     `json:"message"`
+	Encoded            string                `json:"encoded"`
+}
+
+type TestVectorSuite struct {
+	Version       int                 `json:"version"`
+	LeafHashes    []LeafHashVector    `json:"leafHashes"`
+	BalanceLeaves []BalanceLeafVector `json:"balanceLeaves"`
+	QueueItems    []QueueItemVector   `json:"queueItems"`
+	NftQueueItems []QueueItemVector   `json:"nftQueueItems"`
+	Queues        []QueueVector       `json:"queues"`
+	Withdrawals   []WithdrawalVector  `json:"withdrawals"`
+	Collections   []CollectionVector  `json:"collections"`
+	MerkleNodes   []MerkleNodeVector  `json:"merkleNodes"`
+	MerkleTrees   []MerkleTreeVector  `json:"merkleTrees"`
+	Settlements   []SettlementVector  `json:"settlements"`
+}
+
+func hexString(data []byte) string {
+	return "0x" + hex.EncodeToString(data)
+}
+
+// BuildTestVectors runs each data directory through the settlement code and records the inputs and outputs of
+// every hash the contract has to reproduce.
+func BuildTestVectors(data_dirs []string) (TestVectorSuite, error) {
+	suite := TestVectorSuite{
+		Version:       TestVectorsVersion,
+		LeafHashes:    []LeafHashVector{},
+		BalanceLeaves: []BalanceLeafVector{},
+		QueueItems:    []QueueItemVector{},
+		NftQueueItems: []QueueItemVector{},
+		Queues:        []QueueVector{},
+		Withdrawals:   []WithdrawalVector{},
+		Collections:   []CollectionVector{},
+		MerkleNodes:   []MerkleNodeVector{},
+		MerkleTrees:   []MerkleTreeVector{},
+		Settlements:   []SettlementVector{},
+	}
+	for _, data_dir := range data_dirs {
+		input_data, _, err := GetData(data_dir)
+		if err != nil {
+			return suite, err
+		}
+		// collections are recorded before the transition, which updates them in place
+		for _, collection := range input_data.NewNftCollections {
+			valid, hash := ProcessAndVerifyCollectionData(collection)
+			collection_json, err := json.Marshal(collection)
+			if err != nil {
+				return suite, err
+			}
+			suite.Collections = append(suite.Collections, CollectionVector{Collection: collection_json, Valid: valid, Hash: hexString(hash)})
+		}
+		settlement, result, err := buildSettlementVector(filepath.Base(data_dir), input_data)
+		if err != nil {
+			return suite, fmt.Errorf("%s in %s", err.Error(), data_dir)
+		}
+		suite.Settlements = append(suite.Settlements, settlement)
+		err = addStateVectors(&suite, input_data, result)
+		if err != nil {
+			return suite, fmt.Errorf("%s in %s", err.Error(), data_dir)
+		}
+		addTransactionVectors(&suite, GetQueueTransactions(input_data.Transactions, result.Rejected))
+	}
+	addMerkleVectors(&suite)
+	return suite, nil
+}
+
+// buildSettlementVector takes the message, account tree and public data from BuildSettlement, the builder main
+// signs from, so the vectors cannot drift from what the enclave settles.
+func buildSettlementVector(name string, input_data InputData) (SettlementVector, SimulationResult, error) {
+	var vector SettlementVector
+	settlement, err := BuildSettlement(input_data, NewTransitionOptions(input_data.MetaData))
+	if err != nil {
+		return vector, settlement.Execution.Result, err
+	}
+	result := settlement.Execution.Result
+	vector = SettlementVector{
+		Name:               name,
+		PrevRoot:           result.PrevRoot,
+		NewRoot:            result.Root,
+		PrevCollectionRoot: result.PrevNftRoot,
+		NewCollectionRoot:  result.NftRoot,
+		LeafSetHash:        hexString(LeafSetHash(EncodeLeafSet(settlement.Execution.AccountTree))),
+		PublicData:         hexString(settlement.PublicData),
+		PublicDataHash:     hexString(PublicDataHash(settlement.PublicData)),
+		Rejected:           result.Rejected,
+		Message:            settlement.Message,
+		Encoded:            "0x" + settlement.Message.Encode(),
+	}
+	return vector, result, nil
+}
+
+// addStateVectors records the account leaf and balance leaves of every user of the post-state, the leaf of an
+// empty account and the balances tree of the first user.
+func addStateVectors(suite *TestVectorSuite, input_data InputData, result SimulationResult) error {
+	max_num_balances, _ := strconv.Atoi(input_data.MetaData["max_num_balances"].(string))
+	for _, u := range result.UsersOrdered {
+		balances_tree, ok := GetBalancesTree(result.Balances[u], result.BalanceOrder[u], max_num_balances)
+		if !ok {
+			return fmt.Errorf("too many balances for user %s", u)
+		}
+		balances_root := hexString(balances_tree.Root)
+		suite.LeafHashes = append(suite.LeafHashes, LeafHashVector{
+			Address:             u,
+			BalancesRoot:        balances_root,
+			Nonce:               result.UsersNonce[u],
+			UsedListerNonce:     result.UserListerNonce[u],
+			UsedListerNonceHash: hexString(common.BytesToHash(result.UserListerNonce[u].Hash()).Bytes()),
+			Hash:                hexString(GetLeafHash(u, balances_root, uint(result.UsersNonce[u]), result.UserListerNonce[u])),
+		})
+		for _, asset := range result.BalanceOrder[u] {
+			if asset == ZeroAddress {
+				continue
+			}
+			value := result.Balances[u][asset]
+			currency_or_contract, amt_or_token_id, ctype, l2_minted := GetBalanceLeafFields(asset, value)
+			suite.BalanceLeaves = append(suite.BalanceLeaves, BalanceLeafVector{
+				Asset:                 asset,
+				Value:                 value,
+				CurrencyOrNftContract: currency_or_contract,
+				AmountOrNftTokenId:    amt_or_token_id,
+				AssetType:             ctype,
+				L2Minted:              l2_minted,
+				Hash:                  hexString(GetBalanceLeafHash(asset, value)),
+			})
+		}
+	}
+	empty_balances_root, _ := GetBalancesRoot(map[string]string{}, []string{}, max_num_balances)
+	empty_address := "0x" + fmt.Sprintf("%040s", strconv.FormatUint(uint64(len(result.UsersOrdered)), 16))
+	suite.LeafHashes = append(suite.LeafHashes, LeafHashVector{
+		Address:             empty_address,
+		BalancesRoot:        "0x" + empty_balances_root,
+		UsedListerNonceHash: hexString(common.Hash{}.Bytes()),
+		Hash:                hexString(GetLeafHash(empty_address, "0x"+empty_balances_root, 0, nil)),
+	})
+	if len(result.UsersOrdered) > 0 {
+		u := result.UsersOrdered[0]
+		balances_tree, _ := GetBalancesTree(result.Balances[u], result.BalanceOrder[u], max_num_balances)
+		suite.MerkleTrees = append(suite.MerkleTrees, treeVector(balances_tree))
+		suite.MerkleNodes = append(suite.MerkleNodes, nodeVectors(balances_tree)...)
+	}
+	return nil
+}
+
+func withdrawalItems(transactions []Transaction) []QueueItemVector {
+	items := []QueueItemVector{}
+	for _, t := range transactions {
+		if t.Type != "withdrawal" && t.Type != "nft_withdrawal" {
+			continue
+		}
+		item := QueueItemVector{Address: t.To, Currency: t.CurrencyOrNftContractAddress, AmountOrNftTokenId: t.AmountOrNftTokenId}
+		if t.Type == "nft_withdrawal" {
+			l2_minted := t.L2Minted
+			item.L2Minted = &l2_minted
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// addTransactionVectors records the queue items, the queue hashes and the withdrawal hash of each withdrawal
+// and of the whole batch.
+func addTransactionVectors(suite *TestVectorSuite, transactions []Transaction) {
+	queues := map[string]*QueueVector{}
+	for _, tx_type := range []string{"deposit", "contract_withdrawal", "nft_deposit", "nft_contract_withdrawal"} {
+		queues[tx_type] = &QueueVector{Type: tx_type, Items: []QueueItemVector{}}
+	}
+	for _, t := range transactions {
+		queue, ok := queues[t.Type]
+		if !ok {
+			continue
+		}
+		item := QueueItemVector{Address: t.To, Currency: t.CurrencyOrNftContractAddress, AmountOrNftTokenId: t.AmountOrNftTokenId, IsInvalid: t.IsInvalid}
+		if t.Type == "nft_deposit" || t.Type == "nft_contract_withdrawal" {
+			l2_minted := t.L2Minted
+			item.L2Minted = &l2_minted
+			hash, _ := NftQueueItemHash(t.To, t.CurrencyOrNftContractAddress, t.AmountOrNftTokenId, t.L2Minted)
+			item.Hash = hexString(hash)
+			suite.NftQueueItems = append(suite.NftQueueItems, item)
+		} else {
+			hash, _ := QueueItemHash(t.To, t.CurrencyOrNftContractAddress, t.AmountOrNftTokenId)
+			item.Hash = hexString(hash)
+			suite.QueueItems = append(suite.QueueItems, item)
+		}
+		queue.Items = append(queue.Items, item)
+	}
+	for _, tx_type := range []string{"deposit", "contract_withdrawal", "nft_deposit", "nft_contract_withdrawal"} {
+		queue := queues[tx_type]
+		var hash []byte
+		switch tx_type {
+		case "deposit", "nft_deposit":
+			hash, queue.Length, _ = QueueHash(transactions, tx_type)
+		case "contract_withdrawal":
+			hash, queue.Length, _, _, _, _ = WithdrawalQueueHash(transactions)
+		case "nft_contract_withdrawal":
+			hash, queue.Length, _, _, _, _, _ = NftWithdrawalQueueHash(transactions)
+		}
+		queue.Hash = hexString(hash)
+		suite.Queues = append(suite.Queues, *queue)
+	}
+
+	batch := []Transaction{}
+	for _, t := range transactions {
+		if t.Type != "withdrawal" && t.Type != "nft_withdrawal" {
+			continue
+		}
+		batch = append(batch, t)
+		hash, _, _, _, _, _, ok := WithdrawalHash([]Transaction{t})
+		if ok {
+			suite.Withdrawals = append(suite.Withdrawals, WithdrawalVector{Withdrawals: withdrawalItems([]Transaction{t}), Hash: hexString(hash)})
+		}
+	}
+	if len(batch) > 1 {
+		hash, _, _, _, _, _, ok := WithdrawalHash(batch)
+		if ok {
+			suite.Withdrawals = append(suite.Withdrawals, WithdrawalVector{Withdrawals: withdrawalItems(batch), Hash: hexString(hash)})
+		}
+	}
+}
+
+func treeVector(tree *MerkleTree) MerkleTreeVector {
+	leaves := []string{}
+	for _, node := range tree.Nodes[0] {
+		leaves = append(leaves, hexString(node.Data))
+	}
+	return MerkleTreeVector{Leaves: leaves, Root: hexString(tree.Root)}
+}
+
+// nodeVectors takes the first node of every level above the leaves with the two children it hashes.
+func nodeVectors(tree *MerkleTree) []MerkleNodeVector {
+	nodes := []MerkleNodeVector{}
+	for level := 1; level < len(tree.Nodes); level++ {
+		nodes = append(nodes, MerkleNodeVector{
+			Left:  hexString(tree.Nodes[level-1][0].Data),
+			Right: hexString(tree.Nodes[level-1][1].Data),
+			Hash:  hexString(tree.Nodes[level][0].Data),
+		})
+	}
+	return nodes
+}
+
+// addMerkleVectors adds trees of fixed leaves, including an odd leaf count where the last leaf is repeated.
+func addMerkleVectors(suite *TestVectorSuite) {
+	for _, size := range []int{2, 3, 4} {
+		leaves := [][]byte{}
+		for i := 0; i < size; i++ {
+			leaves = append(leaves, crypto.Keccak256([]byte(fmt.Sprintf("leaf %d", i))))
+		}
+		tree := NewMerkleTreeSync(leaves)
+		suite.MerkleTrees = append(suite.MerkleTrees, MerkleTreeVector{Leaves: treeVector(tree).Leaves[:size], Root: hexString(tree.Root)})
+	}
+	suite.MerkleNodes = append(suite.MerkleNodes, MerkleNodeVector{
+		Left:  hexString(common.Hash{}.Bytes()),
+		Right: hexString(common.Hash{}.Bytes()),
+		Hash:  hexString(NewMerkleTreeSync([][]byte{common.Hash{}.Bytes(), common.Hash{}.Bytes()}).Root),
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+
+	solsha3 "github.com/miguelmota/go-solidity-sha3"
+)
+
+// The committed suite is what the contract tests import. A change to any covered hash shows up here first;
+// regenerate with `go run . test-vectors test_data/test_vectors.json test_data` and bump TestVectorsVersion
+// when the change is intended.
+func TestVectorsMatchCommittedSuite(t *testing.T) {
+	suite, err := BuildTestVectors([]string{"./test_data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := json.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := os.ReadFile("test_data/test_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(generated, '\n'), committed) {
+		t.Fatal("test vectors differ from test_data/test_vectors.json")
+	}
+}
+
+func TestVectorsAreSelfConsistent(t *testing.T) {
+	suite, err := BuildTestVectors([]string{"./test_data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode := func(value string) []byte {
+		data, err := hex.DecodeString(strings.TrimPrefix(value, "0x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	for _, node := range suite.MerkleNodes {
+		hash := solsha3.SoliditySHA3([]string{"uint256", "uint256"}, []interface{}{new(big.Int).SetBytes(decode(node.Left)), new(big.Int).SetBytes(decode(node.Right))})
+		if hexString(hash) != node.Hash {
+			t.Errorf("merkle node %s %s hashes to %x, expected %s", node.Left, node.Right, hash, node.Hash)
+		}
+	}
+	for _, leaf := range suite.LeafHashes {
+		hash := solsha3.SoliditySHA3([]string{"address", "bytes32", "uint256", "bytes32"}, []interface{}{leaf.Address, leaf.BalancesRoot, new(big.Int).SetUint64(leaf.Nonce), decode(leaf.UsedListerNonceHash)})
+		if hexString(hash) != leaf.Hash {
+			t.Errorf("leaf of %s hashes to %x, expected %s", leaf.Address, hash, leaf.Hash)
+		}
+	}
+	for _, settlement := range suite.Settlements {
+		message, err := DecodeSettlementMessage(settlement.Encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message != settlement.Message {
+			t.Errorf("settlement %s message does not round trip", settlement.Name)
+		}
+		if hexString(PublicDataHash(decode(settlement.PublicData))) != settlement.PublicDataHash {
+			t.Errorf("settlement %s public data hash mismatch", settlement.Name)
+		}
+		if settlement.Message.PublicDataHash.Hex() != settlement.PublicDataHash || settlement.Message.NewRoot.Hex() != settlement.NewRoot {
+			t.Errorf("settlement %s message does not carry its roots", settlement.Name)
+		}
+	}
+	if len(suite.Collections) == 0 || !suite.Collections[0].Valid {
+		t.Error("expected the signed test collection to verify")
+	}
+}
+
+func TestSettlementVectorsMatchBuilder(t *testing.T) {
+	suite, err := BuildTestVectors([]string{"./test_data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input_data, _, err := GetData("./test_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settlement, err := BuildSettlement(input_data, NewTransitionOptions(input_data.MetaData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suite.Settlements) != 1 || suite.Settlements[0].Message != settlement.Message {
+		t.Fatalf("settlement vector does not carry the message main signs")
+	}
+	if suite.Settlements[0].LeafSetHash != hexString(LeafSetHash(EncodeLeafSet(settlement.Execution.AccountTree))) {
+		t.Errorf("settlement vector leaf set differs from the tree main publishes")
+	}
+}
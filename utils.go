@@ -1,17 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/big"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	solsha3 "github.com/miguelmota/go-solidity-sha3"
 )
 
@@ -21,6 +24,10 @@ type SettlementRequest struct {
 	NftRoot                              string                 `json:"nftRoot" binding:"required"`
 	AggregatedSignature                  string                 `json:"aggregatedSignature" binding:"required"`
 	AggregatedPublicKeyComponents        []string               `json:"aggregatedPublicKeyComponents" binding:"required"`
+	SigningThreshold                     int                    `json:"signingThreshold"`
+	Signers                              []uint                 `json:"signers"`
+	SignerBitmap                         string                 `json:"signerBitmap"`
+	FailedToDecrypt                      []uint                 `json:"failedToDecrypt"`
 	BlockNumber                          string                 `json:"blockNumber" binding:"required"`
 	QueueHash                            string                 `json:"queueHash" binding:"required"` // deposit
 	QueueIndex                           int                    `json:"queueIndex"`
@@ -42,9 +49,22 @@ type SettlementRequest struct {
 	NftContractWithdrawalQueueIndex      int                    `json:"nftContractWithdrawalQueueIndex"`
 	NftContractWithdrawalL2Minted        []bool                 `json:"nftContractWithdrawalL2Minted" binding:"required"`
 	Message                              string                 `json:"message" binding:"required"` // message
+	SettlementMessage                    SettlementMessage      `json:"settlementMessage"`
 	UsersUpdated                         map[string]interface{} `json:"usersUpdated" binding:"required"`
 	NftCollectionsCreated                map[int]string         `json:"nftCollectionsCreated" binding:"required"`
-	UserListerNonce                      map[string][]uint      `json:"usedListerNonce" binding:"required"`
+	NftCollectionsUpdated                map[int]string         `json:"nftCollectionsUpdated"`
+	NftCollectionsData                   map[int]interface{}    `json:"nftCollectionsData"`
+	UserBalanceOrder                     map[string][]string    `json:"userBalanceOrder"`
+	ExecutionTraceHash                   string                 `json:"executionTraceHash,omitempty"`
+	RejectedTransactions                 []RejectedTransaction  `json:"rejectedTransactions,omitempty"`
+	RejectedTransactionsHash             string                 `json:"rejectedTransactionsHash,omitempty"`
+	PublicData                           string                 `json:"publicData"`
+	PublicDataHash                       string                 `json:"publicDataHash"`
+	LeafSetHash                          string                 `json:"leafSetHash"`
+	UserListerNonce                      map[string]*NonceSet   `json:"usedListerNonce" binding:"required"`
+	UsedListerNonceFormat                uint                   `json:"usedListerNonceFormat"`
+	NumeFeesCollected                    map[string]string      `json:"numeFeesCollected"`
+	NftMintCounts                        map[string]interface{} `json:"nftMintCounts"`
 	SignatureRecordedAt                  time.Time              `json:"signatureRecordedAt" binding:"required"`
 	SettlementStartedAt                  time.Time              `json:"settlementStartedAt" binding:"required"`
 }
@@ -63,19 +83,8 @@ func TimeTrack(start time.Time, name string) {
 	log.Printf("%s took %s", name, elapsed)
 }
 
-func GetLeafHash(address string, root string, nonce uint, used_lister_nonce []uint) []byte {
-	types := []string{}
-	values := []interface{}{}
-	optimized_used_lister_nonce := GetOptimizedNonce(used_lister_nonce)
-
-	for _, nonce := range optimized_used_lister_nonce {
-		types = append(types, "uint256")
-		values = append(values, big.NewInt(int64(nonce)))
-	}
-	used_lister_nonce_hash := solsha3.SoliditySHA3(types, values)
-	if len(used_lister_nonce) == 0 {
-		used_lister_nonce_hash = []byte{}
-	}
+func GetLeafHash(address string, root string, nonce uint, used_lister_nonce *NonceSet) []byte {
+	used_lister_nonce_hash := used_lister_nonce.Hash()
 	nonce_bi := big.NewInt(int64(nonce))
 	hash := solsha3.SoliditySHA3(
 		[]string{"address", "bytes32", "uint256", "bytes32"},
@@ -97,8 +106,6 @@ func NestedMapsEqual(m1, m2 map[string]map[string]string) bool {
 	}
 	for k, v1 := range m1 {
 		if v2, ok := m2[k]; !ok || !MapsEqual(v1, v2) {
-			PrettyPrint("v1", v1)
-			PrettyPrint("v2", v2)
 			return false
 		}
 	}
@@ -117,7 +124,22 @@ func MapsEqual(m1, m2 map[string]string) bool {
 	return reflect.DeepEqual(m1, m2)
 }
 
+const ZeroAddress = "0x0000000000000000000000000000000000000000"
+
+// GetBalancesRoot places each asset of user_balance_order in its slot of the balances tree. It fails when the
+// order needs more than max_num_balances slots.
 func GetBalancesRoot(balances map[string]string, user_balance_order []string, max_num_balances int) (string, bool) {
+	balances_tree, ok := GetBalancesTree(balances, user_balance_order, max_num_balances)
+	if !ok {
+		return "", false
+	}
+	return hex.EncodeToString(balances_tree.Root), true
+}
+
+func GetBalancesTree(balances map[string]string, user_balance_order []string, max_num_balances int) (*MerkleTree, bool) {
+	if len(user_balance_order) > max_num_balances {
+		return nil, false
+	}
 	balances_tree := &MerkleTree{}
 	var balances_data = make([][]byte, max_num_balances)
 	var wg sync.WaitGroup
@@ -134,29 +156,7 @@ func GetBalancesRoot(balances map[string]string, user_balance_order []string, ma
 		wg.Add(1)
 		go func(i int) {
 			if i < len(user_balance_order) && user_balance_order[i] != "0x0000000000000000000000000000000000000000" {
-				amt_or_token_id := balances[user_balance_order[i]]
-				currency_or_contract := user_balance_order[i]
-				ctype := "0"
-				l2_minted := "0"
-				if len(user_balance_order[i]) > 42 {
-					amt_or_token_id = strings.Split(user_balance_order[i], "-")[1]
-					currency_or_contract = strings.Split(user_balance_order[i], "-")[0]
-					ctype = "1"
-					if balances[user_balance_order[i]] == "l2_minted" {
-						l2_minted = "1"
-					}
-				}
-				cb2, _ := new(big.Int).SetString(amt_or_token_id, 10)
-				hash := solsha3.SoliditySHA3(
-					[]string{"address", "uint256", "uint256", "uint256"},
-					[]interface{}{
-						currency_or_contract,
-						cb2,
-						ctype,
-						l2_minted,
-					},
-				)
-				balances_data[i] = hash
+				balances_data[i] = GetBalanceLeafHash(user_balance_order[i], balances[user_balance_order[i]])
 			} else {
 				balances_data[i] = zero_hash
 			}
@@ -165,7 +165,95 @@ func GetBalancesRoot(balances map[string]string, user_balance_order []string, ma
 	}
 	wg.Wait()
 	balances_tree = NewMerkleTree(balances_data)
-	return hex.EncodeToString(balances_tree.Root), true
+	return balances_tree, true
+}
+
+// GetNewBalanceOrder allocates balance slots for the post-state. Assets keep their previous slot, slots of NFTs
+// the user no longer holds and of token balances that dropped to zero are freed by writing ZeroAddress, and new
+// assets take the lowest free slot in sorted order with the fee currency first. The fee currency always keeps a
+// slot. It fails when the user needs more than max_num_balances slots.
+func GetNewBalanceOrder(old_order []string, balances map[string]string, fee_currency string, max_num_balances int) ([]string, error) {
+	holds := func(asset string) bool {
+		value, ok := balances[asset]
+		if !ok {
+			return false
+		}
+		return asset == fee_currency || len(asset) > 42 || (value != "0" && value != "")
+	}
+	order := make([]string, len(old_order))
+	copy(order, old_order)
+	placed := make(map[string]bool)
+	free_slots := []int{}
+	for i, asset := range order {
+		if !holds(asset) || placed[asset] {
+			order[i] = ZeroAddress
+			free_slots = append(free_slots, i)
+			continue
+		}
+		placed[asset] = true
+	}
+	new_assets := []string{}
+	for asset := range balances {
+		if !placed[asset] && holds(asset) {
+			new_assets = append(new_assets, asset)
+		}
+	}
+	sort.Slice(new_assets, func(i, j int) bool {
+		if new_assets[i] == fee_currency || new_assets[j] == fee_currency {
+			return new_assets[i] == fee_currency
+		}
+		return new_assets[i] < new_assets[j]
+	})
+	for _, asset := range new_assets {
+		if len(free_slots) > 0 {
+			order[free_slots[0]] = asset
+			free_slots = free_slots[1:]
+		} else {
+			order = append(order, asset)
+		}
+	}
+	for len(order) > 0 && order[len(order)-1] == ZeroAddress {
+		order = order[:len(order)-1]
+	}
+	if len(order) > max_num_balances {
+		return order, fmt.Errorf("balance slots exceeded %d of %d", len(order), max_num_balances)
+	}
+	return order, nil
+}
+
+// GetBalanceLeafHash encodes one balance slot as (address, amount or token id, type, l2 minted).
+// The type is 0 for ERC20 tokens, 1 for NFTs keyed as "contract-tokenId" and 2 for NativeCurrency.
+func GetBalanceLeafHash(asset string, value string) []byte {
+	currency_or_contract, amt_or_token_id, ctype, l2_minted := GetBalanceLeafFields(asset, value)
+	cb2, _ := new(big.Int).SetString(amt_or_token_id, 10)
+	return solsha3.SoliditySHA3(
+		[]string{"address", "uint256", "uint256", "uint256"},
+		[]interface{}{
+			currency_or_contract,
+			cb2,
+			ctype,
+			l2_minted,
+		},
+	)
+}
+
+// GetBalanceLeafFields splits a balance into the fields hashed by GetBalanceLeafHash.
+func GetBalanceLeafFields(asset string, value string) (string, string, string, string) {
+	amt_or_token_id := value
+	currency_or_contract := asset
+	ctype := "0"
+	l2_minted := "0"
+	if len(asset) > 42 {
+		amt_or_token_id = strings.Split(asset, "-")[1]
+		currency_or_contract = strings.Split(asset, "-")[0]
+		ctype = "1"
+		if value == "l2_minted" {
+			l2_minted = "1"
+		}
+	} else if IsNativeCurrency(asset) {
+		ctype = "2"
+	}
+	return currency_or_contract, amt_or_token_id, ctype, l2_minted
 }
 
 type HasProcess struct {
@@ -191,18 +279,28 @@ func updateHasProcess(has_process *HasProcess, transaction Transaction) {
 	}
 }
 
-func verifyMintData(transaction Transaction, nft_collections_map map[string]map[string]interface{}) error {
+func verifyMintData(transaction Transaction, nft_collections_map map[string]map[string]interface{}, meta_data map[string]interface{}) error {
 	{
-		message := solsha3.SoliditySHA3(
-			[]string{"uint256", "address", "address", "uint256", "address", "uint256"},
-			[]interface{}{strconv.Itoa(int(transaction.Nonce)), transaction.CurrencyOrNftContractAddress, transaction.To, transaction.MintFees, transaction.MintFeesToken, transaction.NumeFees},
-		)
+		collection, ok := nft_collections_map[transaction.CurrencyOrNftContractAddress]
+		if !ok {
+			return fmt.Errorf("nft collection not found")
+		}
+		mint_rules, err := GetMintRules(collection)
+		if err != nil {
+			return err
+		}
+		phased := mint_rules != nil && len(mint_rules.Phases) > 0
+		types := []string{"uint256", "address", "address", "uint256", "address", "uint256"}
+		values := []interface{}{strconv.Itoa(int(transaction.Nonce)), transaction.CurrencyOrNftContractAddress, transaction.To, transaction.MintFees, transaction.MintFeesToken, transaction.NumeFees}
+		// the minter signs the phase it mints in, the operator only supplies CreatedAt
+		if phased {
+			types = append(types, "uint256")
+			values = append(values, strconv.Itoa(int(transaction.MintPhase)))
+		}
+		message := solsha3.SoliditySHA3(types, values)
 		if !EthVerify(hex.EncodeToString(message), transaction.Signature, transaction.To) {
 			return fmt.Errorf("invalid mint signature")
 		}
-		if _, ok := nft_collections_map[transaction.CurrencyOrNftContractAddress]; !ok {
-			return fmt.Errorf("nft collection not found")
-		}
 		mint_end_specifed, ok := new(big.Int).SetString(nft_collections_map[transaction.CurrencyOrNftContractAddress]["MintEnd"].(string), 10)
 		if !ok {
 			return fmt.Errorf("nft collection mint end is not valid")
@@ -221,30 +319,279 @@ func verifyMintData(transaction Transaction, nft_collections_map map[string]map[
 		if mint_start_specifed.Cmp(token_id) != -1 {
 			return fmt.Errorf("nft collection token id should be greater than mint start")
 		}
-		for _, v := range nft_collections_map[transaction.CurrencyOrNftContractAddress]["MintUsers"].([]interface{}) {
-			if v.(string) == transaction.From {
-				return fmt.Errorf("user does not have minting rights")
+		allowlist := collection
+		mint_fees := fmt.Sprint(collection["MintFees"])
+		mint_fees_token, _ := collection["MintFeesToken"].(string)
+		if mint_rules != nil {
+			if phased {
+				if err := CheckMintTimestamp(transaction.CreatedAt, meta_data); err != nil {
+					return err
+				}
+				phase, err := mint_rules.ActivePhase(transaction.CreatedAt)
+				if err != nil {
+					return err
+				}
+				if transaction.MintPhase >= uint(len(mint_rules.Phases)) || phase != &mint_rules.Phases[transaction.MintPhase] {
+					return fmt.Errorf("signed mint phase %d is not active", transaction.MintPhase)
+				}
+				allowlist = phase.Allowlist
+				mint_fees = phase.MintFees.String()
+				mint_fees_token = phase.MintFeesToken
+			}
+			minted, wallet_minted, err := GetMintCounts(collection, transaction.To)
+			if err != nil {
+				return err
+			}
+			if mint_rules.MaxSupply.Sign() == 1 && minted.Cmp(mint_rules.MaxSupply) != -1 {
+				return fmt.Errorf("nft collection max supply reached")
 			}
+			if mint_rules.MaxMintsPerWallet.Sign() == 1 && wallet_minted.Cmp(mint_rules.MaxMintsPerWallet) != -1 {
+				return fmt.Errorf("user reached max mints per wallet")
+			}
+		}
+		if transaction.MintFees != mint_fees || !strings.EqualFold(transaction.MintFeesToken, mint_fees_token) {
+			return fmt.Errorf("mint fees mismatch expected %s %s got %s %s", mint_fees, mint_fees_token, transaction.MintFees, transaction.MintFeesToken)
+		}
+		allowed, err := IsMintAllowed(allowlist, transaction.To, transaction.MintProof, transaction.MintProofIndex)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("user does not have minting rights")
+		}
+	}
+	return nil
+}
+
+// CheckMintTimestamp bounds the operator supplied time of a phased mint by the settlement window,
+// which must be set for such mints.
+func CheckMintTimestamp(created_at time.Time, meta_data map[string]interface{}) error {
+	start, has_start := meta_data["settlement_start_time"].(float64)
+	end, has_end := meta_data["settlement_end_time"].(float64)
+	if !has_start || !has_end {
+		return fmt.Errorf("settlement window missing for phased mint")
+	}
+	if created_at.IsZero() {
+		return fmt.Errorf("mint timestamp missing")
+	}
+	if created_at.Unix() < int64(start) || created_at.Unix() > int64(end) {
+		return fmt.Errorf("mint timestamp outside settlement window")
+	}
+	return nil
+}
+
+// collectionChangeFields are the signed creation fields that collection_update and collection_transfer may change.
+var collectionChangeFields = []string{"Owner", "BaseUri", "RoyaltyFeesPercetage", "MintFees", "MintFeesToken"}
+
+// ApplyCollectionChange checks a collection_update or collection_transfer against the current owner and
+// replaces the collection in nft_collections_map with a changed copy. The copy keeps the creation values of
+// the changed fields in CreationData and appends the signed change to Changes, so VerifyCollectionData can
+// check the collection again in later batches.
+func ApplyCollectionChange(transaction Transaction, nft_collections_map map[string]map[string]interface{}) error {
+	collection, ok := nft_collections_map[transaction.CurrencyOrNftContractAddress]
+	if !ok {
+		return fmt.Errorf("nft collection not found")
+	}
+	changed, err := changeCollection(transaction, collection)
+	if err != nil {
+		return err
+	}
+	if _, ok := collection["CreationData"]; !ok {
+		creation_data := make(map[string]interface{})
+		for _, field := range collectionChangeFields {
+			creation_data[field] = collection[field]
 		}
+		changed["CreationData"] = creation_data
 	}
+	change := map[string]interface{}{
+		"Type":      transaction.Type,
+		"From":      transaction.From,
+		"Nonce":     float64(transaction.Nonce),
+		"Signature": transaction.Signature,
+	}
+	if transaction.Type == "collection_transfer" {
+		change["To"] = transaction.To
+	} else {
+		change["BaseUri"] = transaction.BaseUri
+		change["RoyaltyFeesPercetage"] = transaction.RoyaltyFeesPercetage
+		change["MintFees"] = transaction.MintFees
+		change["MintFeesToken"] = transaction.MintFeesToken
+	}
+	changes, _ := collection["Changes"].([]interface{})
+	changed["Changes"] = append(append([]interface{}{}, changes...), change)
+	nft_collections_map[transaction.CurrencyOrNftContractAddress] = changed
 	return nil
 }
 
-func binarySearch(array []uint, to_search uint) bool {
-	found := false
-	low := 0
-	high := len(array) - 1
-	for low <= high {
-		mid := (low + high) / 2
-		if array[mid] == to_search {
-			found = true
-			break
+// changeCollection checks a change against the owner of collection and returns a copy with the change applied.
+func changeCollection(transaction Transaction, collection map[string]interface{}) (map[string]interface{}, error) {
+	owner, _ := collection["Owner"].(string)
+	if !strings.EqualFold(owner, transaction.From) {
+		return nil, fmt.Errorf("only the collection owner can change the collection")
+	}
+	changed := make(map[string]interface{})
+	for k, v := range collection {
+		changed[k] = v
+	}
+	if transaction.Type == "collection_transfer" {
+		if !common.IsHexAddress(transaction.To) || common.HexToAddress(transaction.To) == (common.Address{}) {
+			return nil, fmt.Errorf("invalid new collection owner")
+		}
+		message := CollectionTransferMessage(transaction.From, transaction.CurrencyOrNftContractAddress, transaction.To, transaction.Nonce)
+		if !EthVerify(message, transaction.Signature, owner) {
+			return nil, fmt.Errorf("invalid collection transfer signature")
+		}
+		changed["Owner"] = strings.ToLower(transaction.To)
+		return changed, nil
+	}
+	if transaction.Type != "collection_update" {
+		return nil, fmt.Errorf("invalid collection change type %s", transaction.Type)
+	}
+	if transaction.BaseUri == "" {
+		return nil, fmt.Errorf("nft collection base uri is not valid")
+	}
+	royalty, ok := new(big.Int).SetString(transaction.RoyaltyFeesPercetage, 10)
+	if !ok || royalty.Sign() < 0 || royalty.Cmp(big.NewInt(100)) == 1 {
+		return nil, fmt.Errorf("nft collection royalty percentage is not valid")
+	}
+	mint_fees, ok := new(big.Int).SetString(transaction.MintFees, 10)
+	if !ok || mint_fees.Sign() < 0 {
+		return nil, fmt.Errorf("nft collection mint fees is not valid")
+	}
+	if !common.IsHexAddress(transaction.MintFeesToken) {
+		return nil, fmt.Errorf("nft collection mint fees token is not valid")
+	}
+	message := CollectionUpdateMessage(transaction.From, transaction.CurrencyOrNftContractAddress, transaction.BaseUri, transaction.RoyaltyFeesPercetage, transaction.MintFees, transaction.MintFeesToken, transaction.Nonce)
+	if !EthVerify(message, transaction.Signature, owner) {
+		return nil, fmt.Errorf("invalid collection update signature")
+	}
+	changed["BaseUri"] = transaction.BaseUri
+	changed["RoyaltyFeesPercetage"] = royalty.String()
+	changed["MintFees"] = mint_fees.String()
+	changed["MintFeesToken"] = transaction.MintFeesToken
+	return changed, nil
+}
+
+// VerifyCollectionData checks a collection already committed in the collection tree and returns its leaf hash.
+// The creation signature is checked over the CreationData values, then every recorded change is replayed
+// against the owner at that time, with each signer's nonces increasing, and must end at the collection's fields.
+func VerifyCollectionData(collection map[string]interface{}) ([]byte, error) {
+	contract, _ := collection["ContractAddress"].(string)
+	if _, ok := collection["Signature"].(string); !ok {
+		return nil, fmt.Errorf("nft collection %s has no creation signature", contract)
+	}
+	current := make(map[string]interface{})
+	for k, v := range collection {
+		current[k] = v
+	}
+	if creation_data, ok := collection["CreationData"].(map[string]interface{}); ok {
+		for _, field := range collectionChangeFields {
+			current[field] = creation_data[field]
+		}
+	}
+	if _, ok := current["Owner"].(string); !ok {
+		return nil, fmt.Errorf("nft collection %s owner is not valid", contract)
+	}
+	if verified, _ := ProcessAndVerifyCollectionData(current); !verified {
+		return nil, fmt.Errorf("invalid creation signature for nft collection %s", contract)
+	}
+	last_nonce := make(map[string]uint)
+	changes, _ := collection["Changes"].([]interface{})
+	for i, c := range changes {
+		change, ok := c.(map[string]interface{})
+		nonce, has_nonce := change["Nonce"].(float64)
+		if !ok || !has_nonce {
+			return nil, fmt.Errorf("change %d of nft collection %s is not valid", i, contract)
+		}
+		field := func(name string) string {
+			value, _ := change[name].(string)
+			return value
+		}
+		transaction := Transaction{
+			Type:                         field("Type"),
+			From:                         field("From"),
+			To:                           field("To"),
+			CurrencyOrNftContractAddress: contract,
+			BaseUri:                      field("BaseUri"),
+			RoyaltyFeesPercetage:         field("RoyaltyFeesPercetage"),
+			MintFees:                     field("MintFees"),
+			MintFeesToken:                field("MintFeesToken"),
+			Nonce:                        uint(nonce),
+			Signature:                    field("Signature"),
+		}
+		signer := strings.ToLower(transaction.From)
+		if previous, ok := last_nonce[signer]; ok && transaction.Nonce <= previous {
+			return nil, fmt.Errorf("change %d of nft collection %s reuses a nonce", i, contract)
+		}
+		last_nonce[signer] = transaction.Nonce
+		var err error
+		current, err = changeCollection(transaction, current)
+		if err != nil {
+			return nil, fmt.Errorf("change %d of nft collection %s: %s", i, contract, err.Error())
+		}
+	}
+	for _, field := range collectionChangeFields {
+		if !strings.EqualFold(fmt.Sprint(current[field]), fmt.Sprint(collection[field])) {
+			return nil, fmt.Errorf("nft collection %s %s does not match its recorded changes", contract, field)
+		}
+	}
+	return GetCollectionLeafHash(collection)
+}
+
+func GetMintAllowlistRoot(collection map[string]interface{}) ([]byte, error) {
+	root_hex, _ := collection["MintUsersRoot"].(string)
+	if root_hex == "" {
+		return nil, nil
+	}
+	root, err := hex.DecodeString(strings.TrimPrefix(root_hex, "0x"))
+	if err != nil || len(root) != 32 {
+		return nil, fmt.Errorf("nft collection mint users root is not valid")
+	}
+	return root, nil
+}
+
+func MintAllowlistLeaf(user string) []byte {
+	return solsha3.SoliditySHA3([]string{"address"}, []interface{}{strings.ToLower(user)})
+}
+
+// VerifyMintAllowlistProof walks proof from the user's leaf at index up to root, hashing pairs the same
+// way MerkleTree does.
+func VerifyMintAllowlistProof(root []byte, user string, proof []string, index uint) bool {
+	hash := MintAllowlistLeaf(user)
+	position := index
+	for _, p := range proof {
+		neighbour, err := hex.DecodeString(strings.TrimPrefix(p, "0x"))
+		if err != nil {
+			return false
 		}
-		if array[mid] < to_search {
-			low = mid + 1
+		if position%2 == 0 {
+			hash = solsha3.SoliditySHA3([]string{"uint256", "uint256"}, []interface{}{new(big.Int).SetBytes(hash), new(big.Int).SetBytes(neighbour)})
 		} else {
-			high = mid - 1
+			hash = solsha3.SoliditySHA3([]string{"uint256", "uint256"}, []interface{}{new(big.Int).SetBytes(neighbour), new(big.Int).SetBytes(hash)})
+		}
+		position /= 2
+	}
+	return position == 0 && bytes.Equal(hash, root)
+}
+
+// IsMintAllowed checks user against the collection allowlist. A collection with a MintUsersRoot requires
+// a Merkle proof, otherwise the inline MintUsers list is used and an empty list leaves minting open.
+func IsMintAllowed(collection map[string]interface{}, user string, proof []string, index uint) (bool, error) {
+	root, err := GetMintAllowlistRoot(collection)
+	if err != nil {
+		return false, err
+	}
+	if root != nil {
+		return VerifyMintAllowlistProof(root, user, proof, index), nil
+	}
+	mint_users, _ := collection["MintUsers"].([]interface{})
+	if len(mint_users) == 0 {
+		return true, nil
+	}
+	for _, v := range mint_users {
+		if mint_user, ok := v.(string); ok && strings.EqualFold(mint_user, user) {
+			return true, nil
 		}
 	}
-	return found
+	return false, nil
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetNewBalanceOrder(t *testing.T) {
+	tests := []struct {
+		old_order []string
+		balances  map[string]string
+		expected  []string
+		valid     bool
+	}{
+		{nil, map[string]string{"0xb": "1", testFeeCurrency: "0", "0xa": "2"}, []string{testFeeCurrency, "0xa", "0xb"}, true},
+		{[]string{testFeeCurrency, "0xc-1", "0xb"}, map[string]string{testFeeCurrency: "1", "0xb": "1", "0xa": "1", "0xd": "1"}, []string{testFeeCurrency, "0xa", "0xb", "0xd"}, true},
+		{[]string{testFeeCurrency, "0xb", "0xc-1"}, map[string]string{testFeeCurrency: "1", "0xb": "1"}, []string{testFeeCurrency, "0xb"}, true},
+		{[]string{testFeeCurrency, "0xc-1", "0xb"}, map[string]string{testFeeCurrency: "1", "0xb": "1"}, []string{testFeeCurrency, ZeroAddress, "0xb"}, true},
+		{[]string{testFeeCurrency, "0xa", "0xb"}, map[string]string{testFeeCurrency: "0", "0xa": "0", "0xb": "1", "0xc": "5"}, []string{testFeeCurrency, "0xc", "0xb"}, true},
+		{[]string{testFeeCurrency, "0xa", "0xb", "0xc"}, map[string]string{testFeeCurrency: "1", "0xa": "1", "0xb": "1", "0xc": "1", "0xd": "1"}, nil, false},
+	}
+	for i, test := range tests {
+		order, err := GetNewBalanceOrder(test.old_order, test.balances, testFeeCurrency, 4)
+		if (err == nil) != test.valid {
+			t.Errorf("Test %d: expected valid %v got error %v", i, test.valid, err)
+			continue
+		}
+		if test.valid && !reflect.DeepEqual(order, test.expected) {
+			t.Errorf("Test %d: expected %v got %v", i, test.expected, order)
+		}
+	}
+	if _, ok := GetBalancesRoot(map[string]string{}, []string{"0xa", "0xb", "0xc"}, 2); ok {
+		t.Errorf("Expected GetBalancesRoot to reject an order over capacity")
+	}
+}